@@ -0,0 +1,62 @@
+package apollon
+
+import (
+	"log"
+	"math/rand"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Deletes the account with all data stored for it and closes the connection
+// of the user. The former contacts and the remaining members of the groups of
+// the user are told about the deletion.
+func DeleteAccount(userId uint32, onlineC chan OnlineMessage, fwdC chan ForwardMessage, newCC chan ConnMessage) error {
+	contacts := database.GetContacts(userId)
+	groups := database.GetGroupsOfUser(userId)
+	err := database.DeleteUser(userId)
+	if err != nil {
+		return err
+	}
+	newCC <- ConnMessage{
+		Id:         userId,
+		Disconnect: true,
+		Close:      true,
+	}
+
+	for _, v := range contacts {
+		PushContactUpdate(v, packets.CONTACT_DELETED, userId, onlineC, fwdC)
+	}
+	for _, v := range groups {
+		group, err := database.GetGroup(v.GroupId)
+		if err != nil {
+			// The user was the last member
+			continue
+		}
+		notifyGroupMembers(packets.Header{UserId: userId, MessageId: rand.Uint32()}, group, onlineC, fwdC)
+	}
+	log.Printf("Notified %d contacts and %d groups about the deletion of %d", len(contacts), len(groups), userId)
+	return nil
+}
+
+// Answers the deletion request of the user before the account is removed, as
+// the connection is closed afterwards. Returns whether the account was deleted.
+func HandleDeleteAccount(header packets.Header, connection net.Conn, onlineC chan OnlineMessage, fwdC chan ForwardMessage, newCC chan ConnMessage) bool {
+	if !database.IdExists(header.UserId) {
+		SendError(header, packets.ERR_CONTACT, "user not found", connection)
+		return false
+	}
+	raw, err := packets.SerializePacket(packets.CreateDeleteAccount(header.UserId, header.MessageId), nil)
+	if err != nil {
+		log.Printf("Failed to serialize deletion answer")
+		return false
+	}
+	connection.Write(raw)
+	err = DeleteAccount(header.UserId, onlineC, fwdC, newCC)
+	if err != nil {
+		log.Printf("Failed to delete account %d: %s", header.UserId, err)
+		return false
+	}
+	return true
+}
@@ -6,12 +6,12 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"net"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"anzu.cloudsheeptech.com/database"
@@ -20,6 +20,15 @@ import (
 
 var MESSAGE_QUEUE_SIZE int = 50
 
+// Connections that do not log in or create an account within the timeout are
+// closed. Connections that are already handled read the timeout as well, so
+// the time.Duration is stored atomically.
+var loginTimeout atomic.Int64
+
+func init() {
+	loginTimeout.Store(int64(30 * time.Second))
+}
+
 type StoreMessage struct {
 	MessageID uint32
 	Type      int16
@@ -34,80 +43,132 @@ type ConnMessage struct {
 	Connection net.Conn
 	Id         uint32
 	Disconnect bool
+	// Closes the registered connection of the user as well
+	Close bool
 }
 
+// Asks the online registry whether the user is connected. The registry
+// answers on the reply channel of the request with Online set accordingly.
 type OnlineMessage struct {
 	Id     uint32
 	Online bool
+	Reply  chan OnlineMessage
 }
 
+// Guards the map of connected users, which the registry, the forwarding and
+// the online check share
+var connLock sync.Mutex
+
 func HandleOldMessages(id uint32, connection net.Conn) {
 	log.Printf("Handling messages for \"%d\"", id)
-	messages, err := database.ReadMessagesFromFile(fmt.Sprint(id) + ".json")
+	takeStoredTexts(id)
+	messages, err := database.TakeMailbox(id)
 	if err != nil {
 		log.Printf("No messages for client \"%d\" found", id)
-	} else {
-		log.Printf("Sending %d messages from %d", len(messages), id)
-		random := rand.NewSource(time.Now().UnixNano())
-		initMessageId := uint32(random.Int63())
-		for _, v := range messages {
-			// TODO: Fix this, for now this is only to fix the compiliation error
-			log.Print("Sending next packet...")
-			header := packets.Header{
-				Category:  packets.CAT_DATA,
-				Type:      packets.D_TEXT,
-				UserId:    v.ContactUserId,
-				MessageId: initMessageId,
-			}
-			v.ContactUserId = id
-			initMessageId += 1
-			raw, err := packets.SerializePacket(header, v)
-			if err != nil {
-				log.Printf("Failed to serialize packet: %s", err)
-				continue
-			}
-			log.Printf("Sending:\n%s", hex.Dump(raw))
-			connection.Write(raw)
+		return
+	}
+	log.Printf("Sending %d messages to %d", len(messages), id)
+	for _, v := range messages {
+		log.Print("Sending next packet...")
+		var payload any
+		if len(v.Payload) > 0 {
+			payload = v.Payload
+		}
+		raw, err := packets.SerializePacket(v.Header, payload)
+		if err != nil {
+			log.Printf("Failed to serialize packet: %s", err)
+			continue
 		}
+		// The payload is not logged, it may contain texts of the users
+		log.Printf("Sending:\n%s", hex.Dump(raw[:10]))
+		// Packets the client cannot take go back to the mailbox
+		deliver(id, connection, raw)
 	}
-	// TODO: For now only rename the file but later make sure the packets arrived and then remove from the file // or delete the file completly
-	os.Rename(fmt.Sprint(id)+".json", "_"+fmt.Sprint(id)+".json")
 }
 
 func CheckUserOnline(c chan OnlineMessage, connMap map[uint32]net.Conn) bool {
 	for {
 		m := <-c
+		connLock.Lock()
 		_, ex := connMap[m.Id]
-		if ex {
-			m.Online = false
-		} else {
-			m.Online = true
-		}
-		c <- m
+		connLock.Unlock()
+		m.Online = ex
+		m.Reply <- m
 	}
 }
 
 func ModifyOnlineUsers(c chan ConnMessage, connMap map[uint32]net.Conn) {
 	for {
 		newCon := <-c
-		if !newCon.Disconnect {
-			connMap[newCon.Id] = newCon.Connection
-		} else {
-			delete(connMap, newCon.Id)
+		connLock.Lock()
+		registerConnection(newCon, connMap)
+		connLock.Unlock()
+	}
+}
+
+func registerConnection(newCon ConnMessage, connMap map[uint32]net.Conn) {
+	registered, wasOnline := connMap[newCon.Id]
+	if !newCon.Disconnect {
+		connMap[newCon.Id] = newCon.Connection
+		if !wasOnline {
+			NotifyPresence(newCon.Id, true, connMap)
 		}
+		return
+	}
+	// An old connection of the user that closes must not remove the
+	// connection the user logged in with afterwards
+	if !newCon.Close && newCon.Connection != nil && wasOnline && registered != newCon.Connection {
+		return
+	}
+	if newCon.Close && wasOnline {
+		registered.Close()
+	}
+	delete(connMap, newCon.Id)
+	if wasOnline && !database.IsDeleted(newCon.Id) {
+		NotifyPresence(newCon.Id, false, connMap)
 	}
 }
 
+// Queues the packets for the recipients. Writing happens in the writer of each
+// connection, so that a slow client does not hold up the others. Packets for
+// recipients that went offline in the meantime are stored in the mailbox.
 func ForwardingPackets(c chan ForwardMessage, connMap map[uint32]net.Conn) {
 	for {
 		fwdM := <-c
 		// Check where to forwards this packet to
+		connLock.Lock()
 		con, ex := connMap[fwdM.ForwardId]
+		connLock.Unlock()
 		if !ex {
 			log.Printf("Contact %d currently not online!", fwdM.ForwardId)
+			StorePacket(fwdM.ForwardId, fwdM.Packet)
 			continue
 		}
-		con.Write(fwdM.Packet)
+		deliver(fwdM.ForwardId, con, fwdM.Packet)
+	}
+}
+
+// Forwards the packet to the recipient if online and otherwise stores
+// the packet in the mailbox of the recipient. Packets of blocked senders are
+// silently dropped.
+func ForwardOrStore(header packets.Header, content any, recipient uint32, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	if database.IsBlocked(recipient, header.UserId) {
+		log.Printf("Dropping packet from %d, blocked by %d", header.UserId, recipient)
+		return
+	}
+	if !IsOnline(recipient, onlineC) {
+		log.Printf("Contact %d not online", recipient)
+		database.SaveToMailbox(recipient, header, content)
+		return
+	}
+	forward, err := packets.SerializePacket(header, content)
+	if err != nil {
+		log.Printf("Failed to create forward packet!")
+		return
+	}
+	fwdC <- ForwardMessage{
+		Packet:    forward,
+		ForwardId: recipient,
 	}
 }
 
@@ -130,10 +191,30 @@ func AddMessageId(messageId uint32, category byte, pType byte, count *int, lastM
 	*count = (*count + 1) % MESSAGE_QUEUE_SIZE
 }
 
+// Zero keeps the current timeout
+func SetLoginTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		loginTimeout.Store(int64(timeout))
+	}
+}
+
 func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan ConnMessage, onlineC chan OnlineMessage) {
 	log.Println("Handling client...")
 
+	// Everything sent to the client goes through the queue of the connection
+	outbound := NewOutboundConn(connection)
+	connection = outbound
 	defer connection.Close()
+	var loggedIn atomic.Bool
+	timeout := time.Duration(loginTimeout.Load())
+	unauthenticated := connection
+	loginTimer := time.AfterFunc(timeout, func() {
+		if !loggedIn.Load() {
+			log.Printf("Closing connection from %s, no login within %s", unauthenticated.RemoteAddr(), timeout)
+			unauthenticated.Close()
+		}
+	})
+	defer loginTimer.Stop()
 
 	// incoming := make(chan []byte)
 	// go HandleIncoming(connection, incoming)
@@ -147,6 +228,15 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 	// Keeping track of the last n messageIDs for this client
 	lastMessageId := make([]StoreMessage, MESSAGE_QUEUE_SIZE)
 	count := 0
+	// Ongoing file up- and downloads of this client by message ID
+	uploads := make(map[uint32]FileUpload)
+	downloads := make(map[uint32]string)
+	// Compression negotiated for this connection
+	compression := packets.COMPRESSION_NONE
+	// Rate limits apply to the user and to the remote host
+	address := RemoteHost(connection)
+	throttled := 0
+	var throttledSince time.Time
 
 	// headerBuffer := make([]byte, 10)
 
@@ -162,7 +252,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 			// delete(db, id)
 			newCC <- ConnMessage{
 				Id:         id,
-				Connection: nil,
+				Connection: connection,
 				Disconnect: true,
 			}
 			return
@@ -172,6 +262,15 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 		if err == bufio.ErrBufferFull {
 			// log.Printf("Failed to read all data in one go")
 			largePacketBuffer = append(largePacketBuffer, inBuffer...)
+			if len(largePacketBuffer) > frameLimitFor(largePacketBuffer) {
+				RejectFrame(largePacketBuffer, connection)
+				newCC <- ConnMessage{
+					Id:         id,
+					Connection: connection,
+					Disconnect: true,
+				}
+				return
+			}
 			continue
 		}
 
@@ -184,10 +283,19 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 			inBuffer = append(largePacketBuffer, inBuffer...)
 			largePacketBuffer = make([]byte, 0)
 		}
+		if len(inBuffer) > frameLimitFor(inBuffer) {
+			RejectFrame(inBuffer, connection)
+			newCC <- ConnMessage{
+				Id:         id,
+				Connection: connection,
+				Disconnect: true,
+			}
+			return
+		}
 
-		if len(inBuffer) < 10 {
-			log.Print("The first packet was not enough to fit the header!")
-			// Flush the pipe or wait?
+		if len(inBuffer) <= 10 {
+			// The newline is part of the header (e.g. in the message ID), the packet continues
+			largePacketBuffer = append(largePacketBuffer, inBuffer...)
 			continue
 		}
 
@@ -205,30 +313,103 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 			// delete(db, id)
 			newCC <- ConnMessage{
 				Id:         id,
+				Connection: connection,
+				Disconnect: true,
+			}
+			return
+		}
+		// The user is bound to the connection at the login or the creation of
+		// the account. Packets claiming to be from another user are not
+		// accepted, the client could act for other users otherwise.
+		if id != 0 && header.UserId != id {
+			log.Printf("Packet from %s claims to be from %d, connection belongs to %d", address, header.UserId, id)
+			newCC <- ConnMessage{
+				Id:         id,
+				Connection: connection,
+				Disconnect: true,
+			}
+			return
+		}
+		payload, err := packets.DecompressPayload(inBuffer[10:], compression)
+		if err != nil {
+			log.Printf("Failed to decompress payload from %d", id)
+			newCC <- ConnMessage{
+				Id:         id,
+				Connection: connection,
+				Disconnect: true,
+			}
+			return
+		}
+		// Compressed payloads have to fit the limit after decompressing as well
+		if compression != packets.COMPRESSION_NONE && len(payload)+11 > FrameLimit(header.Category, header.Type) {
+			RejectFrame(inBuffer, connection)
+			newCC <- ConnMessage{
+				Id:         id,
+				Connection: connection,
 				Disconnect: true,
 			}
 			return
 		}
-		id = header.UserId
-		payload := inBuffer[10:]
 		log.Printf("Header:\n%s", hex.Dump(inBuffer[:10]))
 
+		if !AllowPacket(header, id, address) {
+			if time.Since(throttledSince) > THROTTLE_PERIOD {
+				throttled = 0
+				throttledSince = time.Now()
+			}
+			throttled++
+			if throttled > MAX_THROTTLED {
+				log.Printf("Disconnecting %d from %s, too many throttled packets", id, address)
+				throttleDisconnects.Add(1)
+				newCC <- ConnMessage{
+					Id:         id,
+					Connection: connection,
+					Disconnect: true,
+				}
+				return
+			}
+			log.Printf("Throttling packet %d of %d from %s", header.MessageId, id, address)
+			SendError(header, packets.ERR_THROTTLED, "rate limited", connection)
+			continue
+		}
+
 		switch header.Category {
 		case packets.CAT_CONTACT:
 			switch header.Type {
+			case packets.CON_NEGOTIATE:
+				// The compression has to be negotiated directly after connecting
+				if count != 0 || compression != packets.COMPRESSION_NONE {
+					log.Printf("Negotiate packet after connection establishment!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				negotiate, err := packets.DeseralizePacket[packets.Negotiate](payload)
+				if err != nil {
+					log.Println("Failed to deserialize negotiate packet")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				connection, compression = HandleNegotiate(header, negotiate, connection)
 			case packets.CON_CREATE:
 				if count != 0 {
 					log.Printf("Create packet after connection establishment!")
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
 				}
 
-				AddMessageId(header.MessageId, header.Category, header.Type, &count, &lastMessageId)
-
 				// Already read the whole payload, no more need to do this!
 				// // Reading the actual payload
 				// payload, err := reader.ReadSlice('\n')
@@ -245,6 +426,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
@@ -254,7 +436,8 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 				newUserId := rand.Uint32()
 				safeCounter := math.MaxInt32
 				for {
-					exists := database.IdExists(newUserId)
+					// IDs of deleted accounts are never given out again
+					exists := database.IdExists(newUserId) || database.IsDeleted(newUserId)
 					if !exists || safeCounter <= 0 {
 						break
 					}
@@ -266,15 +449,23 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 				err = database.StoreInDatabase(newUserId, create.Username)
 				if err != nil {
 					// Failed to insert user into database
+					header.UserId = 0
+					SendError(header, packets.ERR_USERNAME, err.Error(), connection)
 					continue
 				}
+				// The message ID is only recorded for the created account, the
+				// client can retry with another username before
+				AddMessageId(header.MessageId, header.Category, header.Type, &count, &lastMessageId)
 				// Logging in the client
 				// db[newUserId] = connection
+				id = newUserId
+				outbound.SetUser(id)
 				newCC <- ConnMessage{
 					Id:         newUserId,
 					Connection: connection,
 					Disconnect: false,
 				}
+				loggedIn.Store(true)
 
 				// Sending back the ID to the client
 				encoded, err := packets.SerializePacket(header, nil)
@@ -285,12 +476,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 				log.Printf("Writing create ack back:\n%s", hex.Dump(encoded))
 				connection.Write(encoded)
 			case packets.CON_SEARCH:
-				onlineC <- OnlineMessage{
-					Id:     id,
-					Online: false,
-				}
-				onl := <-onlineC
-				if onl.Online {
+				if !IsOnline(id, onlineC) {
 					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
 					return
 				}
@@ -302,6 +488,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 						// delete(db, id)
 						newCC <- ConnMessage{
 							Id:         id,
+							Connection: connection,
 							Disconnect: true,
 						}
 						return
@@ -328,13 +515,15 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
 				}
-				users := database.SearchUsers(search.UserIdentifier)
+				users, next := database.SearchUsers(search.UserIdentifier, header.UserId, search.Cursor, search.Limit)
 				log.Printf("%d users for identifier \"%s\" found", len(users), search.UserIdentifier)
 				header, contactList := packets.CreateContactList(header.UserId, header.MessageId, users)
+				contactList.NextCursor = next
 
 				encoded, err := packets.SerializePacket(header, contactList)
 				if err != nil {
@@ -344,21 +533,14 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 				// log.Printf("Raw: %s", string(encoded))
 				connection.Write(encoded)
 			case packets.CON_CONTACTS:
-				// Should never be sent to the server
-				log.Println("Received contact list! Should not be received on the server side! Closing connection!")
-				// delete(db, id)
-				newCC <- ConnMessage{
-					Id:         id,
-					Disconnect: true,
+				// The client requests the contact list stored on the server, the payload is ignored
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
 				}
-				return
+				SendContactList(header, connection, onlineC)
 			case packets.CON_OPTION:
-				onlineC <- OnlineMessage{
-					Id:     id,
-					Online: false,
-				}
-				onl := <-onlineC
-				if onl.Online {
+				if !IsOnline(id, onlineC) {
 					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
 					return
 				}
@@ -370,6 +552,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 						// delete(db, id)
 						newCC <- ConnMessage{
 							Id:         id,
+							Connection: connection,
 							Disconnect: true,
 						}
 						return
@@ -394,6 +577,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
@@ -403,21 +587,12 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 				// fwdC <- ForwardMessage{
 				// 	Packet: ,
 				// }
-				onlineC <- OnlineMessage{
-					Id:     option.ContactUserId,
-					Online: false,
-				}
-				onl = <-onlineC
-				if onl.Online {
-					// TODO: Save question to file
-					// database.SaveContactOption(option, fmt.Sprint(option.ContactUserId)+".json")
-					continue
-				}
-				err = HandleContactOption(header, option, connection, fwdC)
+				err = HandleContactOption(header, option, connection, onlineC, fwdC)
 				if err != nil {
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
@@ -430,6 +605,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 					// delete(db, header.UserId)
 					newCC <- ConnMessage{
 						Id:         header.UserId,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
@@ -448,25 +624,28 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 					// delete(db, header.UserId)
 					newCC <- ConnMessage{
 						Id:         header.UserId,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
 				}
 				// Proceed to handle user otherwise
 				// db[id] = connection
+				id = header.UserId
+				outbound.SetUser(id)
 				newCC <- ConnMessage{
 					Id:         id,
 					Connection: connection,
 					Disconnect: false,
 				}
+				loggedIn.Store(true)
 				go HandleOldMessages(id, connection)
-			case packets.CON_CONTACT_INFO:
-				onlineC <- OnlineMessage{
-					Id:     id,
-					Online: false,
+				// Clients with contacts receive the list right away
+				if len(database.GetContacts(id)) > 0 {
+					SendContactList(packets.Header{UserId: id, MessageId: rand.Uint32()}, connection, onlineC)
 				}
-				onl := <-onlineC
-				if onl.Online {
+			case packets.CON_CONTACT_INFO:
+				if !IsOnline(id, onlineC) {
 					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
 					return
 				}
@@ -478,6 +657,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 						// delete(db, id)
 						newCC <- ConnMessage{
 							Id:         id,
+							Connection: connection,
 							Disconnect: true,
 						}
 						return
@@ -502,44 +682,163 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
 				}
 				// log.Printf("Got contact information: %s", string(contentBuf))
-				// Acknowledge that we received the packet
-				infoAck := packets.CreateContactInfoAck(header.UserId, header.MessageId)
-				rawInfoAck, err := packets.SerializePacket(infoAck, nil)
+				HandleContactInfo(header, contact, connection, onlineC, fwdC)
+			case packets.CON_PRESENCE_REQ:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				request, err := packets.DeseralizePacket[packets.PresenceList](payload)
 				if err != nil {
-					log.Printf("Failed to serialize acknowledgement header!\n%s", err)
-					continue
+					log.Println("Failed to deserialize presence request!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				HandlePresenceRequest(header, request, connection, onlineC)
+			case packets.CON_PRIVACY:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
 				}
-				connection.Write(rawInfoAck)
 
-				forward, err := packets.SerializePacket(header, contact)
+				privacy, err := packets.DeseralizePacket[packets.PrivacySettings](payload)
 				if err != nil {
-					log.Println("Failed to serialize contact packet")
-					continue
+					log.Println("Failed to deserialize privacy settings!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				HandlePrivacySettings(header, privacy, connection)
+			case packets.CON_RENAME:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				rename, err := packets.DeseralizePacket[packets.Create](payload)
+				if err != nil {
+					log.Println("Failed to deserialize rename!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				HandleRename(header, rename, connection, onlineC, fwdC)
+			case packets.CON_KEYS:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				upload, err := packets.DeseralizePacket[packets.KeyUpload](payload)
+				if err != nil {
+					log.Println("Failed to deserialize key upload!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				HandleKeyUpload(header, upload, connection, onlineC, fwdC)
+			case packets.CON_KEY_BUNDLE:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				request, err := packets.DeseralizePacket[packets.KeyBundle](payload)
+				if err != nil {
+					log.Println("Failed to deserialize key bundle request!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				HandleKeyBundleRequest(header, request, connection)
+			case packets.CON_DELETE:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+				if HandleDeleteAccount(header, connection, onlineC, fwdC, newCC) {
+					return
 				}
-				for _, v := range contact.ContactIds {
-					fwdC <- ForwardMessage{
-						Packet:    forward,
-						ForwardId: v,
+			case packets.CON_PROFILE:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				request, err := packets.DeseralizePacket[packets.ProfileRequest](payload)
+				if err != nil {
+					log.Println("Failed to deserialize profile request!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
 					}
-					// forwardCon, ex := db[v]
-					// if !ex {
-					// 	log.Printf("Contact %du not online\n", v)
-					// 	// database.SaveContactInfoToFile(contact, fmt.Sprint(v)+".json")
-					// 	continue
-					// }
-					// forwardCon.Write(forward)
-					log.Printf("Forwarded contact info to %du\n", v)
+					return
 				}
+				HandleProfileRequest(header, request, connection)
+			case packets.CON_GROUP_CREATE, packets.CON_GROUP_INVITE, packets.CON_GROUP_JOIN, packets.CON_GROUP_LEAVE, packets.CON_GROUP_KICK, packets.CON_GROUP_RENAME, packets.CON_GROUP_ADMIN, packets.CON_GROUP_INFO:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				if index := MessageIDExists(header.MessageId, lastMessageId); index > -1 {
+					log.Printf("MessageID has already been seen!")
+					stored := lastMessageId[index]
+					if !AlreadySeen(header.Category, header.Type, stored.Type) {
+						newCC <- ConnMessage{
+							Id:         id,
+							Connection: connection,
+							Disconnect: true,
+						}
+						return
+					} else {
+						continue
+					}
+				}
+
+				AddMessageId(header.MessageId, header.Category, header.Type, &count, &lastMessageId)
+
+				action, err := packets.DeseralizePacket[packets.GroupAction](payload)
+				if err != nil {
+					log.Println("Failed to deserialize group packet!")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				HandleGroupPacket(header, action, connection, onlineC, fwdC)
 			default:
 				log.Printf("Incorrect packet type: %d\n", header.Type)
 				// delete(db, id)
 				newCC <- ConnMessage{
 					Id:         id,
+					Connection: connection,
 					Disconnect: true,
 				}
 				return
@@ -547,16 +846,23 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 		case packets.CAT_DATA:
 			switch header.Type {
 			case packets.D_TEXT:
-				onlineC <- OnlineMessage{
-					Id:     id,
-					Online: false,
-				}
-				onl := <-onlineC
-				if onl.Online {
+				if !IsOnline(id, onlineC) {
 					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
 					return
 				}
 
+				if duplicate, valid := HandleDuplicate(header, connection); duplicate {
+					if !valid {
+						newCC <- ConnMessage{
+							Id:         id,
+							Connection: connection,
+							Disconnect: true,
+						}
+						return
+					}
+					continue
+				}
+
 				if index := MessageIDExists(header.MessageId, lastMessageId); index > -1 {
 					log.Printf("MessageID has already been seen!")
 					stored := lastMessageId[index]
@@ -564,6 +870,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 						// delete(db, id)
 						newCC <- ConnMessage{
 							Id:         id,
+							Connection: connection,
 							Disconnect: true,
 						}
 						return
@@ -584,106 +891,131 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 
 				var text packets.Text
 				text, err = packets.DeseralizePacket[packets.Text](payload)
-				log.Printf("Got \"%s\" from \"%d\" forwarding to \"%d\"\n", text.Message, header.UserId, text.ContactUserId)
+				log.Printf("Got text %d from \"%d\" forwarding to \"%d\"\n", header.MessageId, header.UserId, text.ContactUserId)
 				if err != nil {
 					log.Println("Failed to deserialize text packet")
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
 				}
 
-				// First write the ack back to the sending client (later on save the text and send to client when it comes back online)
-				ackHeader, textAck := packets.CreateTextAck(header.UserId, header.MessageId, text.ContactUserId)
-				ack, err := packets.SerializePacket(ackHeader, textAck)
-				if err != nil {
-					log.Println("Failed to create ack packet")
-					continue
+				var group database.Group
+				if text.GroupId != 0 {
+					group, err = database.GetGroup(text.GroupId)
+					if err != nil || !group.IsMember(header.UserId) {
+						log.Printf("User %d cannot send to group %d", header.UserId, text.GroupId)
+						SendError(header, packets.ERR_GROUP, "not a member", connection)
+						continue
+					}
 				}
-				connection.Write(ack)
-				log.Printf("Wrote textAck (%s) back to %d\n", hex.Dump(ack), header.UserId)
 
-				// Continue with forwarding the text
-				onlineC <- OnlineMessage{
-					Id:     text.ContactUserId,
-					Online: false,
-				}
-				onl = <-onlineC
-				if onl.Online {
-					log.Printf("Contact %d not online", text.ContactUserId)
-					database.SaveMessagesToFile(text, header.UserId, fmt.Sprint(text.ContactUserId)+".json")
+				if text.GroupId == 0 && !database.PrivacyAllows(text.ContactUserId, header.UserId, packets.PRIVACY_MESSAGES) {
+					log.Printf("User %d does not accept texts from %d", text.ContactUserId, header.UserId)
+					SendError(header, packets.ERR_PRIVACY, "not allowed", connection)
 					continue
 				}
-				log.Printf("Text before sending: %v", text)
-				forward, err := packets.SerializePacket(header, text)
+
+				// First write the ack back to the sending client, the text is then forwarded or stored until the recipient comes back online
+				recipients := []uint32{text.ContactUserId}
+				if text.GroupId != 0 {
+					recipients = group.Recipients(header.UserId)
+				}
+				text, err = StampText(header, text)
 				if err != nil {
-					log.Printf("Failed to create forward packet!")
+					log.Printf("Failed to store text %d of %d in history: %s", header.MessageId, header.UserId, err)
+				}
+				AcceptText(header, recipients, text, connection)
+
+				// Continue with forwarding the text
+				if text.GroupId != 0 {
+					ForwardGroupText(header, text, group, onlineC, fwdC)
 					continue
 				}
-				log.Printf("Sending:\n%s", hex.Dump(forward))
-				// forwardCon.Write(forward)
-				fwdC <- ForwardMessage{
-					Packet:    forward,
-					ForwardId: text.ContactUserId,
+				ForwardOrStore(header, text, text.ContactUserId, onlineC, fwdC)
+			case packets.D_TEXT_ACK, packets.D_TEXT_DELIVERED, packets.D_TEXT_READ:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
 				}
-			case packets.D_TEXT_ACK:
-				// TODO: When this is received send it further to acked client so that he can show the "received" flag
-
-				// Difficult to check. Contains the same ID as the text, so cannot really check twice
-				// if MessageIDExists(header.MessageId, lastMessageId) > 0 {
-				// 	log.Printf("MessageID in text ack has already been seen!")
-				// 	// not going to forward
-				// 	continue
-				// }
-				// AddMessageId(header.MessageId, &count, &lastMessageId)
-
-				// payload, err := reader.ReadSlice('\n')
-				// if err != nil {
-				// 	log.Printf("Failed to read payload of contact info packet!%s\n", err)
-				// 	continue
-				// }
 
+				// Receipts carry the ID of the text, the state of the text already filters duplicates
 				var textAck packets.TextAck
 				textAck, err = packets.DeseralizePacket[packets.TextAck](payload)
 				if err != nil {
-					log.Printf("Failed to deserialize text ack!")
-					// We cannot decode, so also not store the answer...
-					// database.SaveTextAckToFile(textAck, fmt.Sprint(textAck.ContactUserId)+".json")
+					log.Printf("Failed to deserialize text receipt!")
+					continue
+				}
+				HandleReceipt(header, textAck, onlineC, fwdC)
+			case packets.D_TEXT_STATUS:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				query, err := packets.DeseralizePacket[packets.TextStatus](payload)
+				if err != nil {
+					log.Printf("Failed to deserialize text status query!")
 					continue
 				}
+				HandleTextStatus(header, query, connection)
+			case packets.D_TEXT_EDIT, packets.D_TEXT_DELETE:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
 
-				// Lookup the contacted user and forward
-				onlineC <- OnlineMessage{
-					Id:     textAck.ContactUserId,
-					Online: false,
+				if duplicate, valid := HandleDuplicate(header, connection); duplicate {
+					if !valid {
+						newCC <- ConnMessage{
+							Id:         id,
+							Connection: connection,
+							Disconnect: true,
+						}
+						return
+					}
+					continue
 				}
-				onl := <-onlineC
-				if onl.Online {
-					log.Printf("Contact %d not online", textAck.ContactUserId)
-					// database.SaveTextAckToFile(textAck, fmt.Sprint(textAck.ContactUserId)+".json")
+
+				if index := MessageIDExists(header.MessageId, lastMessageId); index > -1 {
+					log.Printf("MessageID has already been seen!")
+					if !AlreadySeen(header.Category, header.Type, lastMessageId[index].Type) {
+						newCC <- ConnMessage{
+							Id:         id,
+							Connection: connection,
+							Disconnect: true,
+						}
+						return
+					}
 					continue
 				}
-				forward, err := packets.SerializePacket(header, textAck)
+				AddMessageId(header.MessageId, header.Category, header.Type, &count, &lastMessageId)
+
+				edit, err := packets.DeseralizePacket[packets.TextEdit](payload)
 				if err != nil {
-					log.Printf("Failed to create forward packet!")
+					log.Printf("Failed to deserialize text edit!")
 					continue
 				}
-				// forwardCon.Write(forward)
-				fwdC <- ForwardMessage{
-					Packet:    forward,
-					ForwardId: textAck.ContactUserId,
+				HandleTextEdit(header, edit, connection, onlineC, fwdC)
+			case packets.D_SYNC:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
 				}
+
+				request, err := packets.DeseralizePacket[packets.Sync](payload)
+				if err != nil {
+					log.Printf("Failed to deserialize sync request!")
+					continue
+				}
+				HandleSync(header, request, connection)
 			case packets.D_FILE_INFO:
 				log.Printf("Received file information")
 
-				onlineC <- OnlineMessage{
-					Id:     id,
-					Online: false,
-				}
-				onl := <-onlineC
-				if onl.Online {
+				if !IsOnline(id, onlineC) {
 					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
 					return
 				}
@@ -695,6 +1027,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 						// delete(db, id)
 						newCC <- ConnMessage{
 							Id:         id,
+							Connection: connection,
 							Disconnect: true,
 						}
 						return
@@ -721,36 +1054,108 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 					// delete(db, id)
 					newCC <- ConnMessage{
 						Id:         id,
+						Connection: connection,
 						Disconnect: true,
 					}
 					return
 				}
 
-				onlineC <- OnlineMessage{
-					Id:     fileInfo.ContactUserId,
-					Online: false,
+				err = packets.CheckFileCompression(fileInfo)
+				if err != nil {
+					log.Printf("Rejecting file info from %d: %s", id, err)
+					SendError(header, packets.ERR_COMPRESSION, err.Error(), connection)
+					continue
 				}
-				onl = <-onlineC
-				if onl.Online {
-					log.Printf("Contact %d not online", fileInfo.ContactUserId)
-					// database.SaveTextAckToFile(textAck, fmt.Sprint(textAck.ContactUserId)+".json")
+				if !database.PrivacyAllows(fileInfo.ContactUserId, header.UserId, packets.PRIVACY_MESSAGES) {
+					log.Printf("User %d does not accept files from %d", fileInfo.ContactUserId, header.UserId)
+					SendError(header, packets.ERR_PRIVACY, "not allowed", connection)
 					continue
 				}
-				forward, err := packets.SerializePacket(header, fileInfo)
+
+				// Files announced with their content hash are stored on the server
+				// and the file info is only forwarded once the file is complete
+				if fileInfo.ContentHash != "" {
+					if !database.ValidFileHash(fileInfo.ContentHash) {
+						log.Printf("Invalid content hash \"%s\"", fileInfo.ContentHash)
+						newCC <- ConnMessage{
+							Id:         id,
+							Connection: connection,
+							Disconnect: true,
+						}
+						return
+					}
+					if !HandleFileInfo(header, fileInfo, connection) {
+						uploads[header.MessageId] = FileUpload{
+							Header: header,
+							Info:   fileInfo,
+						}
+						continue
+					}
+				}
+
+				ForwardFileInfo(header, fileInfo, onlineC, fwdC)
+			case packets.D_FILE:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				// All chunks share the message ID of the file info, therefore no duplicate check here.
+				// Chunks arriving twice are rejected because of the incorrect offset.
+				file, err := packets.DeseralizePacket[packets.File](payload)
 				if err != nil {
-					log.Printf("Failed to create forward packet!")
+					log.Println("Failed to deserialize file packet")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				upload, ex := uploads[header.MessageId]
+				if !ex {
+					log.Printf("No upload for message %d from %d", header.MessageId, id)
 					continue
 				}
-				// forwardCon.Write(forward)
-				fwdC <- ForwardMessage{
-					Packet:    forward,
-					ForwardId: fileInfo.ContactUserId,
+				if HandleFileChunk(header, upload.Info, file, connection) {
+					delete(uploads, header.MessageId)
+					ForwardFileInfo(upload.Header, upload.Info, onlineC, fwdC)
+				}
+			case packets.D_FILE_REQ:
+				if !IsOnline(id, onlineC) {
+					log.Printf("User %d not logged in. Cannot process anything without registration and login!", id)
+					return
+				}
+
+				// Requests can be repeated to resume an interrupted download
+				request, err := packets.DeseralizePacket[packets.FileRequest](payload)
+				if err != nil {
+					log.Println("Failed to deserialize file request")
+					newCC <- ConnMessage{
+						Id:         id,
+						Connection: connection,
+						Disconnect: true,
+					}
+					return
+				}
+				if HandleFileRequest(header, request, connection) {
+					downloads[header.MessageId] = request.ContentHash
 				}
+			case packets.D_FILE_ACK:
+				// The recipient acknowledges the download, the file is no longer needed for this user
+				hash, ex := downloads[header.MessageId]
+				if !ex {
+					log.Printf("File ack for unknown download %d", header.MessageId)
+					continue
+				}
+				delete(downloads, header.MessageId)
+				database.ReleaseFileReference(hash, id)
 			default:
 				log.Printf("Incorrect packet type %d", header.Type)
 				// delete(db, id)
 				newCC <- ConnMessage{
 					Id:         id,
+					Connection: connection,
 					Disconnect: true,
 				}
 				return
@@ -760,6 +1165,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 			// delete(db, id)
 			newCC <- ConnMessage{
 				Id:         id,
+				Connection: connection,
 				Disconnect: true,
 			}
 			return
@@ -767,7 +1173,7 @@ func HandleClient(connection net.Conn, fwdC chan ForwardMessage, newCC chan Conn
 	}
 }
 
-func HandleContactOption(header packets.Header, option packets.ContactOption, connection net.Conn, fwdC chan ForwardMessage) error {
+func HandleContactOption(header packets.Header, option packets.ContactOption, connection net.Conn, onlineC chan OnlineMessage, fwdC chan ForwardMessage) error {
 	for _, v := range option.Options {
 		log.Printf("Option: {%s, %s}", v.Type, v.Value)
 		switch v.Type {
@@ -780,69 +1186,52 @@ func HandleContactOption(header packets.Header, option packets.ContactOption, co
 					log.Printf("%s", err)
 					break
 				}
-
-				// TODO: Add forwarding the request to be able to automatically add the user into the list
-				forwardPacket, err := packets.SerializePacket(header, option)
-				if err != nil {
-					log.Print("Failed to create Option packet to forward!")
+				if database.IsBlocked(option.ContactUserId, header.UserId) {
+					// The blocked user is not told about the block
+					log.Printf("User %d is blocked by %d, dropping request", header.UserId, option.ContactUserId)
 					break
 				}
-				fwdC <- ForwardMessage{
-					Packet:    forwardPacket,
-					ForwardId: option.ContactUserId,
+				// The request is stored until answered, the questioned user gets it when coming online
+				err = database.AddContactRequest(header.UserId, option.ContactUserId)
+				if err != nil {
+					log.Printf("Not forwarding request: %s", err)
+					break
 				}
-				log.Print("The questioned client is not online!")
-
-				// Forwarding the request to the other user
-				// if user.Connection == nil {
-				// 	log.Printf("User \"%d\" is currently not online!", option.ContactUserId)
-				// 	// TODO: Save the request and send it as soon as the other client comes online
-				// 	return nil
-				// }
-				// packet, err := CreatePacket(option)
-				// if err != nil {
-				// 	log.Println("Failed to create next packet!")
-				// 	return nil
-				// }
-				// connection.Write(packet)
-
-				// Because we currently don't have the request implemented on the other client we just send the accept answer back (for testing purposes)
-				answerOption := packets.Option{
+				ForwardOrStore(header, option, option.ContactUserId, onlineC, fwdC)
+			case "Remove":
+				// The server removes the relationship for both users and tells the removed user
+				database.RemoveContact(header.UserId, option.ContactUserId)
+				ForwardOrStore(header, option, option.ContactUserId, onlineC, fwdC)
+				PushContactUpdate(header.UserId, packets.CONTACT_REMOVED, option.ContactUserId, onlineC, fwdC)
+				PushContactUpdate(option.ContactUserId, packets.CONTACT_REMOVED, header.UserId, onlineC, fwdC)
+				removeAck := packets.Option{
 					Type:  "Answer",
-					Value: "Accept",
-				}
-				nameOption := packets.Option{
-					Type:  "Name",
-					Value: option.Options[len(option.Options)-1].Value,
+					Value: "RemoveAck",
 				}
-				options := make([]packets.Option, 2)
-				options[0] = answerOption
-				options[1] = nameOption
+				options := make([]packets.Option, 1)
+				options[0] = removeAck
 				answerHeader := packets.Header{
 					Category:  packets.CAT_CONTACT,
 					Type:      packets.CON_OPTION,
 					UserId:    option.ContactUserId,
 					MessageId: header.MessageId,
 				}
-				accept := packets.ContactOption{
+				ack := packets.ContactOption{
 					ContactUserId: header.UserId,
 					Options:       options,
 				}
-				packet, err := packets.SerializePacket(answerHeader, accept)
+				packet, err := packets.SerializePacket(answerHeader, ack)
 				if err != nil {
-					log.Println("Failed to create answer packet!")
+					log.Printf("Failed to create next packet")
 					break
 				}
 				connection.Write(packet)
-			case "Remove":
-				// TODO: Implement the acknowledgement on the client side before sending out the ack.
-				// For testing purposes the ack is send so that the client is successfully removed
-				removeAck := packets.Option{
-					Type:  "Answer",
-					Value: "RemoveAck",
+			case "Block", "Unblock":
+				if v.Value == "Block" {
+					database.BlockUser(header.UserId, option.ContactUserId)
+				} else {
+					database.UnblockUser(header.UserId, option.ContactUserId)
 				}
-				options := make([]packets.Option, 1)
-				options[0] = removeAck
 				answerHeader := packets.Header{
 					Category:  packets.CAT_CONTACT,
 					Type:      packets.CON_OPTION,
@@ -851,7 +1240,7 @@ func HandleContactOption(header packets.Header, option packets.ContactOption, co
 				}
 				ack := packets.ContactOption{
 					ContactUserId: header.UserId,
-					Options:       options,
+					Options:       []packets.Option{{Type: "Answer", Value: v.Value + "Ack"}},
 				}
 				packet, err := packets.SerializePacket(answerHeader, ack)
 				if err != nil {
@@ -863,10 +1252,51 @@ func HandleContactOption(header packets.Header, option packets.ContactOption, co
 				log.Printf("Unknown or incorrect contact option value \"%s\". Closing connection...", v.Value)
 				return errors.New("unknown contact value")
 			}
+		case "Answer":
+			// The questioned user answers the request of the contact
+			var accept bool
+			switch v.Value {
+			case "Accept":
+				accept = true
+			case "Decline":
+				accept = false
+			default:
+				log.Printf("Unknown or incorrect contact answer \"%s\". Closing connection...", v.Value)
+				return errors.New("unknown contact answer")
+			}
+			err := database.AnswerContactRequest(option.ContactUserId, header.UserId, accept)
+			if err != nil {
+				// Answers without a request are not forwarded
+				break
+			}
+			answer := packets.ContactOption{
+				ContactUserId: option.ContactUserId,
+				Options:       []packets.Option{v},
+			}
+			user, err := database.GetUser(header.UserId)
+			if err == nil {
+				answer.Options = append(answer.Options, packets.Option{Type: "Name", Value: user.Username})
+			}
+			ForwardOrStore(header, answer, option.ContactUserId, onlineC, fwdC)
+			if accept {
+				PushContactUpdate(header.UserId, packets.CONTACT_ADDED, option.ContactUserId, onlineC, fwdC)
+				PushContactUpdate(option.ContactUserId, packets.CONTACT_ADDED, header.UserId, onlineC, fwdC)
+			}
+		case "Presence":
+			// Short form of the presence privacy setting
+			switch v.Value {
+			case "Hide":
+				database.SetPrivacySettings(header.UserId, []packets.Option{{Type: packets.PRIVACY_PRESENCE, Value: packets.PRIVACY_NOBODY}})
+			case "Show":
+				database.SetPrivacySettings(header.UserId, []packets.Option{{Type: packets.PRIVACY_PRESENCE, Value: packets.PRIVACY_CONTACTS}})
+			default:
+				log.Printf("Unknown presence option value \"%s\"", v.Value)
+				return errors.New("unknown presence value")
+			}
 		case "Add":
 			log.Printf("User is adding the contact and sending name: %s", v.Value)
-		case "Username":
-			log.Printf("Username: %s", option.Options[0].Value)
+		case "Username", "Name":
+			log.Printf("%s: %s", v.Type, v.Value)
 		default:
 			log.Printf("Unknown contact option type \"%s\"", v.Type)
 			return errors.New("unknown contact type")
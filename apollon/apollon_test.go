@@ -1,16 +1,35 @@
 package apollon_test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"expvar"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"anzu.cloudsheeptech.com/apollon"
 	"anzu.cloudsheeptech.com/configuration"
+	"anzu.cloudsheeptech.com/database"
 	"anzu.cloudsheeptech.com/packets"
 	"anzu.cloudsheeptech.com/server"
 )
@@ -22,6 +41,8 @@ func TestMain(m *testing.M) {
 	server.Stop()
 }
 
+var noiseKeyfile = filepath.Join(os.TempDir(), "apollon-test.noise")
+
 func StartServer() {
 	configuration := configuration.Config{
 		Secure:             false,
@@ -34,6 +55,11 @@ func StartServer() {
 		CertificateKeyfile: "resources/apollon.key",
 		DatabaseFile:       "../resources/test_database.json",
 		DatabaseNoWrite:    true,
+		FileDirectory:      filepath.Join(os.TempDir(), "apollon-test-files"),
+		Noise:              true,
+		NoiseListenPort:    "50003",
+		NoiseKeyfile:       noiseKeyfile,
+		NoiseCreateKey:     true,
 	}
 	go server.Start(configuration)
 }
@@ -203,6 +229,32 @@ func TestCreateAccount(t *testing.T) {
 	}
 }
 
+func TestCreateAccountRetry(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// A rejected username does not use up the create of the connection
+	rejectedHeader, rejected := packets.CreateAccount(rand.Uint32(), "ab")
+	sendPacket(conn, rejectedHeader, rejected)
+	_, payload, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_ERROR)
+	if answer, _ := packets.DeseralizePacket[packets.Error](payload); err != nil || answer.Code != packets.ERR_USERNAME {
+		log.Printf("Short username was not rejected: %s", err)
+		t.FailNow()
+	}
+	createHeader, create := packets.CreateAccount(rand.Uint32(), "Zweiter Versuch")
+	sendPacket(conn, createHeader, create)
+	header, _, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_CREATE)
+	if err != nil || header.MessageId != createHeader.MessageId || header.UserId == 0 {
+		log.Printf("Retry with another username failed: %s", err)
+		t.FailNow()
+	}
+}
+
 func TestSendingMessage(t *testing.T) {
 	userId := uint32(1293812414)
 	contactId := uint32(3718291512)
@@ -306,8 +358,9 @@ func TestUpdateContactInfo(t *testing.T) {
 	userId := uint32(1293812414)
 	messageId := rand.Uint32()
 	username := "Username"
-	image := []byte{0x01, 0x02, 0x03, 0x04}
-	userlist := []uint32{3718291512}
+	image := testImage(8, 8)
+	// The info is forwarded to the contacts stored on the server
+	userlist := []uint32{}
 
 	// First only sending contact info (MUST FAIL!)
 	contactInfoHeader, contactInfo := packets.CreateContactInfo(userId, messageId, username, image, userlist)
@@ -412,3 +465,2400 @@ func TestUpdateContactInfo(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func readPacket(reader *bufio.Reader) (packets.Header, []byte, error) {
+	var header packets.Header
+	raw, err := reader.ReadBytes('\n')
+	// A newline inside of the header does not end the packet
+	for err == nil && len(raw) <= 10 {
+		var rest []byte
+		rest, err = reader.ReadBytes('\n')
+		raw = append(raw, rest...)
+	}
+	if err != nil {
+		return header, nil, err
+	}
+	err = binary.Read(bytes.NewReader(raw[:10]), binary.BigEndian, &header)
+	return header, raw[10 : len(raw)-1], err
+}
+
+func loginUser(userId uint32) (net.Conn, *bufio.Reader, error) {
+	// Connections of previous tests might still be closing
+	time.Sleep(100 * time.Millisecond)
+	loginHeader := packets.CreateLogin(userId, rand.Uint32())
+	packet, err := packets.SerializePacket(loginHeader, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = conn.Write(packet)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// Give the server time to register the client
+	time.Sleep(100 * time.Millisecond)
+	return conn, bufio.NewReader(conn), nil
+}
+
+func TestFileUpload(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	conn, reader, err := loginUser(userId)
+	if err != nil {
+		log.Printf("Failed to login: %s", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	content := make([]byte, 1024)
+	rand.Read(content)
+	hash := sha256.Sum256(content)
+	messageId := rand.Uint32()
+	infoHeader, info := packets.CreateFileInfo(userId, messageId, "image.png", uint32(len(content)), 0, "None", 0)
+	info.ContactUserId = contactId
+	info.ContentHash = hex.EncodeToString(hash[:])
+	packet, _ := packets.SerializePacket(infoHeader, info)
+	conn.Write(packet)
+
+	// New file, the upload has to start at the beginning
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	header, payload, err := readPacket(reader)
+	if err != nil || header.Type != packets.D_FILE_HAVE || header.MessageId != messageId {
+		log.Printf("Expected file have: %s", err)
+		t.FailNow()
+	}
+	have, err := packets.DeseralizePacket[packets.FileHave](payload)
+	if err != nil || have.FileOffset != 0 {
+		log.Println("Incorrect offset for new file!")
+		t.FailNow()
+	}
+	chunkHeader, chunk := packets.CreateFileChunk(userId, messageId, 0, content)
+	packet, _ = packets.SerializePacket(chunkHeader, chunk)
+	conn.Write(packet)
+	header, _, err = readPacket(reader)
+	if err != nil || header.Type != packets.D_FILE_ACK || header.MessageId != messageId {
+		log.Printf("Expected file ack: %s", err)
+		t.FailNow()
+	}
+
+	// Sending the same file again must not require another upload
+	messageId = rand.Uint32()
+	infoHeader.MessageId = messageId
+	packet, _ = packets.SerializePacket(infoHeader, info)
+	conn.Write(packet)
+	header, payload, err = readPacket(reader)
+	if err != nil || header.Type != packets.D_FILE_HAVE || header.MessageId != messageId {
+		log.Printf("Expected file have: %s", err)
+		t.FailNow()
+	}
+	have, err = packets.DeseralizePacket[packets.FileHave](payload)
+	if err != nil || have.FileOffset != uint64(len(content)) {
+		log.Println("Existing file was not recognized!")
+		t.FailNow()
+	}
+}
+
+func TestCompressedConnection(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		log.Printf("Failed to connect to the server!")
+		t.FailNow()
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	negotiateHeader, negotiate := packets.CreateNegotiate(userId, rand.Uint32(), []string{"brotli", packets.COMPRESSION_GZIP})
+	packet, _ := packets.SerializePacket(negotiateHeader, negotiate)
+	conn.Write(packet)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	header, payload, err := readPacket(reader)
+	if err != nil || header.Type != packets.CON_NEGOTIATE {
+		log.Printf("Expected negotiate answer: %s", err)
+		t.FailNow()
+	}
+	answer, err := packets.DeseralizePacket[packets.Negotiate](payload)
+	if err != nil || len(answer.Compression) != 1 || answer.Compression[0] != packets.COMPRESSION_GZIP {
+		log.Printf("Server did not choose gzip!")
+		t.FailNow()
+	}
+
+	loginHeader := packets.CreateLogin(userId, rand.Uint32())
+	packet, _ = packets.SerializePacket(loginHeader, nil)
+	conn.Write(packet)
+	time.Sleep(100 * time.Millisecond)
+
+	messageId := rand.Uint32()
+	textHeader, text := packets.CreateText(userId, messageId, contactId, "Compressed text")
+	packet, _ = packets.SerializePacket(textHeader, text)
+	packet, err = packets.CompressPacket(packet, packets.COMPRESSION_GZIP)
+	if err != nil {
+		t.FailNow()
+	}
+	conn.Write(packet)
+	header, payload, err = readPacket(reader)
+	if err != nil || header.Type != packets.D_TEXT_ACK || header.MessageId != messageId {
+		log.Printf("Expected text ack: %s", err)
+		t.FailNow()
+	}
+	payload, err = packets.DecompressPayload(payload, packets.COMPRESSION_GZIP)
+	if err != nil {
+		log.Printf("Ack was not compressed: %s", err)
+		t.FailNow()
+	}
+	ack, err := packets.DeseralizePacket[packets.TextAck](payload)
+	if err != nil || ack.ContactUserId != contactId {
+		log.Printf("Failed to decode compressed ack")
+		t.FailNow()
+	}
+}
+
+func expectPacket(reader *bufio.Reader, category byte, pType byte) (packets.Header, []byte, error) {
+	for {
+		header, payload, err := readPacket(reader)
+		if err != nil {
+			return header, payload, err
+		}
+		if header.Category == category && header.Type == pType {
+			return header, payload, nil
+		}
+		log.Printf("Skipping packet %d:%d", header.Category, header.Type)
+	}
+}
+
+func TestGroupText(t *testing.T) {
+	ownerId := uint32(1293812414)
+	memberId := uint32(3718291512)
+	owner, ownerReader, err := loginUser(ownerId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer owner.Close()
+	member, memberReader, err := loginUser(memberId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer member.Close()
+	owner.SetReadDeadline(time.Now().Add(2 * time.Second))
+	member.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	createHeader, create := packets.CreateGroupAction(ownerId, rand.Uint32(), packets.CON_GROUP_CREATE, 0, 0, "Testgroup")
+	packet, _ := packets.SerializePacket(createHeader, create)
+	owner.Write(packet)
+	header, payload, err := expectPacket(ownerReader, packets.CAT_CONTACT, packets.CON_GROUP_INFO)
+	if err != nil || header.MessageId != createHeader.MessageId {
+		log.Printf("Did not receive group info: %s", err)
+		t.FailNow()
+	}
+	group, err := packets.DeseralizePacket[packets.GroupInfo](payload)
+	if err != nil || group.GroupId == 0 || group.Owner != ownerId {
+		log.Println("Group was not created correctly!")
+		t.FailNow()
+	}
+
+	// Texts from non members are rejected
+	textHeader, text := packets.CreateGroupText(memberId, rand.Uint32(), group.GroupId, "Not a member")
+	packet, _ = packets.SerializePacket(textHeader, text)
+	member.Write(packet)
+	_, _, err = expectPacket(memberReader, packets.CAT_CONTACT, packets.CON_ERROR)
+	if err != nil {
+		log.Printf("Text from non member was not rejected: %s", err)
+		t.FailNow()
+	}
+
+	inviteHeader, invite := packets.CreateGroupAction(ownerId, rand.Uint32(), packets.CON_GROUP_INVITE, group.GroupId, memberId, "")
+	packet, _ = packets.SerializePacket(inviteHeader, invite)
+	owner.Write(packet)
+	_, payload, err = expectPacket(memberReader, packets.CAT_CONTACT, packets.CON_GROUP_INVITE)
+	if err != nil {
+		log.Printf("Did not receive invite: %s", err)
+		t.FailNow()
+	}
+	invite, _ = packets.DeseralizePacket[packets.GroupAction](payload)
+	if invite.GroupId != group.GroupId || invite.UserId != ownerId {
+		t.FailNow()
+	}
+
+	joinHeader, join := packets.CreateGroupAction(memberId, rand.Uint32(), packets.CON_GROUP_JOIN, group.GroupId, 0, "")
+	packet, _ = packets.SerializePacket(joinHeader, join)
+	member.Write(packet)
+	_, _, err = expectPacket(memberReader, packets.CAT_CONTACT, packets.CON_GROUP_INFO)
+	if err != nil {
+		t.FailNow()
+	}
+	// Owner was told about the new member (after the answer to the invite)
+	expectPacket(ownerReader, packets.CAT_CONTACT, packets.CON_GROUP_INFO)
+	_, payload, err = expectPacket(ownerReader, packets.CAT_CONTACT, packets.CON_GROUP_INFO)
+	if err != nil {
+		t.FailNow()
+	}
+	group, _ = packets.DeseralizePacket[packets.GroupInfo](payload)
+	if len(group.Members) != 2 {
+		log.Printf("Owner got incorrect member list: %v", group.Members)
+		t.FailNow()
+	}
+
+	textHeader, text = packets.CreateGroupText(ownerId, rand.Uint32(), group.GroupId, "Hello group")
+	packet, _ = packets.SerializePacket(textHeader, text)
+	owner.Write(packet)
+	header, payload, err = expectPacket(memberReader, packets.CAT_DATA, packets.D_TEXT)
+	if err != nil || header.UserId != ownerId {
+		log.Printf("Member did not receive group text: %s", err)
+		t.FailNow()
+	}
+	received, _ := packets.DeseralizePacket[packets.Text](payload)
+	if received.GroupId != group.GroupId || received.Message != "Hello group" {
+		log.Println("Incorrect group text received!")
+		t.FailNow()
+	}
+
+	// Edits stay in the group the text was sent to, whatever group they name
+	otherHeader, other := packets.CreateGroupAction(ownerId, rand.Uint32(), packets.CON_GROUP_CREATE, 0, 0, "Othergroup")
+	sendPacket(owner, otherHeader, other)
+	_, payload, err = expectPacket(ownerReader, packets.CAT_CONTACT, packets.CON_GROUP_INFO)
+	if err != nil {
+		t.FailNow()
+	}
+	otherGroup, _ := packets.DeseralizePacket[packets.GroupInfo](payload)
+	editHeader, edit := packets.CreateTextEdit(ownerId, rand.Uint32(), 0, textHeader.MessageId, "Hello everyone")
+	edit.GroupId = otherGroup.GroupId
+	sendPacket(owner, editHeader, edit)
+	_, payload, err = expectPacket(memberReader, packets.CAT_DATA, packets.D_TEXT_EDIT)
+	if receivedEdit, _ := packets.DeseralizePacket[packets.TextEdit](payload); err != nil || receivedEdit.GroupId != group.GroupId {
+		log.Printf("Edit did not stay in the group of the text: %s", err)
+		t.FailNow()
+	}
+	if database.HistorySequence(database.ConversationKey(ownerId, 0, otherGroup.GroupId)) != 0 {
+		log.Println("Edit was stored in the history of another group!")
+		t.FailNow()
+	}
+}
+
+func TestTextReceipts(t *testing.T) {
+	senderId := uint32(1293812414)
+	recipientId := uint32(3718291512)
+	sender, senderReader, err := loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	recipient, recipientReader, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer recipient.Close()
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	textHeader, text := packets.CreateText(senderId, rand.Uint32(), recipientId, "Did you read this?")
+	packet, _ := packets.SerializePacket(textHeader, text)
+	sender.Write(packet)
+	header, payload, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK)
+	if err != nil || header.MessageId != textHeader.MessageId {
+		log.Printf("Did not receive server ack: %s", err)
+		t.FailNow()
+	}
+	ack, err := packets.DeseralizePacket[packets.TextAck](payload)
+	if err != nil || ack.MessageId != textHeader.MessageId || ack.Timestamp == 0 {
+		log.Println("Server ack does not reference the text!")
+		t.FailNow()
+	}
+	_, _, err = expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT)
+	if err != nil {
+		t.FailNow()
+	}
+
+	receiptHeader, receipt := packets.CreateTextReceipt(recipientId, rand.Uint32(), packets.D_TEXT_READ, senderId, textHeader.MessageId)
+	packet, _ = packets.SerializePacket(receiptHeader, receipt)
+	recipient.Write(packet)
+	header, payload, err = expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_READ)
+	if err != nil || header.UserId != recipientId {
+		log.Printf("Did not receive read receipt: %s", err)
+		t.FailNow()
+	}
+	receipt, _ = packets.DeseralizePacket[packets.TextAck](payload)
+	if receipt.MessageId != textHeader.MessageId {
+		t.FailNow()
+	}
+
+	queryHeader, query := packets.CreateTextStatus(senderId, rand.Uint32(), textHeader.MessageId, nil)
+	packet, _ = packets.SerializePacket(queryHeader, query)
+	sender.Write(packet)
+	_, payload, err = expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_STATUS)
+	if err != nil {
+		log.Printf("Did not receive text status: %s", err)
+		t.FailNow()
+	}
+	status, _ := packets.DeseralizePacket[packets.TextStatus](payload)
+	if len(status.Receipts) != 1 || status.Receipts[0].ContactUserId != recipientId || status.Receipts[0].Status != packets.STATUS_READ {
+		log.Printf("Incorrect text status: %+v", status)
+		t.FailNow()
+	}
+}
+
+func TestEditAndDeleteText(t *testing.T) {
+	senderId := uint32(1293812414)
+	recipientId := uint32(3718291512)
+	sender, senderReader, err := loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	recipient, recipientReader, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer recipient.Close()
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	textHeader, text := packets.CreateText(senderId, rand.Uint32(), recipientId, "Helo")
+	sendPacket(sender, textHeader, text)
+	if _, _, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK); err != nil {
+		t.FailNow()
+	}
+	if _, _, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT); err != nil {
+		t.FailNow()
+	}
+
+	// Only the sender can change the text
+	forgedHeader, forged := packets.CreateTextEdit(recipientId, rand.Uint32(), senderId, textHeader.MessageId, "Forged")
+	sendPacket(recipient, forgedHeader, forged)
+	_, payload, err := expectPacket(recipientReader, packets.CAT_CONTACT, packets.CON_ERROR)
+	if rejected, _ := packets.DeseralizePacket[packets.Error](payload); err != nil || rejected.Code != packets.ERR_MESSAGE {
+		log.Printf("Edit of foreign text was not rejected: %s", err)
+		t.FailNow()
+	}
+
+	editHeader, edit := packets.CreateTextEdit(senderId, rand.Uint32(), recipientId, textHeader.MessageId, "Hello")
+	sendPacket(sender, editHeader, edit)
+	header, _, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK)
+	if err != nil || header.MessageId != editHeader.MessageId {
+		log.Printf("Edit was not acknowledged: %s", err)
+		t.FailNow()
+	}
+	_, payload, err = expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT_EDIT)
+	if received, _ := packets.DeseralizePacket[packets.TextEdit](payload); err != nil || received.MessageId != textHeader.MessageId || received.Message != "Hello" {
+		log.Printf("Edit was not forwarded: %s", err)
+		t.FailNow()
+	}
+
+	deleteHeader, remove := packets.CreateTextDelete(senderId, rand.Uint32(), recipientId, textHeader.MessageId)
+	sendPacket(sender, deleteHeader, remove)
+	if _, _, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK); err != nil {
+		t.FailNow()
+	}
+	_, payload, err = expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT_DELETE)
+	if received, _ := packets.DeseralizePacket[packets.TextEdit](payload); err != nil || received.MessageId != textHeader.MessageId {
+		log.Printf("Delete was not forwarded: %s", err)
+		t.FailNow()
+	}
+
+	// Deleted texts cannot be changed anymore
+	editHeader.MessageId = rand.Uint32()
+	sendPacket(sender, editHeader, edit)
+	_, payload, err = expectPacket(senderReader, packets.CAT_CONTACT, packets.CON_ERROR)
+	if rejected, _ := packets.DeseralizePacket[packets.Error](payload); err != nil || rejected.Code != packets.ERR_MESSAGE {
+		log.Printf("Edit of deleted text was not rejected: %s", err)
+		t.FailNow()
+	}
+}
+
+func TestSyncConversation(t *testing.T) {
+	senderId := uint32(1293812414)
+	recipientId := uint32(3718291512)
+	sender, senderReader, err := loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	recipient, recipientReader, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer recipient.Close()
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// The server assigns increasing sequence numbers regardless of the client clock
+	var sequences []uint64
+	for i, message := range []string{"First", "Second"} {
+		textHeader, text := packets.CreateText(senderId, rand.Uint32(), recipientId, message)
+		text.Timestamp = uint64(10 - i)
+		sendPacket(sender, textHeader, text)
+		_, payload, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK)
+		ack, _ := packets.DeseralizePacket[packets.TextAck](payload)
+		if err != nil || ack.Sequence == 0 || ack.Timestamp < text.Timestamp {
+			log.Printf("Ack does not carry the sequence: %s", err)
+			t.FailNow()
+		}
+		_, payload, err = expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT)
+		received, _ := packets.DeseralizePacket[packets.Text](payload)
+		if err != nil || received.Sequence != ack.Sequence || received.ServerTimestamp != ack.Timestamp {
+			log.Printf("Forwarded text does not carry the sequence: %s", err)
+			t.FailNow()
+		}
+		sequences = append(sequences, ack.Sequence)
+	}
+	if sequences[1] != sequences[0]+1 {
+		log.Printf("Sequence numbers %v are not consecutive", sequences)
+		t.FailNow()
+	}
+
+	syncHeader, request := packets.CreateSync(recipientId, rand.Uint32(), senderId, 0, sequences[0])
+	sendPacket(recipient, syncHeader, request)
+	_, payload, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT)
+	synced, _ := packets.DeseralizePacket[packets.Text](payload)
+	if err != nil || synced.Sequence != sequences[1] || synced.Message != "Second" {
+		log.Printf("Incorrect synced text: %s", err)
+		t.FailNow()
+	}
+	header, payload, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_SYNC)
+	answer, _ := packets.DeseralizePacket[packets.Sync](payload)
+	if err != nil || header.MessageId != syncHeader.MessageId || answer.After != sequences[1] || answer.More {
+		log.Printf("Incorrect sync answer %+v: %s", answer, err)
+		t.FailNow()
+	}
+}
+
+func TestResendAfterReconnect(t *testing.T) {
+	senderId := uint32(1293812414)
+	recipientId := uint32(3718291512)
+	sender, senderReader, err := loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	recipient, recipientReader, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer recipient.Close()
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	textHeader, text := packets.CreateText(senderId, rand.Uint32(), recipientId, "Only once")
+	sendPacket(sender, textHeader, text)
+	_, payload, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK)
+	original, _ := packets.DeseralizePacket[packets.TextAck](payload)
+	if err != nil {
+		t.FailNow()
+	}
+	if _, _, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT); err != nil {
+		t.FailNow()
+	}
+	sender.Close()
+
+	// The ack got lost, the client sends the text again after reconnecting
+	sender, senderReader, err = loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	sendPacket(sender, textHeader, text)
+	header, payload, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK)
+	resent, _ := packets.DeseralizePacket[packets.TextAck](payload)
+	if err != nil || header.MessageId != textHeader.MessageId || resent != original {
+		log.Printf("Did not receive the original ack: %+v %+v", resent, original)
+		t.FailNow()
+	}
+	recipient.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT); err == nil {
+		log.Printf("Text was delivered twice")
+		t.FailNow()
+	}
+}
+
+func sendPacket(conn net.Conn, header packets.Header, content any) {
+	packet, err := packets.SerializePacket(header, content)
+	if err != nil {
+		log.Printf("Failed to serialize packet: %s", err)
+		return
+	}
+	conn.Write(packet)
+}
+
+// Sends the request of the user and accepts it with the contact
+func addContact(user net.Conn, userReader *bufio.Reader, userId uint32, contact net.Conn, contactReader *bufio.Reader, contactId uint32) error {
+	addHeader, add := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Add"}, {Type: "Username", Value: "User"}})
+	sendPacket(user, addHeader, add)
+	_, payload, err := expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	if err != nil {
+		return err
+	}
+	question, err := packets.DeseralizePacket[packets.ContactOption](payload)
+	if err != nil || len(question.Options) == 0 || question.Options[0].Value != "Add" {
+		return errors.New("expected contact request")
+	}
+	acceptHeader, accept := packets.CreateContactOption(contactId, rand.Uint32(), userId, []packets.Option{{Type: "Answer", Value: "Accept"}})
+	sendPacket(contact, acceptHeader, accept)
+	header, payload, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	if err != nil {
+		return err
+	}
+	answer, err := packets.DeseralizePacket[packets.ContactOption](payload)
+	if err != nil || header.UserId != contactId || answer.Options[0].Value != "Accept" {
+		return errors.New("expected accepted request")
+	}
+	return nil
+}
+
+func TestContactRequest(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	// Answers without a request are dropped
+	acceptHeader, accept := packets.CreateContactOption(contactId, rand.Uint32(), userId, []packets.Option{{Type: "Answer", Value: "Accept"}})
+	sendPacket(contact, acceptHeader, accept)
+	time.Sleep(100 * time.Millisecond)
+
+	addHeader, add := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Add"}, {Type: "Username", Value: "User"}})
+	sendPacket(user, addHeader, add)
+	header, _, err := expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	if err != nil || header.UserId != userId {
+		log.Printf("Request was not forwarded: %s", err)
+		t.FailNow()
+	}
+	declineHeader, decline := packets.CreateContactOption(contactId, rand.Uint32(), userId, []packets.Option{{Type: "Answer", Value: "Decline"}})
+	sendPacket(contact, declineHeader, decline)
+	header, payload, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	if err != nil || header.UserId != contactId {
+		log.Printf("Answer was not forwarded: %s", err)
+		t.FailNow()
+	}
+	answer, _ := packets.DeseralizePacket[packets.ContactOption](payload)
+	if len(answer.Options) == 0 || answer.Options[0].Value != "Decline" {
+		log.Printf("Expected decline, got %+v", answer)
+		t.FailNow()
+	}
+
+	err = addContact(user, userReader, userId, contact, contactReader, contactId)
+	if err != nil {
+		log.Printf("Failed to add contact: %s", err)
+		t.FailNow()
+	}
+
+	// Removing updates both sides
+	removeHeader, remove := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Remove"}})
+	sendPacket(user, removeHeader, remove)
+	_, payload, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	if err != nil {
+		t.FailNow()
+	}
+	answer, _ = packets.DeseralizePacket[packets.ContactOption](payload)
+	if answer.Options[0].Value != "RemoveAck" {
+		t.FailNow()
+	}
+	header, payload, err = expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	if err != nil || header.UserId != userId {
+		log.Printf("Removed contact was not told: %s", err)
+		t.FailNow()
+	}
+	answer, _ = packets.DeseralizePacket[packets.ContactOption](payload)
+	if answer.Options[0].Value != "Remove" {
+		t.FailNow()
+	}
+}
+
+func TestPresence(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+	err = addContact(user, userReader, userId, contact, contactReader, contactId)
+	if err != nil {
+		t.FailNow()
+	}
+
+	contact.Close()
+	header, payload, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_PRESENCE)
+	if err != nil || header.UserId != contactId {
+		log.Printf("Did not receive offline presence: %s", err)
+		t.FailNow()
+	}
+	presence, _ := packets.DeseralizePacket[packets.Presence](payload)
+	if presence.ContactUserId != contactId || presence.Online || presence.LastSeen == 0 {
+		t.FailNow()
+	}
+
+	contact, _, err = loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	header, payload, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_PRESENCE)
+	if err != nil || header.UserId != contactId {
+		log.Printf("Did not receive online presence: %s", err)
+		t.FailNow()
+	}
+	presence, _ = packets.DeseralizePacket[packets.Presence](payload)
+	if !presence.Online {
+		t.FailNow()
+	}
+
+	// Only the presence of contacts is answered
+	requestHeader, request := packets.CreatePresenceRequest(userId, rand.Uint32(), []uint32{contactId, 12345})
+	sendPacket(user, requestHeader, request)
+	_, payload, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_PRESENCE_REQ)
+	if err != nil {
+		t.FailNow()
+	}
+	answer, _ := packets.DeseralizePacket[packets.PresenceList](payload)
+	if len(answer.Presence) != 1 || !answer.Presence[0].Online {
+		log.Printf("Incorrect presence answer: %+v", answer)
+		t.FailNow()
+	}
+
+	// A hidden contact is shown as offline
+	hideHeader, hide := packets.CreateContactOption(contactId, rand.Uint32(), contactId, []packets.Option{{Type: "Presence", Value: "Hide"}})
+	sendPacket(contact, hideHeader, hide)
+	time.Sleep(100 * time.Millisecond)
+	requestHeader.MessageId = rand.Uint32()
+	sendPacket(user, requestHeader, request)
+	_, payload, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_PRESENCE_REQ)
+	if err != nil {
+		t.FailNow()
+	}
+	answer, _ = packets.DeseralizePacket[packets.PresenceList](payload)
+	if len(answer.Presence) != 1 || answer.Presence[0].Online || answer.Presence[0].LastSeen != 0 {
+		log.Printf("Hidden contact was shown: %+v", answer)
+		t.FailNow()
+	}
+	showHeader, show := packets.CreateContactOption(contactId, rand.Uint32(), contactId, []packets.Option{{Type: "Presence", Value: "Show"}})
+	sendPacket(contact, showHeader, show)
+
+	removeHeader, remove := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Remove"}})
+	sendPacket(user, removeHeader, remove)
+	expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+}
+
+// Concurrent checks each get the answer for the user they asked for
+func TestOnlineCheck(t *testing.T) {
+	onlineC := make(chan apollon.OnlineMessage, 10)
+	connMap := map[uint32]net.Conn{1: nil, 3: nil}
+	go apollon.CheckUserOnline(onlineC, connMap)
+	reply := make(chan apollon.OnlineMessage, 1)
+	onlineC <- apollon.OnlineMessage{Id: 1, Reply: reply}
+	if answer := <-reply; answer.Id != 1 || !answer.Online {
+		log.Printf("Connected user is not online")
+		t.FailNow()
+	}
+	wrong := make(chan uint32, 100)
+	done := make(chan bool)
+	for i := uint32(0); i < 100; i++ {
+		go func(userId uint32) {
+			if apollon.IsOnline(userId, onlineC) != (userId%2 == 1) {
+				wrong <- userId
+			}
+			done <- true
+		}(i%4 + 1)
+	}
+	for i := 0; i < 100; i++ {
+		<-done
+	}
+	if len(wrong) != 0 {
+		log.Printf("Incorrect online state of %d", <-wrong)
+		t.FailNow()
+	}
+}
+
+func TestContactListSync(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+	err = addContact(user, userReader, userId, contact, contactReader, contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	_, payload, err := expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_CONTACT_UPD)
+	if err != nil {
+		log.Printf("Contact did not receive update: %s", err)
+		t.FailNow()
+	}
+	update, _ := packets.DeseralizePacket[packets.ContactUpdate](payload)
+	if update.Change != packets.CONTACT_ADDED || update.Contact.UserId != userId || update.Contact.Username == "" || !update.Presence.Online {
+		log.Printf("Incorrect contact update: %+v", update)
+		t.FailNow()
+	}
+
+	listHeader := packets.Header{Category: packets.CAT_CONTACT, Type: packets.CON_CONTACTS, UserId: userId, MessageId: rand.Uint32()}
+	sendPacket(user, listHeader, nil)
+	header, payload, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_CONTACTS)
+	if err != nil || header.MessageId != listHeader.MessageId {
+		log.Printf("Did not receive contact list: %s", err)
+		t.FailNow()
+	}
+	list, _ := packets.DeseralizePacket[packets.ContactList](payload)
+	if len(list.Contacts) != 1 || list.Contacts[0].UserId != contactId || len(list.Presence) != 1 || !list.Presence[0].Online {
+		log.Printf("Incorrect contact list: %+v", list)
+		t.FailNow()
+	}
+
+	// The list is sent right after the login
+	user.Close()
+	user, userReader, err = loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, payload, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_CONTACTS)
+	if err != nil {
+		log.Printf("Did not receive contact list after login: %s", err)
+		t.FailNow()
+	}
+	list, _ = packets.DeseralizePacket[packets.ContactList](payload)
+	if len(list.Contacts) != 1 {
+		t.FailNow()
+	}
+
+	removeHeader, remove := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Remove"}})
+	sendPacket(user, removeHeader, remove)
+	_, payload, err = expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_CONTACT_UPD)
+	if err != nil {
+		t.FailNow()
+	}
+	update, _ = packets.DeseralizePacket[packets.ContactUpdate](payload)
+	if update.Change != packets.CONTACT_REMOVED || update.Contact.UserId != userId {
+		t.FailNow()
+	}
+}
+
+func TestContactInfoOnlyToContacts(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	// Pushing to a non contact is rejected
+	infoHeader, info := packets.CreateContactInfo(userId, rand.Uint32(), "Username", testImage(4, 4), []uint32{contactId})
+	sendPacket(user, infoHeader, info)
+	header, _, err := readPacket(userReader)
+	if err != nil || header.Type != packets.CON_ERROR || header.MessageId != infoHeader.MessageId {
+		log.Printf("Contact info to non contact was not rejected: %s", err)
+		t.FailNow()
+	}
+
+	err = addContact(user, userReader, userId, contact, contactReader, contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	infoHeader.MessageId = rand.Uint32()
+	sendPacket(user, infoHeader, info)
+	_, _, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_CONTACT_ACK)
+	if err != nil {
+		t.FailNow()
+	}
+	header, payload, err := expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_CONTACT_INFO)
+	if err != nil || header.UserId != userId {
+		log.Printf("Contact did not receive info: %s", err)
+		t.FailNow()
+	}
+	forwarded, _ := packets.DeseralizePacket[packets.ContactInfo](payload)
+	if forwarded.Username != "Username" || len(forwarded.ContactIds) != 0 {
+		log.Printf("Incorrect forwarded info: %+v", forwarded)
+		t.FailNow()
+	}
+
+	removeHeader, remove := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Remove"}})
+	sendPacket(user, removeHeader, remove)
+	expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+}
+
+func TestBlockingUser(t *testing.T) {
+	userId := uint32(1293812414)
+	blockedId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	blocked, blockedReader, err := loginUser(blockedId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer blocked.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	blocked.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	blockHeader, block := packets.CreateContactOption(userId, rand.Uint32(), blockedId, []packets.Option{{Type: "Question", Value: "Block"}})
+	sendPacket(user, blockHeader, block)
+	_, payload, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	if err != nil {
+		t.FailNow()
+	}
+	answer, _ := packets.DeseralizePacket[packets.ContactOption](payload)
+	if answer.Options[0].Value != "BlockAck" {
+		t.FailNow()
+	}
+	defer func() {
+		unblockHeader, unblock := packets.CreateContactOption(userId, rand.Uint32(), blockedId, []packets.Option{{Type: "Question", Value: "Unblock"}})
+		sendPacket(user, unblockHeader, unblock)
+		expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+	}()
+
+	// The blocked user still gets the ack, but the text is never delivered
+	textHeader, text := packets.CreateText(blockedId, rand.Uint32(), userId, "Let me in")
+	sendPacket(blocked, textHeader, text)
+	_, _, err = expectPacket(blockedReader, packets.CAT_DATA, packets.D_TEXT_ACK)
+	if err != nil {
+		t.FailNow()
+	}
+	// Files of the blocked user are not kept for the blocking user, neither
+	// after the upload nor when the file was stored already
+	content := make([]byte, 512)
+	rand.Read(content)
+	hash := sha256.Sum256(content)
+	fileHeader, fileInfo := packets.CreateFileInfo(blockedId, rand.Uint32(), "blocked.bin", uint32(len(content)), 0, "None", 0)
+	fileInfo.ContactUserId = userId
+	fileInfo.ContentHash = hex.EncodeToString(hash[:])
+	sendPacket(blocked, fileHeader, fileInfo)
+	if _, _, err := expectPacket(blockedReader, packets.CAT_DATA, packets.D_FILE_HAVE); err != nil {
+		t.FailNow()
+	}
+	chunkHeader, chunk := packets.CreateFileChunk(blockedId, fileHeader.MessageId, 0, content)
+	sendPacket(blocked, chunkHeader, chunk)
+	if _, _, err := expectPacket(blockedReader, packets.CAT_DATA, packets.D_FILE_ACK); err != nil {
+		t.FailNow()
+	}
+	fileHeader.MessageId = rand.Uint32()
+	sendPacket(blocked, fileHeader, fileInfo)
+	if _, _, err := expectPacket(blockedReader, packets.CAT_DATA, packets.D_FILE_HAVE); err != nil {
+		t.FailNow()
+	}
+	if database.HasFileReference(fileInfo.ContentHash, userId) {
+		log.Printf("Blocked user stored a file for the blocking user")
+		t.FailNow()
+	}
+	addHeader, add := packets.CreateContactOption(blockedId, rand.Uint32(), userId, []packets.Option{{Type: "Question", Value: "Add"}, {Type: "Username", Value: "Contact"}})
+	sendPacket(blocked, addHeader, add)
+
+	// The blocked user gets the profile without image, as if it was hidden
+	profileHeader, profileRequest := packets.CreateProfileRequest(blockedId, rand.Uint32(), userId, 0)
+	sendPacket(blocked, profileHeader, profileRequest)
+	_, payload, err = expectPacket(blockedReader, packets.CAT_CONTACT, packets.CON_PROFILE)
+	if err != nil {
+		log.Printf("Blocked user did not get the hidden profile: %s", err)
+		t.FailNow()
+	}
+	profile, _ := packets.DeseralizePacket[packets.Profile](payload)
+	if profile.ContactUserId != userId || len(profile.Image) != 0 {
+		log.Printf("Blocked user got the profile: %+v", profile)
+		t.FailNow()
+	}
+	// The blocking user is shown as offline
+	presenceHeader, presenceRequest := packets.CreatePresenceRequest(blockedId, rand.Uint32(), []uint32{userId})
+	sendPacket(blocked, presenceHeader, presenceRequest)
+	_, payload, err = expectPacket(blockedReader, packets.CAT_CONTACT, packets.CON_PRESENCE_REQ)
+	if err != nil {
+		t.FailNow()
+	}
+	presence, _ := packets.DeseralizePacket[packets.PresenceList](payload)
+	for _, v := range presence.Presence {
+		if v.Online || v.LastSeen != 0 {
+			log.Printf("Blocked user got the presence: %+v", v)
+			t.FailNow()
+		}
+	}
+
+	searchHeader := packets.Header{Category: packets.CAT_CONTACT, Type: packets.CON_SEARCH, UserId: userId, MessageId: rand.Uint32()}
+	sendPacket(user, searchHeader, packets.Search{UserIdentifier: "Contact"})
+	header, payload, err := readPacket(userReader)
+	if err != nil || header.Type != packets.CON_CONTACTS {
+		log.Printf("Expected search answer, got %d: %s", header.Type, err)
+		t.FailNow()
+	}
+	list, _ := packets.DeseralizePacket[packets.ContactList](payload)
+	for _, v := range list.Contacts {
+		if v.UserId == blockedId {
+			log.Println("Blocked user was found in search!")
+			t.FailNow()
+		}
+	}
+}
+
+func TestPrivacySettings(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	invalidHeader, invalid := packets.CreatePrivacySettings(contactId, rand.Uint32(), []packets.Option{{Type: packets.PRIVACY_MESSAGES, Value: packets.PRIVACY_NOBODY}})
+	sendPacket(contact, invalidHeader, invalid)
+	header, _, err := readPacket(contactReader)
+	if err != nil || header.Type != packets.CON_ERROR {
+		log.Printf("Invalid setting was accepted: %s", err)
+		t.FailNow()
+	}
+
+	privacyHeader, privacy := packets.CreatePrivacySettings(contactId, rand.Uint32(), []packets.Option{{Type: packets.PRIVACY_MESSAGES, Value: packets.PRIVACY_CONTACTS}, {Type: packets.PRIVACY_SEARCH, Value: packets.PRIVACY_NOBODY}})
+	sendPacket(contact, privacyHeader, privacy)
+	header, payload, err := readPacket(contactReader)
+	if err != nil || header.Type != packets.CON_PRIVACY || header.MessageId != privacyHeader.MessageId {
+		log.Printf("Did not receive privacy settings: %s", err)
+		t.FailNow()
+	}
+	defer func() {
+		resetHeader, reset := packets.CreatePrivacySettings(contactId, rand.Uint32(), []packets.Option{{Type: packets.PRIVACY_MESSAGES, Value: packets.PRIVACY_EVERYONE}, {Type: packets.PRIVACY_SEARCH, Value: packets.PRIVACY_EVERYONE}})
+		sendPacket(contact, resetHeader, reset)
+		expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_PRIVACY)
+	}()
+	settings, _ := packets.DeseralizePacket[packets.PrivacySettings](payload)
+	if len(settings.Settings) != 4 {
+		log.Printf("Expected all settings, got %+v", settings)
+		t.FailNow()
+	}
+	for _, v := range settings.Settings {
+		if v.Type == packets.PRIVACY_SEARCH && v.Value != packets.PRIVACY_NOBODY {
+			t.FailNow()
+		}
+	}
+
+	// Only contacts can send texts now
+	textHeader, text := packets.CreateText(userId, rand.Uint32(), contactId, "Hello stranger")
+	sendPacket(user, textHeader, text)
+	header, payload, err = readPacket(userReader)
+	if err != nil || header.Type != packets.CON_ERROR {
+		log.Printf("Text to contact only user was not rejected: %s", err)
+		t.FailNow()
+	}
+	rejected, _ := packets.DeseralizePacket[packets.Error](payload)
+	if rejected.Code != packets.ERR_PRIVACY {
+		t.FailNow()
+	}
+
+	searchHeader := packets.Header{Category: packets.CAT_CONTACT, Type: packets.CON_SEARCH, UserId: userId, MessageId: rand.Uint32()}
+	sendPacket(user, searchHeader, packets.Search{UserIdentifier: "Contact"})
+	_, payload, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_CONTACTS)
+	if err != nil {
+		t.FailNow()
+	}
+	list, _ := packets.DeseralizePacket[packets.ContactList](payload)
+	if len(list.Contacts) != 0 {
+		log.Printf("Hidden user was found: %+v", list)
+		t.FailNow()
+	}
+}
+
+func TestProfileRetrieval(t *testing.T) {
+	userId := uint32(1293812414)
+	requesterId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	requester, requesterReader, err := loginUser(requesterId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer requester.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	requester.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	image := testImage(16, 16)
+	infoHeader, info := packets.CreateContactInfo(userId, rand.Uint32(), "Profilename", image, nil)
+	sendPacket(user, infoHeader, info)
+	_, _, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_CONTACT_ACK)
+	if err != nil {
+		t.FailNow()
+	}
+
+	requestHeader, request := packets.CreateProfileRequest(requesterId, rand.Uint32(), userId, 0)
+	sendPacket(requester, requestHeader, request)
+	header, payload, err := expectPacket(requesterReader, packets.CAT_CONTACT, packets.CON_PROFILE)
+	if err != nil || header.MessageId != requestHeader.MessageId {
+		log.Printf("Did not receive profile: %s", err)
+		t.FailNow()
+	}
+	// The username comes from the database, not from the contact info
+	profile, _ := packets.DeseralizePacket[packets.Profile](payload)
+	stored, _ := database.GetUser(userId)
+	if !profile.Changed || profile.Version == 0 || profile.Username != stored.Username || profile.Username == "Profilename" || profile.ImageFormat != packets.IMAGE_PNG || len(profile.Image) == 0 {
+		log.Printf("Incorrect profile: %+v", profile)
+		t.FailNow()
+	}
+
+	// The cached version is still up to date
+	requestHeader, request = packets.CreateProfileRequest(requesterId, rand.Uint32(), userId, profile.Version)
+	sendPacket(requester, requestHeader, request)
+	_, payload, err = expectPacket(requesterReader, packets.CAT_CONTACT, packets.CON_PROFILE)
+	if err != nil {
+		t.FailNow()
+	}
+	unchanged, _ := packets.DeseralizePacket[packets.Profile](payload)
+	if unchanged.Changed || unchanged.Version != profile.Version || len(unchanged.Image) != 0 {
+		log.Printf("Unchanged profile was sent again: %+v", unchanged)
+		t.FailNow()
+	}
+}
+
+// Encodes a PNG image with the given size
+func testImage(width int, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+		}
+	}
+	var buffer bytes.Buffer
+	png.Encode(&buffer, img)
+	return buffer.Bytes()
+}
+
+func TestNormalizeImage(t *testing.T) {
+	_, _, err := apollon.NormalizeImage([]byte{0x01, 0x02, 0x03})
+	if err == nil {
+		log.Printf("Invalid image was accepted")
+		t.FailNow()
+	}
+
+	apollon.SetMaxImageDimension(64)
+	defer apollon.SetMaxImageDimension(512)
+	normalized, format, err := apollon.NormalizeImage(testImage(256, 128))
+	if err != nil || format != packets.IMAGE_PNG {
+		log.Printf("Failed to normalize image: %s", err)
+		t.FailNow()
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(normalized))
+	if err != nil || config.Width != 64 || config.Height != 32 {
+		log.Printf("Image was not downscaled: %+v", config)
+		t.FailNow()
+	}
+
+	_, _, err = apollon.NormalizeImage(testImage(apollon.MAX_IMAGE_INPUT_DIMENSION+1, 1))
+	if err == nil {
+		log.Printf("Oversized image was accepted")
+		t.FailNow()
+	}
+
+	// Insert an EXIF segment directly after the start of image marker
+	var encoded bytes.Buffer
+	decoded, _, _ := image.Decode(bytes.NewReader(testImage(8, 8)))
+	jpeg.Encode(&encoded, decoded, nil)
+	exif := append([]byte{0xff, 0xe1, 0x00, 0x0f}, []byte("Exif\x00\x00GPSDATA")...)
+	withExif := append(append(append([]byte{}, encoded.Bytes()[:2]...), exif...), encoded.Bytes()[2:]...)
+	normalized, format, err = apollon.NormalizeImage(withExif)
+	if err != nil || format != packets.IMAGE_JPEG {
+		log.Printf("Failed to normalize JPEG: %s", err)
+		t.FailNow()
+	}
+	if bytes.Contains(normalized, []byte("Exif")) || bytes.Contains(normalized, []byte("GPSDATA")) {
+		log.Printf("EXIF data was not removed")
+		t.FailNow()
+	}
+}
+
+func TestRenameUser(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+	err = addContact(user, userReader, userId, contact, contactReader, contactId)
+	if err != nil {
+		t.FailNow()
+	}
+
+	renameHeader, rename := packets.CreateRename(userId, rand.Uint32(), "x")
+	sendPacket(user, renameHeader, rename)
+	header, _, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_ERROR)
+	if err != nil || header.MessageId != renameHeader.MessageId {
+		log.Printf("Invalid username was not rejected: %s", err)
+		t.FailNow()
+	}
+
+	renameHeader, rename = packets.CreateRename(userId, rand.Uint32(), "  Renamed   User ")
+	sendPacket(user, renameHeader, rename)
+	header, payload, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_RENAME)
+	if err != nil || header.MessageId != renameHeader.MessageId {
+		log.Printf("Did not receive rename answer: %s", err)
+		t.FailNow()
+	}
+	renamed, _ := packets.DeseralizePacket[packets.Create](payload)
+	if renamed.Username != "Renamed User" {
+		log.Printf("Incorrect username %s", renamed.Username)
+		t.FailNow()
+	}
+	for {
+		_, payload, err = expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_CONTACT_UPD)
+		if err != nil {
+			log.Printf("Contact was not notified: %s", err)
+			t.FailNow()
+		}
+		update, _ := packets.DeseralizePacket[packets.ContactUpdate](payload)
+		if update.Change != packets.CONTACT_RENAMED {
+			continue
+		}
+		if update.Contact.UserId != userId || update.Contact.Username != "Renamed User" {
+			log.Printf("Incorrect rename update: %+v", update)
+			t.FailNow()
+		}
+		break
+	}
+
+	renameHeader, rename = packets.CreateRename(userId, rand.Uint32(), "Testuser")
+	sendPacket(user, renameHeader, rename)
+	expectPacket(userReader, packets.CAT_CONTACT, packets.CON_RENAME)
+	removeHeader, remove := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Remove"}})
+	sendPacket(user, removeHeader, remove)
+	expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	contactId := uint32(3718291512)
+	user, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	userReader := bufio.NewReader(user)
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	createHeader, create := packets.CreateAccount(rand.Uint32(), "Short Lived")
+	sendPacket(user, createHeader, create)
+	header, _, err := expectPacket(userReader, packets.CAT_CONTACT, packets.CON_CREATE)
+	if err != nil || header.UserId == 0 {
+		log.Printf("Failed to create account: %s", err)
+		t.FailNow()
+	}
+	userId := header.UserId
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+	err = addContact(user, userReader, userId, contact, contactReader, contactId)
+	if err != nil {
+		t.FailNow()
+	}
+
+	deleteHeader := packets.CreateDeleteAccount(userId, rand.Uint32())
+	sendPacket(user, deleteHeader, nil)
+	header, _, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_DELETE)
+	if err != nil || header.MessageId != deleteHeader.MessageId {
+		log.Printf("Deletion was not confirmed: %s", err)
+		t.FailNow()
+	}
+	// The server closes the connection afterwards
+	for err == nil {
+		_, _, err = readPacket(userReader)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		log.Printf("Connection was not closed")
+		t.FailNow()
+	}
+	for {
+		_, payload, err := expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_CONTACT_UPD)
+		if err != nil {
+			log.Printf("Contact was not notified: %s", err)
+			t.FailNow()
+		}
+		update, _ := packets.DeseralizePacket[packets.ContactUpdate](payload)
+		if update.Change == packets.CONTACT_DELETED && update.Contact.UserId == userId {
+			break
+		}
+	}
+
+	// The account cannot be used anymore
+	user, userReader, err = loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = readPacket(userReader)
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		log.Printf("Login of deleted account was not rejected")
+		t.FailNow()
+	}
+}
+
+// Private keys of a test client for the key exchange
+type clientKeys struct {
+	identity ed25519.PrivateKey
+	exchange *ecdh.PrivateKey
+	preKeys  map[uint32]*ecdh.PrivateKey
+}
+
+func newClientKeys(preKeys int) (clientKeys, packets.KeyUpload) {
+	keys := clientKeys{preKeys: make(map[uint32]*ecdh.PrivateKey)}
+	identityPublic, identity, _ := ed25519.GenerateKey(crand.Reader)
+	keys.identity = identity
+	keys.exchange, _ = ecdh.X25519().GenerateKey(crand.Reader)
+	upload := packets.KeyUpload{
+		IdentityKey:       identityPublic,
+		ExchangeKey:       keys.exchange.PublicKey().Bytes(),
+		ExchangeSignature: ed25519.Sign(identity, keys.exchange.PublicKey().Bytes()),
+	}
+	for i := uint32(1); i <= uint32(preKeys); i++ {
+		preKey, _ := ecdh.X25519().GenerateKey(crand.Reader)
+		keys.preKeys[i] = preKey
+		upload.PreKeys = append(upload.PreKeys, packets.PreKey{KeyId: i, Key: preKey.PublicKey().Bytes(), Signature: ed25519.Sign(identity, preKey.PublicKey().Bytes())})
+	}
+	return keys, upload
+}
+
+// Checks the signatures of the bundle and returns the exchange key and prekey
+func verifyBundle(bundle packets.KeyBundle, identityKey []byte) (*ecdh.PublicKey, *ecdh.PublicKey, error) {
+	if !bytes.Equal(bundle.IdentityKey, identityKey) {
+		return nil, nil, errors.New("unexpected identity key")
+	}
+	if !ed25519.Verify(identityKey, bundle.ExchangeKey, bundle.ExchangeSignature) || !ed25519.Verify(identityKey, bundle.PreKey.Key, bundle.PreKey.Signature) {
+		return nil, nil, errors.New("invalid signature")
+	}
+	exchange, err := ecdh.X25519().NewPublicKey(bundle.ExchangeKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	preKey, err := ecdh.X25519().NewPublicKey(bundle.PreKey.Key)
+	return exchange, preKey, err
+}
+
+func sharedCipher(secrets ...[]byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(bytes.Join(secrets, nil))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func requestBundle(conn net.Conn, reader *bufio.Reader, userId uint32, contactId uint32) (packets.KeyBundle, error) {
+	requestHeader, request := packets.CreateKeyBundleRequest(userId, rand.Uint32(), contactId)
+	sendPacket(conn, requestHeader, request)
+	_, payload, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_KEY_BUNDLE)
+	if err != nil {
+		return packets.KeyBundle{}, err
+	}
+	return packets.DeseralizePacket[packets.KeyBundle](payload)
+}
+
+func TestKeyExchange(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	contact, contactReader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	contact.SetReadDeadline(time.Now().Add(3 * time.Second))
+	err = addContact(user, userReader, userId, contact, contactReader, contactId)
+	if err != nil {
+		t.FailNow()
+	}
+
+	// Both clients publish their keys, the contacts learn about the new identities
+	contactKeys, contactUpload := newClientKeys(2)
+	uploadHeader, upload := packets.CreateKeyUpload(contactId, rand.Uint32(), contactUpload.IdentityKey, contactUpload.ExchangeKey, contactUpload.ExchangeSignature, contactUpload.PreKeys)
+	sendPacket(contact, uploadHeader, upload)
+	_, payload, err := expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_KEYS)
+	status, _ := packets.DeseralizePacket[packets.KeyStatus](payload)
+	if err != nil || status.PreKeys != 2 {
+		log.Printf("Keys were not stored: %s", err)
+		t.FailNow()
+	}
+	_, payload, err = expectPacket(userReader, packets.CAT_CONTACT, packets.CON_KEY_CHANGE)
+	change, _ := packets.DeseralizePacket[packets.KeyBundle](payload)
+	if err != nil || change.ContactUserId != contactId || !bytes.Equal(change.IdentityKey, contactUpload.IdentityKey) {
+		log.Printf("Did not receive key change: %s", err)
+		t.FailNow()
+	}
+	contactIdentity := change.IdentityKey
+	userKeys, userUpload := newClientKeys(1)
+	uploadHeader, upload = packets.CreateKeyUpload(userId, rand.Uint32(), userUpload.IdentityKey, userUpload.ExchangeKey, userUpload.ExchangeSignature, userUpload.PreKeys)
+	sendPacket(user, uploadHeader, upload)
+	expectPacket(userReader, packets.CAT_CONTACT, packets.CON_KEYS)
+	_, payload, err = expectPacket(contactReader, packets.CAT_CONTACT, packets.CON_KEY_CHANGE)
+	change, _ = packets.DeseralizePacket[packets.KeyBundle](payload)
+	if err != nil || !bytes.Equal(change.IdentityKey, userUpload.IdentityKey) {
+		t.FailNow()
+	}
+
+	// The user fetches the bundle of the contact and encrypts a text with it
+	bundle, err := requestBundle(user, userReader, userId, contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	contactExchange, contactPreKey, err := verifyBundle(bundle, contactIdentity)
+	if err != nil {
+		log.Printf("Invalid bundle: %s", err)
+		t.FailNow()
+	}
+	ephemeral, _ := ecdh.X25519().GenerateKey(crand.Reader)
+	first, _ := userKeys.exchange.ECDH(contactExchange)
+	second, _ := ephemeral.ECDH(contactExchange)
+	third, _ := ephemeral.ECDH(contactPreKey)
+	aead, err := sharedCipher(first, second, third)
+	if err != nil {
+		t.FailNow()
+	}
+	nonce := make([]byte, aead.NonceSize())
+	crand.Read(nonce)
+	envelope := binary.BigEndian.AppendUint32(ephemeral.PublicKey().Bytes(), bundle.PreKey.KeyId)
+	envelope = append(envelope, nonce...)
+	envelope = aead.Seal(envelope, nonce, []byte("Secret text"), nil)
+	textHeader, text := packets.CreateText(userId, rand.Uint32(), contactId, "")
+	text.Ciphertext = envelope
+	sendPacket(user, textHeader, text)
+	_, _, err = expectPacket(userReader, packets.CAT_DATA, packets.D_TEXT_ACK)
+	if err != nil {
+		t.FailNow()
+	}
+
+	// The contact verifies the identity of the user and decrypts the text
+	_, payload, err = expectPacket(contactReader, packets.CAT_DATA, packets.D_TEXT)
+	if err != nil {
+		t.FailNow()
+	}
+	received, _ := packets.DeseralizePacket[packets.Text](payload)
+	userBundle, err := requestBundle(contact, contactReader, contactId, userId)
+	if err != nil {
+		t.FailNow()
+	}
+	userExchange, _, err := verifyBundle(userBundle, userUpload.IdentityKey)
+	if err != nil || len(received.Ciphertext) < 36+aead.NonceSize() || received.Message != "" {
+		log.Printf("Incorrect text or bundle: %s", err)
+		t.FailNow()
+	}
+	ephemeralKey, _ := ecdh.X25519().NewPublicKey(received.Ciphertext[:32])
+	preKey := contactKeys.preKeys[binary.BigEndian.Uint32(received.Ciphertext[32:36])]
+	first, _ = contactKeys.exchange.ECDH(userExchange)
+	second, _ = contactKeys.exchange.ECDH(ephemeralKey)
+	third, _ = preKey.ECDH(ephemeralKey)
+	aead, _ = sharedCipher(first, second, third)
+	rest := received.Ciphertext[36:]
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], nil)
+	if err != nil || string(plain) != "Secret text" {
+		log.Printf("Failed to decrypt text: %s", err)
+		t.FailNow()
+	}
+
+	removeHeader, remove := packets.CreateContactOption(userId, rand.Uint32(), contactId, []packets.Option{{Type: "Question", Value: "Remove"}})
+	sendPacket(user, removeHeader, remove)
+	expectPacket(userReader, packets.CAT_CONTACT, packets.CON_OPTION)
+}
+
+func TestNoiseConnection(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	key, err := server.LoadNoiseKey(noiseKeyfile)
+	if err != nil {
+		log.Printf("Failed to load server key: %s", err)
+		t.FailNow()
+	}
+	serverKey := key.PublicKey().Bytes()
+
+	// Clients only talk to the server with the pinned key
+	otherKey, _ := ecdh.X25519().GenerateKey(crand.Reader)
+	_, err = server.DialNoise("127.0.0.1:50003", otherKey.PublicKey().Bytes(), nil)
+	if err == nil {
+		log.Printf("Handshake with wrong pinned key succeeded")
+		t.FailNow()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	conn, err := server.DialNoise("127.0.0.1:50003", serverKey, nil)
+	if err != nil {
+		log.Printf("Noise handshake failed: %s", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+	if !bytes.Equal(conn.RemoteStatic(), serverKey) {
+		t.FailNow()
+	}
+	reader := bufio.NewReader(conn)
+	sendPacket(conn, packets.CreateLogin(userId, rand.Uint32()), nil)
+	time.Sleep(100 * time.Millisecond)
+
+	// Texts larger than a single Noise message are split and joined again
+	messageId := rand.Uint32()
+	textHeader, text := packets.CreateText(userId, messageId, contactId, string(bytes.Repeat([]byte("a"), 100000)))
+	sendPacket(conn, textHeader, text)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	header, payload, err := expectPacket(reader, packets.CAT_DATA, packets.D_TEXT_ACK)
+	if err != nil || header.MessageId != messageId {
+		log.Printf("Expected text ack over Noise: %s", err)
+		t.FailNow()
+	}
+	ack, err := packets.DeseralizePacket[packets.TextAck](payload)
+	if err != nil || ack.ContactUserId != contactId {
+		t.FailNow()
+	}
+
+	// Plain packets are not accepted on the Noise port
+	plain, err := net.Dial("tcp", "127.0.0.1:50003")
+	if err != nil {
+		t.FailNow()
+	}
+	defer plain.Close()
+	sendPacket(plain, packets.CreateLogin(userId, rand.Uint32()), nil)
+	plain.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = bufio.NewReader(plain).ReadByte()
+	if err == nil {
+		log.Printf("Server answered a plain packet on the Noise port")
+		t.FailNow()
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	if apollon.SetRateLimits("1.2=1") == nil || apollon.SetRateLimits("1.x=1/2") == nil || apollon.SetRateLimits("1.2=0.5/0") == nil {
+		log.Printf("Invalid rate limits were accepted")
+		t.FailNow()
+	}
+	userId := uint32(3718291512)
+	apollon.SetRateLimit(packets.CAT_CONTACT, packets.CON_SEARCH, apollon.RateLimit{Rate: 0.01, Burst: 3})
+	defer apollon.SetRateLimit(packets.CAT_CONTACT, packets.CON_SEARCH, apollon.RateLimit{Rate: 2, Burst: 10})
+	conn, reader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	search := func() {
+		searchHeader := packets.Header{Category: packets.CAT_CONTACT, Type: packets.CON_SEARCH, UserId: userId, MessageId: rand.Uint32()}
+		sendPacket(conn, searchHeader, packets.Search{UserIdentifier: "Test"})
+	}
+	for i := 0; i < 3; i++ {
+		search()
+		if _, _, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_CONTACTS); err != nil {
+			log.Printf("Search %d within the burst failed: %s", i, err)
+			t.FailNow()
+		}
+	}
+	search()
+	_, payload, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_ERROR)
+	if rejected, _ := packets.DeseralizePacket[packets.Error](payload); err != nil || rejected.Code != packets.ERR_THROTTLED {
+		log.Printf("Search was not throttled: %s", err)
+		t.FailNow()
+	}
+	throttled := expvar.Get("ratelimit").(*expvar.Map).Get("throttled").(*expvar.Map).Get("1.2")
+	if throttled == nil || throttled.String() == "0" {
+		log.Printf("Throttled search is missing in the metrics")
+		t.FailNow()
+	}
+
+	// Clients that keep flooding are disconnected
+	for i := 0; i < apollon.MAX_THROTTLED; i++ {
+		search()
+	}
+	for err == nil {
+		_, _, err = readPacket(reader)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		log.Printf("Flooding client was not disconnected")
+		t.FailNow()
+	}
+	if expvar.Get("ratelimit").(*expvar.Map).Get("disconnects").String() == "0" {
+		t.FailNow()
+	}
+
+	// Key bundles are limited by default, every bundle uses up a prekey
+	limits := expvar.Get("ratelimit").(*expvar.Map).Get("limits").String()
+	if !strings.Contains(limits, `"1.27"`) {
+		log.Printf("Key bundles have no default limit: %s", limits)
+		t.FailNow()
+	}
+}
+
+// Writes the beginning of a frame followed by up to total bytes without a
+// newline. Returns the number of written bytes once the server closed the
+// connection.
+func streamWithoutNewline(start []byte, total int64) (int64, error) {
+	conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Second))
+	written := int64(0)
+	chunk := bytes.Repeat([]byte("a"), 1024*1024)
+	_, err = conn.Write(start)
+	for err == nil && written < total {
+		var n int
+		n, err = conn.Write(chunk)
+		written += int64(n)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return written, errors.New("server stopped reading without closing")
+	}
+	if err == nil {
+		return written, errors.New("server accepted the whole stream")
+	}
+	return written, nil
+}
+
+func TestOversizedFrames(t *testing.T) {
+	if apollon.SetFrameLimits("1.2") == nil || apollon.SetFrameLimits("1.2=x") == nil {
+		log.Printf("Invalid frame limits were accepted")
+		t.FailNow()
+	}
+	if apollon.FrameLimit(packets.CAT_CONTACT, packets.CON_SEARCH) >= apollon.FrameLimit(packets.CAT_DATA, packets.D_FILE) {
+		t.FailNow()
+	}
+	userId := uint32(1293812414)
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	// A client that never sends a newline is disconnected instead of filling the memory
+	written, err := streamWithoutNewline(nil, 4*1024*1024*1024)
+	if err != nil || written > 256*1024*1024 {
+		log.Printf("Stream without header was not cut off after %d bytes: %s", written, err)
+		t.FailNow()
+	}
+	fileHeader, _ := packets.SerializePacket(packets.Header{Category: packets.CAT_DATA, Type: packets.D_FILE, UserId: userId, MessageId: rand.Uint32()}, nil)
+	written, err = streamWithoutNewline(fileHeader[:10], 4*1024*1024*1024)
+	if err != nil || written > 256*1024*1024 {
+		log.Printf("File chunk stream was not cut off after %d bytes: %s", written, err)
+		t.FailNow()
+	}
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc > before.HeapAlloc+64*1024*1024 {
+		log.Printf("Heap grew from %d to %d bytes", before.HeapAlloc, after.HeapAlloc)
+		t.FailNow()
+	}
+
+	// Oversized frames are answered with an error before the disconnect
+	conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	searchHeader := packets.Header{Category: packets.CAT_CONTACT, Type: packets.CON_SEARCH, UserId: userId, MessageId: rand.Uint32()}
+	frame, _ := packets.SerializePacket(searchHeader, packets.Search{UserIdentifier: string(bytes.Repeat([]byte("a"), 4096))})
+	conn.Write(frame[:4096])
+	reader := bufio.NewReader(conn)
+	header, payload, err := readPacket(reader)
+	rejected, _ := packets.DeseralizePacket[packets.Error](payload)
+	if err != nil || header.Type != packets.CON_ERROR || header.MessageId != searchHeader.MessageId || rejected.Code != packets.ERR_FRAME_SIZE {
+		log.Printf("Oversized search was not rejected: %s", err)
+		t.FailNow()
+	}
+	if _, _, err := readPacket(reader); err == nil {
+		log.Printf("Connection was not closed")
+		t.FailNow()
+	}
+}
+
+func TestCompressedFrameLimit(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	negotiateHeader, negotiate := packets.CreateNegotiate(userId, rand.Uint32(), []string{packets.COMPRESSION_GZIP})
+	sendPacket(conn, negotiateHeader, negotiate)
+	if _, _, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_NEGOTIATE); err != nil {
+		t.FailNow()
+	}
+	sendPacket(conn, packets.CreateLogin(userId, rand.Uint32()), nil)
+	time.Sleep(100 * time.Millisecond)
+
+	// The text is small on the wire but too large after decompressing
+	size := apollon.FrameLimit(packets.CAT_DATA, packets.D_TEXT)
+	textHeader, text := packets.CreateText(userId, rand.Uint32(), contactId, string(bytes.Repeat([]byte("a"), size)))
+	packet, _ := packets.SerializePacket(textHeader, text)
+	packet, _ = packets.CompressPacket(packet, packets.COMPRESSION_GZIP)
+	if len(packet) > size {
+		t.FailNow()
+	}
+	conn.Write(packet)
+	header, payload, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_ERROR)
+	if err != nil || header.MessageId != textHeader.MessageId {
+		log.Printf("Decompressed text was not rejected: %s", err)
+		t.FailNow()
+	}
+	if payload, err = packets.DecompressPayload(payload, packets.COMPRESSION_GZIP); err != nil {
+		t.FailNow()
+	}
+	if rejected, _ := packets.DeseralizePacket[packets.Error](payload); rejected.Code != packets.ERR_FRAME_SIZE {
+		t.FailNow()
+	}
+}
+
+func expectRejected(reader *bufio.Reader) error {
+	header, payload, err := readPacket(reader)
+	if err != nil {
+		return err
+	}
+	rejected, _ := packets.DeseralizePacket[packets.Error](payload)
+	if header.Type != packets.CON_ERROR || rejected.Code != packets.ERR_ADMISSION {
+		return errors.New("connection was not rejected")
+	}
+	if _, _, err := readPacket(reader); err == nil {
+		return errors.New("rejected connection was not closed")
+	}
+	return nil
+}
+
+func TestAdmissionControl(t *testing.T) {
+	// Connections of previous tests might still be closing
+	time.Sleep(200 * time.Millisecond)
+	open := server.OpenConnections()
+	server.SetAdmissionLimits(0, open+2)
+	defer server.SetAdmissionLimits(0, 0)
+	var conns []net.Conn
+	defer func() {
+		for _, v := range conns {
+			v.Close()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+		if err != nil {
+			t.FailNow()
+		}
+		conns = append(conns, conn)
+		time.Sleep(50 * time.Millisecond)
+	}
+	conns[2].SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := expectRejected(bufio.NewReader(conns[2])); err != nil {
+		log.Printf("Third connection from the host: %s", err)
+		t.FailNow()
+	}
+
+	// Closed connections free their slot
+	conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	conns = append(conns, conn)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, _, err = readPacket(bufio.NewReader(conn))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		log.Printf("Connection was not accepted after another one closed: %s", err)
+		t.FailNow()
+	}
+
+	server.SetAdmissionLimits(server.OpenConnections(), 0)
+	conn, err = net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	conns = append(conns, conn)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := expectRejected(bufio.NewReader(conn)); err != nil {
+		log.Printf("Connection above the total limit: %s", err)
+		t.FailNow()
+	}
+	if expvar.Get("connections").(*expvar.Map).Get("rejected").String() == "0" {
+		t.FailNow()
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	apollon.SetLoginTimeout(300 * time.Millisecond)
+	defer apollon.SetLoginTimeout(30 * time.Second)
+	idle, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	defer idle.Close()
+	user, reader, err := loginUser(1293812414)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		log.Printf("Connection without login was not closed: %s", err)
+		t.FailNow()
+	}
+	time.Sleep(300 * time.Millisecond)
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	sendPacket(user, packets.Header{Category: packets.CAT_CONTACT, Type: packets.CON_CONTACTS, UserId: 1293812414, MessageId: rand.Uint32()}, nil)
+	if _, _, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_CONTACTS); err != nil {
+		log.Printf("Logged in connection was closed: %s", err)
+		t.FailNow()
+	}
+}
+
+func TestOutboundQueue(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	outbound := apollon.NewOutboundConn(server)
+	for i := uint32(1); i <= 3; i++ {
+		packet, _ := packets.SerializePacket(packets.Header{Category: packets.CAT_DATA, Type: packets.D_TEXT, UserId: 1, MessageId: i}, nil)
+		outbound.Write(packet)
+	}
+	// Queued packets are still sent after closing the connection
+	outbound.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+	for i := uint32(1); i <= 3; i++ {
+		header, _, err := readPacket(reader)
+		if err != nil || header.MessageId != i {
+			log.Printf("Queued packet %d was not sent: %s", i, err)
+			t.FailNow()
+		}
+	}
+	if _, _, err := readPacket(reader); err == nil {
+		log.Printf("Connection was not closed")
+		t.FailNow()
+	}
+	if _, err := outbound.Write([]byte("\n")); err == nil {
+		log.Printf("Closed connection accepted packets")
+		t.FailNow()
+	}
+}
+
+func mailboxIds(userId uint32, count int) map[uint32]bool {
+	ids := make(map[uint32]bool)
+	for i := 0; i < 20 && len(ids) < count; i++ {
+		time.Sleep(100 * time.Millisecond)
+		mailbox, _ := database.ReadMailbox(userId)
+		ids = make(map[uint32]bool)
+		for _, v := range mailbox {
+			ids[v.Header.MessageId] = true
+		}
+	}
+	return ids
+}
+
+func TestSlowRecipient(t *testing.T) {
+	apollon.SetOutboundLimits(2, 200*time.Millisecond)
+	defer apollon.SetOutboundLimits(256, 10*time.Second)
+	// Connections of previous tests must not write to the test database
+	time.Sleep(300 * time.Millisecond)
+	database.SetDatabaseNoWrite(false)
+	defer database.SetDatabaseNoWrite(true)
+	overflowId := uint32(4000000001)
+	timeoutId := uint32(4000000002)
+	defer database.DeleteMailbox(overflowId)
+	defer database.DeleteMailbox(timeoutId)
+
+	// Forwarded packets of a recipient whose queue overflows go to the mailbox
+	client, server := net.Pipe()
+	defer client.Close()
+	outbound := apollon.NewOutboundConn(server)
+	outbound.SetUser(overflowId)
+	for i := uint32(1); i <= 4; i++ {
+		packet, _ := packets.SerializePacket(packets.Header{Category: packets.CAT_DATA, Type: packets.D_TEXT, UserId: 1, MessageId: i}, packets.Text{Message: "Text"})
+		outbound.Forward(packet)
+	}
+	ids := mailboxIds(overflowId, 4)
+	if len(ids) != 4 {
+		log.Printf("Pending packets were not moved to the mailbox: %v", ids)
+		t.FailNow()
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		log.Printf("Overflowing recipient was not disconnected")
+		t.FailNow()
+	}
+
+	// A recipient that does not read within the timeout is disconnected as well
+	client, server = net.Pipe()
+	defer client.Close()
+	outbound = apollon.NewOutboundConn(server)
+	outbound.SetUser(timeoutId)
+	packet, _ := packets.SerializePacket(packets.Header{Category: packets.CAT_DATA, Type: packets.D_TEXT, UserId: 1, MessageId: 5}, packets.Text{Message: "Text"})
+	outbound.Forward(packet)
+	if ids := mailboxIds(timeoutId, 1); !ids[5] {
+		log.Printf("Packet of stuck recipient was not moved to the mailbox")
+		t.FailNow()
+	}
+	mailbox, _ := database.ReadMailbox(timeoutId)
+	text, err := packets.DeseralizePacket[packets.Text](mailbox[0].Payload)
+	if err != nil || text.Message != "Text" {
+		t.FailNow()
+	}
+}
+
+func TestStaleDisconnect(t *testing.T) {
+	senderId := uint32(1293812414)
+	recipientId := uint32(3718291512)
+	sender, senderReader, err := loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	old, _, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	recipient, recipientReader, err := loginUser(recipientId)
+	if err != nil {
+		old.Close()
+		t.FailNow()
+	}
+	defer recipient.Close()
+	// Closing the old connection must keep the newer one registered
+	old.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	textHeader, text := packets.CreateText(senderId, rand.Uint32(), recipientId, "Still there?")
+	sendPacket(sender, textHeader, text)
+	if _, _, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK); err != nil {
+		t.FailNow()
+	}
+	header, _, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT)
+	if err != nil || header.MessageId != textHeader.MessageId {
+		log.Printf("Text was not forwarded to the newer connection: %s", err)
+		t.FailNow()
+	}
+}
+
+func TestDeliveryReceipt(t *testing.T) {
+	senderId := uint32(1293812414)
+	recipientId := uint32(3718291512)
+	sender, senderReader, err := loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	recipient, recipientReader, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer recipient.Close()
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	confirmed := expvar.Get("deliveries").(*expvar.Map).Get("confirmed").(*expvar.Int)
+	before := confirmed.Value()
+
+	textHeader, text := packets.CreateText(senderId, rand.Uint32(), recipientId, "Did this arrive?")
+	sendPacket(sender, textHeader, text)
+	if _, _, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT); err != nil {
+		t.FailNow()
+	}
+	receiptHeader, receipt := packets.CreateTextReceipt(recipientId, rand.Uint32(), packets.D_TEXT_DELIVERED, senderId, textHeader.MessageId)
+	sendPacket(recipient, receiptHeader, receipt)
+	if _, _, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_DELIVERED); err != nil {
+		t.FailNow()
+	}
+	if confirmed.Value() != before+1 {
+		log.Printf("Receipt did not confirm the delivery")
+		t.FailNow()
+	}
+}
+
+func forwardText(fwdC chan apollon.ForwardMessage, recipient uint32, messageId uint32) {
+	header, text := packets.CreateText(1, messageId, recipient, "Text")
+	packet, _ := packets.SerializePacket(header, text)
+	fwdC <- apollon.ForwardMessage{Packet: packet, ForwardId: recipient}
+}
+
+func TestDeliveryFaults(t *testing.T) {
+	apollon.SetDeliveryTimeout(300 * time.Millisecond)
+	defer apollon.SetDeliveryTimeout(30 * time.Second)
+	// Connections of previous tests must not write to the test database
+	time.Sleep(300 * time.Millisecond)
+	database.SetDatabaseNoWrite(false)
+	defer database.SetDatabaseNoWrite(true)
+	recipientId := uint32(4000000003)
+	droppedId := uint32(4000000004)
+	defer database.DeleteMailbox(recipientId)
+	defer database.DeleteMailbox(droppedId)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	outbound := apollon.NewOutboundConn(server)
+	outbound.SetUser(recipientId)
+	fwdC := make(chan apollon.ForwardMessage)
+	go apollon.ForwardingPackets(fwdC, map[uint32]net.Conn{recipientId: outbound})
+	reader := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// The recipient went offline after it was checked
+	forwardText(fwdC, droppedId, 1)
+	if ids := mailboxIds(droppedId, 1); !ids[1] {
+		log.Printf("Text for dropped recipient was lost")
+		t.FailNow()
+	}
+
+	// A confirmed text is done, an unconfirmed one goes to the mailbox
+	forwardText(fwdC, recipientId, 2)
+	if header, _, err := readPacket(reader); err != nil || header.MessageId != 2 {
+		t.FailNow()
+	}
+	if !apollon.ConfirmDelivery(recipientId, 1, 2) {
+		log.Printf("Text was not waiting for the receipt")
+		t.FailNow()
+	}
+	forwardText(fwdC, recipientId, 3)
+	if header, _, err := readPacket(reader); err != nil || header.MessageId != 3 {
+		t.FailNow()
+	}
+	ids := mailboxIds(recipientId, 1)
+	if !ids[3] || ids[2] {
+		log.Printf("Incorrect texts in mailbox after timeout: %v", ids)
+		t.FailNow()
+	}
+	// The receipt came late, the stored copy must not be delivered again
+	if apollon.ConfirmDelivery(recipientId, 1, 3) {
+		log.Printf("Stored text is still waiting for the receipt")
+		t.FailNow()
+	}
+	if mailbox, _ := database.ReadMailbox(recipientId); len(mailbox) != 0 {
+		log.Printf("Late confirmed text is still in the mailbox")
+		t.FailNow()
+	}
+	database.DeleteMailbox(recipientId)
+
+	// Texts that were sent or queued when the connection broke are kept
+	apollon.SetDeliveryTimeout(30 * time.Second)
+	forwardText(fwdC, recipientId, 4)
+	if header, _, err := readPacket(reader); err != nil || header.MessageId != 4 {
+		t.FailNow()
+	}
+	forwardText(fwdC, recipientId, 5)
+	forwardText(fwdC, recipientId, 6)
+	client.Close()
+	ids = mailboxIds(recipientId, 3)
+	if len(ids) != 3 || !ids[4] || !ids[5] || !ids[6] {
+		log.Printf("Texts were lost on disconnect: %v", ids)
+		t.FailNow()
+	}
+	if apollon.ConfirmDelivery(recipientId, 1, 4) {
+		log.Printf("Stored text is still waiting for the receipt")
+		t.FailNow()
+	}
+}
+
+func TestDeleteUnconfirmedText(t *testing.T) {
+	apollon.SetDeliveryTimeout(300 * time.Millisecond)
+	defer apollon.SetDeliveryTimeout(30 * time.Second)
+	// Connections of previous tests must not write to the test database
+	time.Sleep(300 * time.Millisecond)
+	database.SetDatabaseNoWrite(false)
+	defer database.SetDatabaseNoWrite(true)
+	senderId := uint32(1293812414)
+	recipientId := uint32(3718291512)
+	defer database.DeleteMailbox(recipientId)
+	sender, senderReader, err := loginUser(senderId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	recipient, recipientReader, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer recipient.Close()
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// The recipient never confirms the text
+	textHeader, text := packets.CreateText(senderId, rand.Uint32(), recipientId, "Sent by mistake")
+	sendPacket(sender, textHeader, text)
+	if _, _, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT); err != nil {
+		t.FailNow()
+	}
+	deleteHeader, remove := packets.CreateTextDelete(senderId, rand.Uint32(), recipientId, textHeader.MessageId)
+	sendPacket(sender, deleteHeader, remove)
+	if _, _, err := expectPacket(senderReader, packets.CAT_DATA, packets.D_TEXT_ACK); err != nil {
+		t.FailNow()
+	}
+	if _, _, err := expectPacket(recipientReader, packets.CAT_DATA, packets.D_TEXT_DELETE); err != nil {
+		t.FailNow()
+	}
+	time.Sleep(600 * time.Millisecond)
+
+	// The deleted text must not come back from the mailbox
+	relogin, reloginReader, err := loginUser(recipientId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer relogin.Close()
+	relogin.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		header, _, err := readPacket(reloginReader)
+		if err != nil {
+			break
+		}
+		if header.Category == packets.CAT_DATA && header.Type == packets.D_TEXT && header.MessageId == textHeader.MessageId {
+			log.Printf("Deleted text was delivered after the timeout")
+			t.FailNow()
+		}
+	}
+	// The conversation of the test is not kept in the test database
+	database.SetDatabaseNoWrite(true)
+	database.DeleteHistoryOf(senderId)
+	database.DeleteSeenMessages(senderId)
+	database.RemoveReceiptsOf(senderId)
+}
+
+// Reads until the server closes the connection
+func expectClosed(reader *bufio.Reader) error {
+	var err error
+	for err == nil {
+		_, _, err = readPacket(reader)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errors.New("connection was not closed")
+	}
+	return nil
+}
+
+func TestSpoofedUserId(t *testing.T) {
+	userId := uint32(1293812414)
+	victimId := uint32(3718291512)
+	victim, _, err := loginUser(victimId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer victim.Close()
+
+	// Connections without login cannot act for online users
+	anonymous, err := net.Dial("tcp", "127.0.0.1"+":"+"50000")
+	if err != nil {
+		t.FailNow()
+	}
+	defer anonymous.Close()
+	anonymous.SetReadDeadline(time.Now().Add(2 * time.Second))
+	sendPacket(anonymous, packets.CreateDeleteAccount(victimId, rand.Uint32()), nil)
+	if err := expectClosed(bufio.NewReader(anonymous)); err != nil {
+		log.Printf("Deletion without login: %s", err)
+		t.FailNow()
+	}
+
+	// Logged in users cannot act for other users
+	user, reader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	sendPacket(user, packets.CreateDeleteAccount(victimId, rand.Uint32()), nil)
+	if err := expectClosed(reader); err != nil {
+		log.Printf("Deletion for another user: %s", err)
+		t.FailNow()
+	}
+	if database.IsDeleted(victimId) || !database.IdExists(victimId) {
+		log.Printf("Account was deleted by another connection")
+		t.FailNow()
+	}
+}
+
+func TestKeysOfOtherUsers(t *testing.T) {
+	userId := uint32(1293812414)
+	victimId := uint32(3718291512)
+	_, victimUpload := newClientKeys(2)
+	database.StoreKeys(victimId, victimUpload)
+	// The spoofed user is online, otherwise the packet is dropped anyway
+	victim, _, err := loginUser(victimId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer victim.Close()
+
+	// Keys can only be uploaded for the user of the connection
+	user, reader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, spoofed := newClientKeys(1)
+	uploadHeader, upload := packets.CreateKeyUpload(victimId, rand.Uint32(), spoofed.IdentityKey, spoofed.ExchangeKey, spoofed.ExchangeSignature, spoofed.PreKeys)
+	sendPacket(user, uploadHeader, upload)
+	if err := expectClosed(reader); err != nil {
+		log.Printf("Upload for another user: %s", err)
+		t.FailNow()
+	}
+	if identity, _ := database.GetIdentityKey(victimId); !bytes.Equal(identity, victimUpload.IdentityKey) {
+		log.Printf("Identity key was replaced by another user")
+		t.FailNow()
+	}
+
+	// Blocked users are told that there are no keys
+	database.BlockUser(victimId, userId)
+	defer database.UnblockUser(victimId, userId)
+	user, reader, err = loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	requestHeader, request := packets.CreateKeyBundleRequest(userId, rand.Uint32(), victimId)
+	sendPacket(user, requestHeader, request)
+	_, payload, err := expectPacket(reader, packets.CAT_CONTACT, packets.CON_ERROR)
+	answer, _ := packets.DeseralizePacket[packets.Error](payload)
+	if err != nil || answer.Code != packets.ERR_KEYS || answer.Message != "no keys published" {
+		log.Printf("Block was revealed: %+v", answer)
+		t.FailNow()
+	}
+}
+
+func TestSyncAuthorization(t *testing.T) {
+	userId := uint32(1293812414)
+	memberId := uint32(3718291512)
+	group, _ := database.CreateGroup(userId, "Sync group")
+	defer database.LeaveGroup(group.GroupId, userId)
+	stampGroupText := func(message string) packets.Text {
+		header, text := packets.CreateText(userId, rand.Uint32(), 0, message)
+		text.GroupId = group.GroupId
+		stamped, _ := apollon.StampText(header, text)
+		return stamped
+	}
+	stampGroupText("Before")
+	database.InviteToGroup(group.GroupId, userId, memberId)
+	database.JoinGroup(group.GroupId, memberId)
+	defer database.LeaveGroup(group.GroupId, memberId)
+	after := stampGroupText("After")
+
+	// Members only get the messages sent after they joined
+	member, reader, err := loginUser(memberId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer member.Close()
+	member.SetReadDeadline(time.Now().Add(2 * time.Second))
+	syncHeader, sync := packets.CreateSync(memberId, rand.Uint32(), 0, group.GroupId, 0)
+	sendPacket(member, syncHeader, sync)
+	_, payload, err := readPacket(reader)
+	text, _ := packets.DeseralizePacket[packets.Text](payload)
+	if err != nil || text.Sequence != after.Sequence {
+		log.Printf("Synced message from before the join: %+v", text)
+		t.FailNow()
+	}
+	if _, _, err := expectPacket(reader, packets.CAT_DATA, packets.D_SYNC); err != nil {
+		t.FailNow()
+	}
+
+	// The history of other users cannot be requested
+	owner, _, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer owner.Close()
+	syncHeader, sync = packets.CreateSync(userId, rand.Uint32(), memberId, 0, 0)
+	sendPacket(member, syncHeader, sync)
+	if err := expectClosed(reader); err != nil {
+		log.Printf("Sync for another user: %s", err)
+		t.FailNow()
+	}
+}
+
+func TestRenameOtherUser(t *testing.T) {
+	userId := uint32(1293812414)
+	victimId := uint32(3718291512)
+	previous, _ := database.GetUser(victimId)
+	// The spoofed user is online, otherwise the packet is dropped anyway
+	victim, _, err := loginUser(victimId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer victim.Close()
+	user, reader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	renameHeader, rename := packets.CreateRename(victimId, rand.Uint32(), "Taken Over")
+	sendPacket(user, renameHeader, rename)
+	if err := expectClosed(reader); err != nil {
+		log.Printf("Rename for another user: %s", err)
+		t.FailNow()
+	}
+	if renamed, _ := database.GetUser(victimId); renamed.Username != previous.Username {
+		log.Printf("User was renamed by another connection")
+		t.FailNow()
+	}
+}
+
+func TestPrivacyOfOtherUser(t *testing.T) {
+	userId := uint32(1293812414)
+	victimId := uint32(3718291512)
+	settings := database.GetPrivacySettings(victimId)
+	// The spoofed user is online, otherwise the packet is dropped anyway
+	victim, _, err := loginUser(victimId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer victim.Close()
+	user, reader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	privacyHeader, privacy := packets.CreatePrivacySettings(victimId, rand.Uint32(), []packets.Option{{Type: packets.PRIVACY_SEARCH, Value: packets.PRIVACY_NOBODY}, {Type: packets.PRIVACY_PRESENCE, Value: packets.PRIVACY_EVERYONE}})
+	sendPacket(user, privacyHeader, privacy)
+	if err := expectClosed(reader); err != nil {
+		log.Printf("Privacy settings for another user: %s", err)
+		t.FailNow()
+	}
+	changed := database.GetPrivacySettings(victimId)
+	for i := range settings {
+		if changed[i] != settings[i] {
+			log.Printf("Privacy settings were changed by another connection")
+			t.FailNow()
+		}
+	}
+}
+
+func TestRateLimitBeforeLogin(t *testing.T) {
+	victimId := uint32(3718291512)
+	apollon.SetRateLimit(packets.CAT_CONTACT, packets.CON_SEARCH, apollon.RateLimit{Rate: 0.01, Burst: 2})
+	defer apollon.SetRateLimit(packets.CAT_CONTACT, packets.CON_SEARCH, apollon.RateLimit{Rate: 2, Burst: 10})
+	header := packets.Header{Category: packets.CAT_CONTACT, Type: packets.CON_SEARCH, UserId: victimId}
+	// Packets before the login only use the bucket of the host
+	for i := 0; i < 5; i++ {
+		apollon.AllowPacket(header, 0, "192.0.2.1")
+	}
+	if !apollon.AllowPacket(header, victimId, "192.0.2.2") {
+		log.Printf("Bucket of the user was drained before the login")
+		t.FailNow()
+	}
+	apollon.AllowPacket(header, victimId, "192.0.2.3")
+	if apollon.AllowPacket(header, victimId, "192.0.2.4") {
+		log.Printf("Bucket of the user was not used after the login")
+		t.FailNow()
+	}
+}
+
+func TestLargeDownload(t *testing.T) {
+	userId := uint32(1293812414)
+	contactId := uint32(3718291512)
+	apollon.SetOutboundLimits(8, 0)
+	defer apollon.SetOutboundLimits(256, 0)
+
+	user, userReader, err := loginUser(userId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer user.Close()
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// Many more chunks than fit into the queue of the client
+	content := make([]byte, 8*1024*1024)
+	rand.Read(content)
+	hash := sha256.Sum256(content)
+	infoHeader, info := packets.CreateFileInfo(userId, rand.Uint32(), "large.bin", uint32(len(content)), 0, "None", 0)
+	info.ContactUserId = contactId
+	info.ContentHash = hex.EncodeToString(hash[:])
+	sendPacket(user, infoHeader, info)
+	if _, _, err := expectPacket(userReader, packets.CAT_DATA, packets.D_FILE_HAVE); err != nil {
+		t.FailNow()
+	}
+	for offset := 0; offset < len(content); offset += 2 * 1024 * 1024 {
+		chunkHeader, chunk := packets.CreateFileChunk(userId, infoHeader.MessageId, uint64(offset), content[offset:offset+2*1024*1024])
+		sendPacket(user, chunkHeader, chunk)
+	}
+	if _, _, err := expectPacket(userReader, packets.CAT_DATA, packets.D_FILE_ACK); err != nil {
+		t.FailNow()
+	}
+
+	// Small receive buffer, so that the chunks pile up in the queue
+	contact, reader, err := loginUser(contactId)
+	if err != nil {
+		t.FailNow()
+	}
+	defer contact.Close()
+	contact.(*net.TCPConn).SetReadBuffer(16 * 1024)
+	contact.SetReadDeadline(time.Now().Add(5 * time.Second))
+	requestHeader, request := packets.CreateFileRequest(contactId, rand.Uint32(), info.ContentHash, 0)
+	sendPacket(contact, requestHeader, request)
+	// Slow client, the server has to wait for it
+	time.Sleep(500 * time.Millisecond)
+	received := make([]byte, 0, len(content))
+	for len(received) < len(content) {
+		_, payload, err := expectPacket(reader, packets.CAT_DATA, packets.D_FILE)
+		if err != nil {
+			log.Printf("Download stopped after %d bytes: %s", len(received), err)
+			t.FailNow()
+		}
+		file, _ := packets.DeseralizePacket[packets.File](payload)
+		if file.FileOffset != uint64(len(received)) {
+			log.Printf("Chunk at offset %d, expected %d", file.FileOffset, len(received))
+			t.FailNow()
+		}
+		received = append(received, file.Data...)
+	}
+	if !bytes.Equal(received, content) {
+		log.Printf("Downloaded file differs")
+		t.FailNow()
+	}
+}
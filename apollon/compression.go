@@ -0,0 +1,65 @@
+package apollon
+
+import (
+	"log"
+	"net"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Wraps the connection of a client that negotiated a compression. Every packet
+// written to the connection is compressed before it is sent, so that the
+// forwarding and all other writers do not need to know about the compression.
+type CompressedConn struct {
+	net.Conn
+	Compression string
+}
+
+func (c *CompressedConn) Write(packet []byte) (int, error) {
+	compressed, err := packets.CompressPacket(packet, c.Compression)
+	if err != nil {
+		log.Printf("Failed to compress packet: %s", err)
+		return 0, err
+	}
+	_, err = c.Conn.Write(compressed)
+	if err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+// Answers the offered compression algorithms with the one chosen by the server.
+// The answer itself is sent uncompressed.
+func HandleNegotiate(header packets.Header, negotiate packets.Negotiate, connection net.Conn) (net.Conn, string) {
+	compression := packets.NegotiateCompression(negotiate.Compression)
+	log.Printf("Negotiated compression \"%s\" with %s", compression, connection.RemoteAddr().String())
+	answerHeader, answer := packets.CreateNegotiate(header.UserId, header.MessageId, []string{compression})
+	raw, err := packets.SerializePacket(answerHeader, answer)
+	if err != nil {
+		log.Printf("Failed to serialize negotiate answer")
+		return connection, packets.COMPRESSION_NONE
+	}
+	connection.Write(raw)
+	if compression == packets.COMPRESSION_NONE {
+		return connection, compression
+	}
+	// The answer is already queued and goes out uncompressed
+	if outbound, ok := connection.(*OutboundConn); ok {
+		outbound.SetCompression(compression)
+		return outbound, compression
+	}
+	return &CompressedConn{
+		Conn:        connection,
+		Compression: compression,
+	}, compression
+}
+
+func SendError(header packets.Header, code uint32, message string, connection net.Conn) {
+	errorHeader, errorPacket := packets.CreateError(header.UserId, header.MessageId, code, message)
+	raw, err := packets.SerializePacket(errorHeader, errorPacket)
+	if err != nil {
+		log.Printf("Failed to serialize error packet")
+		return
+	}
+	connection.Write(raw)
+}
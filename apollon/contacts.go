@@ -0,0 +1,205 @@
+package apollon
+
+import (
+	"log"
+	"math/rand"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Current presence of the contact as seen by the viewer. Contacts that hide
+// their presence from the viewer are always offline.
+func contactPresence(contactId uint32, viewerId uint32, onlineC chan OnlineMessage) packets.Presence {
+	presence := packets.Presence{
+		ContactUserId: contactId,
+	}
+	// Blocked users see the same as users the presence is hidden from
+	if !database.IsBlocked(contactId, viewerId) && database.PrivacyAllows(contactId, viewerId, packets.PRIVACY_PRESENCE) {
+		presence.Online = IsOnline(contactId, onlineC)
+		presence.LastSeen = database.GetPresence(contactId).LastSeen
+	}
+	return presence
+}
+
+func contactOf(contactId uint32) packets.Contact {
+	contact := packets.Contact{
+		UserId: contactId,
+	}
+	user, err := database.GetUser(contactId)
+	if err == nil {
+		contact.Username = user.Username
+	}
+	return contact
+}
+
+// Sends the contact list stored on the server together with the presence of
+// every contact. The server is the source of truth for the contacts of a user.
+func SendContactList(header packets.Header, connection net.Conn, onlineC chan OnlineMessage) {
+	contactIds := database.GetContacts(header.UserId)
+	contacts := make([]packets.Contact, 0, len(contactIds))
+	presence := make([]packets.Presence, 0, len(contactIds))
+	for _, v := range contactIds {
+		contacts = append(contacts, contactOf(v))
+		presence = append(presence, contactPresence(v, header.UserId, onlineC))
+	}
+	listHeader, list := packets.CreateContactList(header.UserId, header.MessageId, contacts)
+	list.Presence = presence
+	raw, err := packets.SerializePacket(listHeader, list)
+	if err != nil {
+		log.Printf("Failed to serialize contact list of %d", header.UserId)
+		return
+	}
+	connection.Write(raw)
+	log.Printf("Sent %d contacts to %d", len(contacts), header.UserId)
+}
+
+// Tells the user about the change of one of the contacts
+func PushContactUpdate(userId uint32, change string, contactId uint32, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	var presence packets.Presence
+	if change != packets.CONTACT_REMOVED {
+		presence = contactPresence(contactId, userId, onlineC)
+	}
+	updateHeader, update := packets.CreateContactUpdate(userId, rand.Uint32(), change, contactOf(contactId), presence)
+	ForwardOrStore(updateHeader, update, userId, onlineC, fwdC)
+}
+
+// Tells all contacts of the user that the username changed
+func NotifyContactRenamed(userId uint32, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	for _, v := range database.GetContacts(userId) {
+		PushContactUpdate(v, packets.CONTACT_RENAMED, userId, onlineC, fwdC)
+	}
+}
+
+// Forwards the profile of the user to all contacts stored on the server. The
+// contact IDs given by the client are only checked, pushing the profile to
+// users that are no contacts is rejected.
+func HandleContactInfo(header packets.Header, info packets.ContactInfo, connection net.Conn, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	for _, v := range info.ContactIds {
+		if !database.IsContact(header.UserId, v) {
+			log.Printf("User %d tried to push contact info to non contact %d", header.UserId, v)
+			SendError(header, packets.ERR_CONTACT, "not a contact", connection)
+			return
+		}
+	}
+
+	// Only images we encoded ourselves are stored and forwarded
+	if len(info.Image) > 0 {
+		image, format, err := NormalizeImage(info.Image)
+		if err != nil {
+			log.Printf("Invalid profile image of %d: %s", header.UserId, err)
+			SendError(header, packets.ERR_IMAGE, err.Error(), connection)
+			return
+		}
+		info.Image = image
+		info.ImageFormat = format
+		info.ImageBytes = uint32(len(image))
+	}
+
+	// Acknowledge that we received the packet
+	infoAck := packets.CreateContactInfoAck(header.UserId, header.MessageId)
+	rawInfoAck, err := packets.SerializePacket(infoAck, nil)
+	if err != nil {
+		log.Printf("Failed to serialize acknowledgement header!\n%s", err)
+		return
+	}
+	connection.Write(rawInfoAck)
+	_, err = database.SaveProfile(header.UserId, info)
+	if err != nil {
+		log.Printf("Failed to store profile of %d: %s", header.UserId, err)
+	}
+
+	forward, err := packets.ConvertContactInfoToClientContactInfo(info)
+	if err != nil {
+		log.Println("Failed to convert contact info")
+		return
+	}
+	withoutImage := forward
+	withoutImage.ImageBytes = 0
+	withoutImage.ImageFormat = ""
+	withoutImage.Image = nil
+	contacts := database.GetContacts(header.UserId)
+	for _, v := range contacts {
+		if !database.PrivacyAllows(header.UserId, v, packets.PRIVACY_IMAGE) {
+			ForwardOrStore(header, withoutImage, v, onlineC, fwdC)
+			continue
+		}
+		ForwardOrStore(header, forward, v, onlineC, fwdC)
+	}
+	log.Printf("Forwarded contact info of %d to %d contacts", header.UserId, len(contacts))
+}
+
+// Changes the username of the user and tells the contacts about the new name
+func HandleRename(header packets.Header, rename packets.Create, connection net.Conn, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	username, err := database.RenameUser(header.UserId, rename.Username)
+	if err != nil {
+		log.Printf("Failed to rename %d: %s", header.UserId, err)
+		SendError(header, packets.ERR_USERNAME, err.Error(), connection)
+		return
+	}
+	answerHeader, answer := packets.CreateRename(header.UserId, header.MessageId, username)
+	raw, err := packets.SerializePacket(answerHeader, answer)
+	if err != nil {
+		log.Printf("Failed to serialize rename answer")
+		return
+	}
+	connection.Write(raw)
+	NotifyContactRenamed(header.UserId, onlineC, fwdC)
+}
+
+// Stores the changed settings and answers with all settings of the user
+func HandlePrivacySettings(header packets.Header, privacy packets.PrivacySettings, connection net.Conn) {
+	err := database.SetPrivacySettings(header.UserId, privacy.Settings)
+	if err != nil {
+		SendError(header, packets.ERR_PRIVACY, err.Error(), connection)
+		return
+	}
+	answerHeader, answer := packets.CreatePrivacySettings(header.UserId, header.MessageId, database.GetPrivacySettings(header.UserId))
+	raw, err := packets.SerializePacket(answerHeader, answer)
+	if err != nil {
+		log.Printf("Failed to serialize privacy settings")
+		return
+	}
+	connection.Write(raw)
+}
+
+// Answers the stored profile of the requested user if it changed since the
+// version known to the client. The image is left out if the owner does not
+// show it to the requesting user or blocked the user, so that the block
+// cannot be told apart from the privacy setting.
+func HandleProfileRequest(header packets.Header, request packets.ProfileRequest, connection net.Conn) {
+	if !database.IdExists(request.ContactUserId) {
+		SendError(header, packets.ERR_CONTACT, "user not found", connection)
+		return
+	}
+	answer := packets.Profile{
+		ContactUserId: request.ContactUserId,
+	}
+	profile, err := database.GetProfile(request.ContactUserId)
+	if err != nil {
+		// Users that never sent a profile only have their username
+		profile.Username = contactOf(request.ContactUserId).Username
+	}
+	answer.Version = profile.Version
+	if request.Version == 0 || profile.Version > request.Version {
+		answer.Changed = true
+		answer.Username = profile.Username
+		if !database.IsBlocked(request.ContactUserId, header.UserId) && database.PrivacyAllows(request.ContactUserId, header.UserId, packets.PRIVACY_IMAGE) {
+			answer.ImageFormat = profile.ImageFormat
+			answer.Image = profile.Image
+		}
+	}
+	answerHeader := packets.Header{
+		Category:  packets.CAT_CONTACT,
+		Type:      packets.CON_PROFILE,
+		UserId:    header.UserId,
+		MessageId: header.MessageId,
+	}
+	raw, err := packets.SerializePacket(answerHeader, answer)
+	if err != nil {
+		log.Printf("Failed to serialize profile of %d", request.ContactUserId)
+		return
+	}
+	connection.Write(raw)
+}
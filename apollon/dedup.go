@@ -0,0 +1,32 @@
+package apollon
+
+import (
+	"log"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Checks whether the sender already sent the message, also on an earlier
+// connection, and answers duplicates with the original ack. Returns whether
+// the message is a duplicate and whether the ID was used for the same packet
+// type before.
+func HandleDuplicate(header packets.Header, connection net.Conn) (bool, bool) {
+	seen, exists := database.FindSeenMessage(header.UserId, header.MessageId)
+	if !exists {
+		return false, true
+	}
+	if seen.Category != header.Category || seen.Type != header.Type {
+		log.Printf("Message ID %d of %d was used for another packet", header.MessageId, header.UserId)
+		return true, false
+	}
+	log.Printf("Message %d of %d is a duplicate, sending the original ack", header.MessageId, header.UserId)
+	raw, err := packets.SerializePacket(seen.Ack.Header, seen.Ack.Payload)
+	if err != nil {
+		log.Printf("Failed to serialize stored ack")
+		return true, true
+	}
+	connection.Write(raw)
+	return true, true
+}
@@ -0,0 +1,213 @@
+package apollon
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Time the recipient has to confirm a forwarded text with a receipt before the
+// text is moved to the mailbox of the recipient
+var deliveryTimeout = 30 * time.Second
+
+// Text forwarded to a recipient that did not confirm it yet. The sender already
+// got the ack of the server, so the text must not get lost.
+type pendingDelivery struct {
+	packet     []byte
+	connection net.Conn
+	order      uint64
+	timer      *time.Timer
+}
+
+type deliveryKey struct {
+	recipient uint32
+	sender    uint32
+	messageId uint32
+}
+
+var pendingDeliveries = make(map[deliveryKey]*pendingDelivery)
+
+// Texts moved to the mailbox that the recipient did not take yet. A receipt
+// that arrives late removes the copy, otherwise the text is delivered twice.
+var storedTexts = make(map[deliveryKey]bool)
+var deliveryOrder uint64
+var deliveryLock sync.Mutex
+
+var deliveryMetrics = expvar.NewMap("deliveries")
+var confirmedDeliveries = new(expvar.Int)
+var storedDeliveries = new(expvar.Int)
+
+func init() {
+	deliveryMetrics.Set("pending", expvar.Func(func() any {
+		deliveryLock.Lock()
+		defer deliveryLock.Unlock()
+		return len(pendingDeliveries)
+	}))
+	deliveryMetrics.Set("confirmed", confirmedDeliveries)
+	deliveryMetrics.Set("stored", storedDeliveries)
+}
+
+func SetDeliveryTimeout(timeout time.Duration) {
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	if timeout > 0 {
+		deliveryTimeout = timeout
+	}
+}
+
+// Sends the packet to the recipient. Texts are tracked until the recipient
+// confirms them, all other packets are forwarded through the queue of the
+// connection.
+func deliver(recipient uint32, connection net.Conn, packet []byte) {
+	header := frameHeader(packet)
+	if header.Category != packets.CAT_DATA || header.Type != packets.D_TEXT {
+		if outbound, ok := connection.(*OutboundConn); ok {
+			outbound.Forward(packet)
+			return
+		}
+		connection.Write(packet)
+		return
+	}
+	key := deliveryKey{recipient: recipient, sender: header.UserId, messageId: header.MessageId}
+	pending := awaitDelivery(key, connection, packet)
+	_, err := connection.Write(packet)
+	if err != nil {
+		storeDelivery(key, pending)
+	}
+}
+
+func awaitDelivery(key deliveryKey, connection net.Conn, packet []byte) *pendingDelivery {
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	if existing, exists := pendingDeliveries[key]; exists {
+		existing.timer.Stop()
+	}
+	deliveryOrder++
+	pending := &pendingDelivery{
+		packet:     append([]byte{}, packet...),
+		connection: connection,
+		order:      deliveryOrder,
+	}
+	pending.timer = time.AfterFunc(deliveryTimeout, func() {
+		if storeDelivery(key, pending) {
+			log.Printf("Text %d of %d was not confirmed by %d in time", key.messageId, key.sender, key.recipient)
+		}
+	})
+	pendingDeliveries[key] = pending
+	return pending
+}
+
+// Stops tracking the text once the recipient sent a receipt for it. Returns
+// whether the text was still waiting for the receipt.
+func ConfirmDelivery(recipient uint32, sender uint32, messageId uint32) bool {
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	key := deliveryKey{recipient: recipient, sender: sender, messageId: messageId}
+	pending, exists := pendingDeliveries[key]
+	if !exists {
+		if storedTexts[key] {
+			delete(storedTexts, key)
+			database.RemoveMailboxText(recipient, sender, messageId)
+		}
+		return false
+	}
+	pending.timer.Stop()
+	delete(pendingDeliveries, key)
+	confirmedDeliveries.Add(1)
+	return true
+}
+
+// Applies an edit of the sender to a text that was sent but not confirmed yet,
+// so that the copy moved to the mailbox later on is the current one. A nil
+// edit drops the text. Returns whether the text was still waiting.
+func revisePendingDelivery(recipient uint32, sender uint32, messageId uint32, revised *packets.TextEdit) bool {
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	key := deliveryKey{recipient: recipient, sender: sender, messageId: messageId}
+	pending, exists := pendingDeliveries[key]
+	if !exists {
+		return false
+	}
+	if revised == nil {
+		pending.timer.Stop()
+		delete(pendingDeliveries, key)
+		return true
+	}
+	var text packets.Text
+	err := json.Unmarshal(bytes.TrimSuffix(pending.packet[10:], []byte("\n")), &text)
+	if err != nil {
+		log.Printf("Failed to decode pending text %d of %d", messageId, sender)
+		return true
+	}
+	text.Message = revised.Message
+	text.Ciphertext = revised.Ciphertext
+	text.Edited = revised.Timestamp
+	packet, err := packets.SerializePacket(frameHeader(pending.packet), text)
+	if err != nil {
+		log.Printf("Failed to serialize pending text %d of %d", messageId, sender)
+		return true
+	}
+	pending.packet = packet
+	return true
+}
+
+// Moves the text to the mailbox of the recipient if it is still unconfirmed.
+// Texts that were sent again in the meantime are left to the newer delivery.
+func storeDelivery(key deliveryKey, pending *pendingDelivery) bool {
+	deliveryLock.Lock()
+	current, exists := pendingDeliveries[key]
+	if !exists || current != pending {
+		deliveryLock.Unlock()
+		return false
+	}
+	pending.timer.Stop()
+	delete(pendingDeliveries, key)
+	storedTexts[key] = true
+	deliveryLock.Unlock()
+	storedDeliveries.Add(1)
+	StorePacket(key.recipient, pending.packet)
+	return true
+}
+
+// Forgets the stored texts of the recipient once the mailbox was taken, the
+// texts are tracked again when they are sent
+func takeStoredTexts(recipient uint32) {
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	for key := range storedTexts {
+		if key.recipient == recipient {
+			delete(storedTexts, key)
+		}
+	}
+}
+
+// Moves all unconfirmed texts sent over the connection to the mailbox of the
+// recipient, in the order they were sent
+func StorePendingDeliveries(connection net.Conn) {
+	type pendingEntry struct {
+		key     deliveryKey
+		pending *pendingDelivery
+	}
+	deliveryLock.Lock()
+	entries := make([]pendingEntry, 0)
+	for key, pending := range pendingDeliveries {
+		if pending.connection == connection {
+			entries = append(entries, pendingEntry{key: key, pending: pending})
+		}
+	}
+	deliveryLock.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].pending.order < entries[j].pending.order
+	})
+	for _, v := range entries {
+		storeDelivery(v.key, v.pending)
+	}
+}
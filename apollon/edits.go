@@ -0,0 +1,79 @@
+package apollon
+
+import (
+	"log"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Edits or deletes a text of the sender. Only texts the server accepted can be
+// changed and they reach the same recipients as the original text. Texts that
+// still wait in a mailbox are rewritten there, otherwise the change is
+// forwarded or stored like a text. Copies that wait for the receipt of the
+// recipient are rewritten as well.
+func HandleTextEdit(header packets.Header, edit packets.TextEdit, connection net.Conn, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	statuses, err := database.GetMessageStatus(header.UserId, edit.MessageId)
+	if err != nil || len(statuses) == 0 {
+		log.Printf("User %d cannot change unknown text %d", header.UserId, edit.MessageId)
+		SendError(header, packets.ERR_MESSAGE, "message not found", connection)
+		return
+	}
+	// The conversation is the one the text was sent to, not the one the
+	// client names
+	edit.GroupId = statuses[0].GroupId
+	key := database.ConversationKey(header.UserId, statuses[0].Recipient, edit.GroupId)
+	if edit.GroupId != 0 {
+		group, err := database.GetGroup(edit.GroupId)
+		if err != nil || !group.IsMember(header.UserId) {
+			log.Printf("User %d cannot change texts in group %d", header.UserId, edit.GroupId)
+			SendError(header, packets.ERR_GROUP, "not a member", connection)
+			return
+		}
+	}
+	deleted := header.Type == packets.D_TEXT_DELETE
+	if deleted {
+		edit.Message = ""
+		edit.Ciphertext = nil
+		database.RemoveMessage(header.UserId, edit.MessageId)
+		database.RemoveFromHistory(key, header.UserId, edit.MessageId)
+	}
+	edit, err = StampTextEdit(header, key, edit)
+	if err != nil {
+		log.Printf("Failed to store change of text %d in history: %s", edit.MessageId, err)
+	}
+
+	ackHeader, ack := packets.CreateTextAck(header.UserId, header.MessageId, edit.ContactUserId)
+	ack.Sequence = edit.Sequence
+	ack.Timestamp = edit.ServerTimestamp
+	raw, err := packets.SerializePacket(ackHeader, ack)
+	if err != nil {
+		log.Println("Failed to create ack packet")
+		return
+	}
+	connection.Write(raw)
+	database.RememberMessage(header, ackHeader, ack)
+
+	for _, v := range statuses {
+		// Every recipient gets its own copy addressed to it
+		recipientEdit := edit
+		recipientEdit.ContactUserId = v.Recipient
+		revised := &recipientEdit
+		if deleted {
+			revised = nil
+		}
+		// A text the recipient did not confirm yet would otherwise be moved to
+		// the mailbox unchanged
+		revisePendingDelivery(v.Recipient, header.UserId, edit.MessageId, revised)
+		found, err := database.ReviseMailboxText(v.Recipient, header.UserId, edit.MessageId, revised)
+		if err != nil {
+			log.Printf("Failed to revise mailbox of %d: %s", v.Recipient, err)
+		}
+		if found {
+			continue
+		}
+		ForwardOrStore(header, recipientEdit, v.Recipient, onlineC, fwdC)
+	}
+	log.Printf("Changed text %d of %d for %d recipients, deleted: %t", edit.MessageId, header.UserId, len(statuses), deleted)
+}
@@ -0,0 +1,155 @@
+package apollon
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Size of the file chunks the server sends out to downloading clients
+var FILE_CHUNK_SIZE int = 32 * 1024
+
+type FileUpload struct {
+	Header packets.Header
+	Info   packets.FileInfo
+}
+
+func transferLength(fileInfo packets.FileInfo) uint64 {
+	if fileInfo.CompressedLength > 0 {
+		return uint64(fileInfo.CompressedLength)
+	}
+	return uint64(fileInfo.FileLength)
+}
+
+// Checks if the announced file is already stored on the server. In this case
+// the sender can skip the upload and the file info is forwarded immediately.
+// Otherwise the offset at which the upload should start is sent back.
+// Returns true if the file is complete and the file info can be forwarded.
+func HandleFileInfo(header packets.Header, fileInfo packets.FileInfo, connection net.Conn) bool {
+	length := transferLength(fileInfo)
+	offset := uint64(0)
+	complete := false
+	if database.FileExists(fileInfo.ContentHash) {
+		log.Printf("File %s already stored, skipping upload", fileInfo.ContentHash)
+		// Blocked senders cannot keep files stored for the recipient, the file
+		// info is dropped like their texts
+		var err error
+		if !database.IsBlocked(fileInfo.ContactUserId, header.UserId) {
+			err = database.AddFileReference(fileInfo.ContentHash, fileInfo.ContactUserId)
+		}
+		if err == nil {
+			offset = length
+			complete = true
+		}
+	} else {
+		offset = database.UploadedLength(fileInfo.ContentHash)
+		if offset > length {
+			database.DiscardUpload(fileInfo.ContentHash)
+			offset = 0
+		}
+	}
+	haveHeader, have := packets.CreateFileHave(header.UserId, header.MessageId, offset)
+	raw, err := packets.SerializePacket(haveHeader, have)
+	if err != nil {
+		log.Printf("Failed to serialize file have packet")
+		return complete
+	}
+	connection.Write(raw)
+	return complete
+}
+
+// Stores the next chunk of an upload. Returns true if the upload is complete
+// and stored. If the chunk does not fit the current state of the upload the
+// client is told the offset to continue from.
+func HandleFileChunk(header packets.Header, fileInfo packets.FileInfo, file packets.File, connection net.Conn) bool {
+	length := transferLength(fileInfo)
+	received, err := database.WriteFileChunk(fileInfo.ContentHash, file.FileOffset, file.Data)
+	if err == nil && received > length {
+		log.Printf("Upload of %s longer than announced", fileInfo.ContentHash)
+		database.DiscardUpload(fileInfo.ContentHash)
+		received = 0
+		err = errors.New("upload too long")
+	}
+	if err == nil && received < length {
+		return false
+	}
+	if err == nil {
+		recipient := fileInfo.ContactUserId
+		if database.IsBlocked(recipient, header.UserId) {
+			recipient = 0
+		}
+		err = database.CommitFile(fileInfo.ContentHash, length, recipient)
+		if err == nil {
+			ack := packets.CreateFileAck(header.UserId, header.MessageId)
+			raw, err := packets.SerializePacket(ack, nil)
+			if err != nil {
+				log.Printf("Failed to serialize file ack")
+				return true
+			}
+			connection.Write(raw)
+			return true
+		}
+		received = database.UploadedLength(fileInfo.ContentHash)
+	}
+	log.Printf("Failed to store chunk of %s: %s", fileInfo.ContentHash, err)
+	haveHeader, have := packets.CreateFileHave(header.UserId, header.MessageId, received)
+	raw, err := packets.SerializePacket(haveHeader, have)
+	if err != nil {
+		log.Printf("Failed to serialize file have packet")
+		return false
+	}
+	connection.Write(raw)
+	return false
+}
+
+// Sends the requested file starting at the requested offset in chunks back
+// to a client that holds a reference onto the file
+func HandleFileRequest(header packets.Header, request packets.FileRequest, connection net.Conn) bool {
+	if !database.HasFileReference(request.ContentHash, header.UserId) {
+		log.Printf("User %d requested file %s without reference", header.UserId, request.ContentHash)
+		return false
+	}
+	stored, err := database.GetStoredFile(request.ContentHash)
+	if err != nil {
+		return false
+	}
+	offset := request.FileOffset
+	for offset < stored.Length {
+		data, err := database.ReadFileChunk(request.ContentHash, offset, FILE_CHUNK_SIZE)
+		if err != nil || len(data) == 0 {
+			log.Printf("Failed to read file %s at offset %d", request.ContentHash, offset)
+			return false
+		}
+		chunkHeader, chunk := packets.CreateFileChunk(header.UserId, header.MessageId, offset, data)
+		raw, err := packets.SerializePacket(chunkHeader, chunk)
+		if err != nil {
+			log.Printf("Failed to serialize file chunk")
+			return false
+		}
+		_, err = writeBulk(connection, raw)
+		if err != nil {
+			log.Printf("Failed to send file chunk to %d", header.UserId)
+			return false
+		}
+		offset += uint64(len(data))
+	}
+	return true
+}
+
+// Writes the packet of a large transfer, connections with a queue wait until
+// the client took the previous packets
+func writeBulk(connection net.Conn, packet []byte) (int, error) {
+	if outbound, ok := connection.(*OutboundConn); ok {
+		return outbound.WriteBulk(packet)
+	}
+	return connection.Write(packet)
+}
+
+// Forwards the file info once the file is complete. Recipients that are
+// offline find it in their mailbox.
+func ForwardFileInfo(header packets.Header, fileInfo packets.FileInfo, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	ForwardOrStore(header, fileInfo, fileInfo.ContactUserId, onlineC, fwdC)
+}
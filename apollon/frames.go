@@ -0,0 +1,123 @@
+package apollon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Maximal size of a frame in bytes including the header and the newline.
+// Packet types without their own limit use the default limit.
+var defaultFrameLimit = 64 * 1024
+var frameLimits = map[uint16]int{
+	packetKey(packets.CAT_CONTACT, packets.CON_SEARCH):       1024,
+	packetKey(packets.CAT_CONTACT, packets.CON_CREATE):       4 * 1024,
+	packetKey(packets.CAT_CONTACT, packets.CON_LOGIN):        1024,
+	packetKey(packets.CAT_CONTACT, packets.CON_CONTACT_INFO): 16 * 1024 * 1024,
+	packetKey(packets.CAT_DATA, packets.D_TEXT):              256 * 1024,
+	packetKey(packets.CAT_DATA, packets.D_TEXT_EDIT):         256 * 1024,
+	packetKey(packets.CAT_DATA, packets.D_FILE):              4 * 1024 * 1024,
+}
+var frameLock sync.Mutex
+
+func init() {
+	packets.MAX_DECOMPRESSED_SIZE = largestFrameLimit()
+}
+
+func SetDefaultFrameLimit(size int) {
+	frameLock.Lock()
+	defer frameLock.Unlock()
+	defaultFrameLimit = size
+	packets.MAX_DECOMPRESSED_SIZE = largestFrameLimit()
+}
+
+// Sets the maximal frame size of the packet type, zero falls back to the
+// default limit
+func SetFrameLimit(category byte, pType byte, size int) {
+	frameLock.Lock()
+	defer frameLock.Unlock()
+	if size <= 0 {
+		delete(frameLimits, packetKey(category, pType))
+	} else {
+		frameLimits[packetKey(category, pType)] = size
+	}
+	packets.MAX_DECOMPRESSED_SIZE = largestFrameLimit()
+}
+
+// Parses limits of the form "category.type=size" separated by commas
+func SetFrameLimits(limits string) error {
+	for _, v := range strings.Split(limits, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		packet, size, found := strings.Cut(v, "=")
+		category, pType, foundType := strings.Cut(packet, ".")
+		if !found || !foundType {
+			return errors.New("invalid frame limit " + v)
+		}
+		categoryValue, errCategory := strconv.ParseUint(category, 10, 8)
+		typeValue, errType := strconv.ParseUint(pType, 10, 8)
+		sizeValue, errSize := strconv.Atoi(size)
+		if errCategory != nil || errType != nil || errSize != nil {
+			return errors.New("invalid frame limit " + v)
+		}
+		SetFrameLimit(byte(categoryValue), byte(typeValue), sizeValue)
+	}
+	return nil
+}
+
+func FrameLimit(category byte, pType byte) int {
+	frameLock.Lock()
+	defer frameLock.Unlock()
+	size, exists := frameLimits[packetKey(category, pType)]
+	if !exists {
+		return defaultFrameLimit
+	}
+	return size
+}
+
+// Limit for a frame of which only the beginning was read. As soon as the
+// category and the type arrived the limit of the packet type applies.
+func frameLimitFor(frame []byte) int {
+	if len(frame) < 2 {
+		frameLock.Lock()
+		defer frameLock.Unlock()
+		return largestFrameLimit()
+	}
+	return FrameLimit(frame[0], frame[1])
+}
+
+func largestFrameLimit() int {
+	largest := defaultFrameLimit
+	for _, v := range frameLimits {
+		if v > largest {
+			largest = v
+		}
+	}
+	return largest
+}
+
+// Header of a frame that may be incomplete, used to answer oversized frames
+func frameHeader(frame []byte) packets.Header {
+	var header packets.Header
+	if len(frame) >= 10 {
+		binary.Read(bytes.NewReader(frame[:10]), binary.BigEndian, &header)
+	}
+	return header
+}
+
+// Answers a frame that exceeds the limit of its packet type. The rest of the
+// frame is not read, the client has to be disconnected afterwards.
+func RejectFrame(frame []byte, connection net.Conn) {
+	header := frameHeader(frame)
+	log.Printf("Rejecting frame of type %d.%d from %s, more than %d bytes", header.Category, header.Type, connection.RemoteAddr(), frameLimitFor(frame))
+	SendError(header, packets.ERR_FRAME_SIZE, "frame too large", connection)
+}
@@ -0,0 +1,99 @@
+package apollon
+
+import (
+	"log"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func groupInfo(userId uint32, messageId uint32, group database.Group) (packets.Header, packets.GroupInfo) {
+	return packets.CreateGroupInfo(userId, messageId, group.GroupId, group.Name, group.Owner, group.Admins, group.Members)
+}
+
+func writeGroupInfo(header packets.Header, group database.Group, connection net.Conn) {
+	infoHeader, info := groupInfo(header.UserId, header.MessageId, group)
+	raw, err := packets.SerializePacket(infoHeader, info)
+	if err != nil {
+		log.Printf("Failed to serialize group info")
+		return
+	}
+	connection.Write(raw)
+}
+
+// Sends the current state of the group to all members except the user that
+// caused the change, this one already got the answer
+func notifyGroupMembers(header packets.Header, group database.Group, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	infoHeader, info := groupInfo(header.UserId, header.MessageId, group)
+	for _, member := range group.Members {
+		if member == header.UserId {
+			continue
+		}
+		ForwardOrStore(infoHeader, info, member, onlineC, fwdC)
+	}
+}
+
+func HandleGroupPacket(header packets.Header, action packets.GroupAction, connection net.Conn, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	var group database.Group
+	var err error
+	switch header.Type {
+	case packets.CON_GROUP_CREATE:
+		group, err = database.CreateGroup(header.UserId, action.Name)
+	case packets.CON_GROUP_INVITE:
+		if !database.IdExists(action.UserId) {
+			log.Printf("Cannot invite unknown user %d into group %d", action.UserId, action.GroupId)
+			SendError(header, packets.ERR_GROUP, "user not found", connection)
+			return
+		}
+		group, err = database.InviteToGroup(action.GroupId, header.UserId, action.UserId)
+		if err == nil {
+			inviteHeader, invite := packets.CreateGroupAction(header.UserId, header.MessageId, packets.CON_GROUP_INVITE, group.GroupId, header.UserId, group.Name)
+			ForwardOrStore(inviteHeader, invite, action.UserId, onlineC, fwdC)
+		}
+	case packets.CON_GROUP_JOIN:
+		group, err = database.JoinGroup(action.GroupId, header.UserId)
+	case packets.CON_GROUP_LEAVE:
+		group, err = database.LeaveGroup(action.GroupId, header.UserId)
+	case packets.CON_GROUP_KICK:
+		group, err = database.KickFromGroup(action.GroupId, header.UserId, action.UserId)
+		if err == nil {
+			kickHeader, kick := packets.CreateGroupAction(header.UserId, header.MessageId, packets.CON_GROUP_KICK, group.GroupId, action.UserId, group.Name)
+			ForwardOrStore(kickHeader, kick, action.UserId, onlineC, fwdC)
+		}
+	case packets.CON_GROUP_RENAME:
+		group, err = database.RenameGroup(action.GroupId, header.UserId, action.Name)
+	case packets.CON_GROUP_ADMIN:
+		group, err = database.SetGroupAdmin(action.GroupId, header.UserId, action.UserId)
+	case packets.CON_GROUP_INFO:
+		group, err = database.GetGroup(action.GroupId)
+		if err == nil && !group.IsMember(header.UserId) {
+			SendError(header, packets.ERR_GROUP, "not a member", connection)
+			return
+		}
+		if err == nil {
+			writeGroupInfo(header, group, connection)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Group action %d of %d failed: %s", header.Type, header.UserId, err)
+		SendError(header, packets.ERR_GROUP, err.Error(), connection)
+		return
+	}
+	writeGroupInfo(header, group, connection)
+	notifyGroupMembers(header, group, onlineC, fwdC)
+}
+
+// Sends the text to every member of the group, offline members receive it
+// once they are back online
+func ForwardGroupText(header packets.Header, text packets.Text, group database.Group, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	for _, member := range group.Members {
+		if member == header.UserId {
+			continue
+		}
+		text.ContactUserId = member
+		ForwardOrStore(header, text, member, onlineC, fwdC)
+	}
+	log.Printf("Forwarded text of %d to %d members of group %d", header.UserId, len(group.Members)-1, group.GroupId)
+}
@@ -0,0 +1,114 @@
+package apollon
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Images larger than this are rejected before decoding them
+const MAX_IMAGE_INPUT_DIMENSION = 4096
+
+// Profile images are downscaled so that neither side exceeds this length
+var maxImageDimension = 512
+
+func SetMaxImageDimension(dimension int) {
+	maxImageDimension = dimension
+}
+
+// Decodes the profile image, downscales it to the maximal dimension and encodes
+// it again. The encoders do not write any metadata, so EXIF and other
+// information of the original image is removed. Returns the normalized image
+// together with its format.
+func NormalizeImage(data []byte) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed to detect image format: %s", err)
+		return nil, "", errors.New("unknown image format")
+	}
+	if format != packets.IMAGE_JPEG && format != packets.IMAGE_PNG && format != packets.IMAGE_GIF {
+		log.Printf("Image format \"%s\" not supported", format)
+		return nil, "", errors.New("unsupported image format")
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > MAX_IMAGE_INPUT_DIMENSION || config.Height > MAX_IMAGE_INPUT_DIMENSION {
+		log.Printf("Rejecting image with %dx%d pixels", config.Width, config.Height)
+		return nil, "", errors.New("image too large")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed to decode image: %s", err)
+		return nil, "", err
+	}
+	img = downscaleImage(img, maxImageDimension)
+
+	var buffer bytes.Buffer
+	if format == packets.IMAGE_JPEG {
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 90})
+	} else {
+		// GIFs are stored as their first frame
+		format = packets.IMAGE_PNG
+		err = png.Encode(&buffer, img)
+	}
+	if err != nil {
+		log.Printf("Failed to encode image: %s", err)
+		return nil, "", err
+	}
+	return buffer.Bytes(), format, nil
+}
+
+// Scales the image down by averaging all source pixels that fall onto one
+// pixel of the result. Images that already fit are returned unchanged.
+func downscaleImage(img image.Image, dimension int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if dimension <= 0 || (width <= dimension && height <= dimension) {
+		return img
+	}
+	newWidth, newHeight := dimension, dimension
+	if width > height {
+		newHeight = height * dimension / width
+	} else {
+		newWidth = width * dimension / height
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	log.Printf("Downscaling image from %dx%d to %dx%d", width, height, newWidth, newHeight)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		startY := bounds.Min.Y + y*height/newHeight
+		endY := bounds.Min.Y + (y+1)*height/newHeight
+		for x := 0; x < newWidth; x++ {
+			startX := bounds.Min.X + x*width/newWidth
+			endX := bounds.Min.X + (x+1)*width/newWidth
+			var r, g, b, a, count uint64
+			for sy := startY; sy < endY; sy++ {
+				for sx := startX; sx < endX; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					count++
+				}
+			}
+			scaled.Set(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+	return scaled
+}
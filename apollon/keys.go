@@ -0,0 +1,85 @@
+package apollon
+
+import (
+	"log"
+	"math/rand"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Stores the uploaded keys and answers with the number of stored prekeys. If
+// the identity key changed, the contacts are told so that they can verify the
+// new key before sending further texts.
+func HandleKeyUpload(header packets.Header, upload packets.KeyUpload, connection net.Conn, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	changed, preKeys, err := database.StoreKeys(header.UserId, upload)
+	if err != nil {
+		log.Printf("Rejected keys of %d: %s", header.UserId, err)
+		SendError(header, packets.ERR_KEYS, err.Error(), connection)
+		return
+	}
+	raw, err := packets.SerializePacket(header, packets.KeyStatus{PreKeys: uint32(preKeys)})
+	if err != nil {
+		log.Printf("Failed to serialize key status")
+		return
+	}
+	connection.Write(raw)
+	if !changed {
+		return
+	}
+
+	changeHeader := packets.Header{
+		Category:  packets.CAT_CONTACT,
+		Type:      packets.CON_KEY_CHANGE,
+		UserId:    header.UserId,
+		MessageId: rand.Uint32(),
+	}
+	change := packets.KeyBundle{
+		ContactUserId: header.UserId,
+		IdentityKey:   upload.IdentityKey,
+	}
+	for _, v := range database.GetContacts(header.UserId) {
+		ForwardOrStore(changeHeader, change, v, onlineC, fwdC)
+	}
+}
+
+// Answers the keys of the requested user. Only users that may send texts to
+// the owner of the keys get a bundle, as every bundle uses up a prekey.
+// Blocked users get the same answer as if no keys were published, so that
+// the block is not revealed.
+func HandleKeyBundleRequest(header packets.Header, request packets.KeyBundle, connection net.Conn) {
+	owner := request.ContactUserId
+	if database.IsBlocked(owner, header.UserId) {
+		log.Printf("User %d is blocked by %d, not answering keys", header.UserId, owner)
+		SendError(header, packets.ERR_KEYS, "no keys published", connection)
+		return
+	}
+	if !database.PrivacyAllows(owner, header.UserId, packets.PRIVACY_MESSAGES) {
+		log.Printf("User %d is not allowed to fetch the keys of %d", header.UserId, owner)
+		SendError(header, packets.ERR_PRIVACY, "not allowed", connection)
+		return
+	}
+	record, err := database.TakeKeyBundle(owner, header.UserId)
+	if err != nil {
+		SendError(header, packets.ERR_KEYS, err.Error(), connection)
+		return
+	}
+	bundle := packets.KeyBundle{
+		ContactUserId:     owner,
+		IdentityKey:       record.IdentityKey,
+		ExchangeKey:       record.ExchangeKey,
+		ExchangeSignature: record.ExchangeSignature,
+	}
+	if len(record.PreKeys) > 0 {
+		bundle.PreKey = record.PreKeys[0]
+	} else {
+		log.Printf("No prekeys of %d left", owner)
+	}
+	raw, err := packets.SerializePacket(header, bundle)
+	if err != nil {
+		log.Printf("Failed to serialize key bundle")
+		return
+	}
+	connection.Write(raw)
+}
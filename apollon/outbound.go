@@ -0,0 +1,254 @@
+package apollon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Number of packets that can wait for a client and the time the client has to
+// take a single packet. Clients exceeding either limit are disconnected. The
+// writers of open connections read the limits while they can be changed.
+var outboundQueueSize atomic.Int64
+var writeTimeout atomic.Int64
+
+func init() {
+	outboundQueueSize.Store(256)
+	writeTimeout.Store(int64(10 * time.Second))
+}
+
+var errQueueFull = errors.New("outbound queue full")
+var errBulkWait = errors.New("bulk share of the queue used")
+
+// Zero keeps the current limit, the limits apply to new connections
+func SetOutboundLimits(queueSize int, timeout time.Duration) {
+	if queueSize > 0 {
+		outboundQueueSize.Store(int64(queueSize))
+	}
+	if timeout > 0 {
+		writeTimeout.Store(int64(timeout))
+	}
+}
+
+type outboundPacket struct {
+	packet      []byte
+	compression string
+	// Forwarded packets are moved to the mailbox if they cannot be sent
+	store bool
+}
+
+// Connection of a client with its own queue of outgoing packets. A writer
+// goroutine drains the queue, so that writing never blocks the forwarding or
+// the handling of other clients. The queue holds the uncompressed packets,
+// they are compressed with the compression that was negotiated when they
+// were queued.
+type OutboundConn struct {
+	net.Conn
+	queue chan outboundPacket
+	// Signaled by the writer whenever it took a packet from the queue
+	drained     chan struct{}
+	lock        sync.Mutex
+	userId      uint32
+	compression string
+	closed      bool
+	closedAt    time.Time
+	failed      bool
+}
+
+func NewOutboundConn(conn net.Conn) *OutboundConn {
+	outbound := &OutboundConn{
+		Conn:        conn,
+		queue:       make(chan outboundPacket, outboundQueueSize.Load()),
+		drained:     make(chan struct{}, 1),
+		compression: packets.COMPRESSION_NONE,
+	}
+	go outbound.writePackets()
+	return outbound
+}
+
+// Sets the user the packets are for, undeliverable forwarded packets are
+// stored in the mailbox of the user
+func (c *OutboundConn) SetUser(userId uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.userId = userId
+}
+
+// Packets queued from now on are compressed
+func (c *OutboundConn) SetCompression(compression string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.compression = compression
+}
+
+func (c *OutboundConn) Write(packet []byte) (int, error) {
+	err := c.enqueue(packet, false, false)
+	if err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+// Queues a packet of a large transfer such as a file download. Bulk packets
+// use at most half of the queue and the call waits until the writer made room,
+// so that the transfer goes at the pace of the client and other packets still
+// fit into the queue.
+func (c *OutboundConn) WriteBulk(packet []byte) (int, error) {
+	for {
+		err := c.enqueue(packet, false, true)
+		if err == nil {
+			return len(packet), nil
+		}
+		if err != errBulkWait {
+			return 0, err
+		}
+		// A client that takes nothing is disconnected by the write timeout,
+		// the next attempt fails then
+		select {
+		case <-c.drained:
+		case <-time.After(time.Duration(writeTimeout.Load())):
+		}
+	}
+}
+
+// Queues a packet forwarded from another user. If the client cannot take it,
+// the packet is stored in the mailbox instead.
+func (c *OutboundConn) Forward(packet []byte) error {
+	err := c.enqueue(packet, true, false)
+	if err != nil {
+		c.store(packet)
+	}
+	return err
+}
+
+// Stops taking new packets. The queued packets are still sent before the
+// connection is closed.
+func (c *OutboundConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeQueue()
+	return nil
+}
+
+func (c *OutboundConn) enqueue(packet []byte, store bool, bulk bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if bulk && len(c.queue) >= bulkLimit(cap(c.queue)) {
+		return errBulkWait
+	}
+	item := outboundPacket{packet: append([]byte{}, packet...), compression: c.compression, store: store}
+	select {
+	case c.queue <- item:
+		return nil
+	default:
+		log.Printf("Outbound queue of %d is full, disconnecting", c.userId)
+		c.fail()
+		return errQueueFull
+	}
+}
+
+func bulkLimit(queueSize int) int {
+	if queueSize < 2 {
+		return 1
+	}
+	return queueSize / 2
+}
+
+func (c *OutboundConn) closeQueue() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	close(c.queue)
+}
+
+// Closes the connection right away, the queued packets are not sent anymore.
+// The lock has to be held.
+func (c *OutboundConn) fail() {
+	if c.failed {
+		return
+	}
+	c.failed = true
+	c.closeQueue()
+	c.Conn.Close()
+}
+
+func (c *OutboundConn) writePackets() {
+	for item := range c.queue {
+		select {
+		case c.drained <- struct{}{}:
+		default:
+		}
+		c.lock.Lock()
+		failed := c.failed
+		userId := c.userId
+		timeout := time.Duration(writeTimeout.Load())
+		deadline := time.Now().Add(timeout)
+		if c.closed && c.closedAt.Add(timeout).Before(deadline) {
+			deadline = c.closedAt.Add(timeout)
+		}
+		c.lock.Unlock()
+		if failed {
+			if item.store {
+				c.store(item.packet)
+			}
+			continue
+		}
+		raw, err := packets.CompressPacket(item.packet, item.compression)
+		if err == nil {
+			c.Conn.SetWriteDeadline(deadline)
+			_, err = c.Conn.Write(raw)
+		}
+		if err != nil {
+			log.Printf("Failed to write to %d: %s", userId, err)
+			c.lock.Lock()
+			c.fail()
+			c.lock.Unlock()
+			if item.store {
+				c.store(item.packet)
+			}
+		}
+	}
+	c.Conn.Close()
+	// Texts the client did not confirm before the connection ended go to the
+	// mailbox
+	StorePendingDeliveries(c)
+}
+
+func (c *OutboundConn) store(packet []byte) {
+	c.lock.Lock()
+	userId := c.userId
+	c.lock.Unlock()
+	StorePacket(userId, packet)
+}
+
+// Stores a serialized packet in the mailbox of the user
+func StorePacket(userId uint32, packet []byte) {
+	if userId == 0 || len(packet) < 11 || database.IsDeleted(userId) {
+		return
+	}
+	var header packets.Header
+	err := binary.Read(bytes.NewReader(packet[:10]), binary.BigEndian, &header)
+	if err != nil {
+		return
+	}
+	var payload json.RawMessage
+	if content := bytes.TrimSuffix(packet[10:], []byte("\n")); len(content) > 0 {
+		payload = content
+	}
+	log.Printf("Moving packet %d for %d to the mailbox", header.MessageId, userId)
+	database.AppendToMailbox(userId, database.MailboxEntry{Header: header, Payload: payload})
+}
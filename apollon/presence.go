@@ -0,0 +1,73 @@
+package apollon
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Asks the online registry whether the given user is connected
+func IsOnline(userId uint32, onlineC chan OnlineMessage) bool {
+	reply := make(chan OnlineMessage, 1)
+	onlineC <- OnlineMessage{
+		Id:    userId,
+		Reply: reply,
+	}
+	return (<-reply).Online
+}
+
+// Tells all connected contacts of the user that the user came online or went
+// offline. Called by the online registry with the lock of the map held.
+func NotifyPresence(userId uint32, online bool, connMap map[uint32]net.Conn) {
+	var lastSeen uint64
+	if !online {
+		lastSeen = uint64(time.Now().UnixMilli())
+		database.SetLastSeen(userId, lastSeen)
+	}
+	header, presence := packets.CreatePresence(userId, rand.Uint32(), userId, online, lastSeen)
+	raw, err := packets.SerializePacket(header, presence)
+	if err != nil {
+		log.Printf("Failed to serialize presence of %d", userId)
+		return
+	}
+	for _, contact := range database.GetContacts(userId) {
+		con, ex := connMap[contact]
+		if !ex || database.IsBlocked(userId, contact) || !database.PrivacyAllows(userId, contact, packets.PRIVACY_PRESENCE) {
+			continue
+		}
+		con.Write(raw)
+	}
+}
+
+// Answers the presence of the requested contacts. IDs that are no contacts
+// of the user are left out unless they show their presence to everyone,
+// hidden contacts are always shown as offline.
+func HandlePresenceRequest(header packets.Header, request packets.PresenceList, connection net.Conn, onlineC chan OnlineMessage) {
+	answer := packets.PresenceList{
+		ContactIds: request.ContactIds,
+		Presence:   make([]packets.Presence, 0, len(request.ContactIds)),
+	}
+	for _, contact := range request.ContactIds {
+		if !database.IsContact(header.UserId, contact) && database.GetPrivacySetting(contact, packets.PRIVACY_PRESENCE) != packets.PRIVACY_EVERYONE {
+			log.Printf("User %d requested presence of non contact %d", header.UserId, contact)
+			continue
+		}
+		answer.Presence = append(answer.Presence, contactPresence(contact, header.UserId, onlineC))
+	}
+	answerHeader := packets.Header{
+		Category:  packets.CAT_CONTACT,
+		Type:      packets.CON_PRESENCE_REQ,
+		UserId:    header.UserId,
+		MessageId: header.MessageId,
+	}
+	raw, err := packets.SerializePacket(answerHeader, answer)
+	if err != nil {
+		log.Printf("Failed to serialize presence answer")
+		return
+	}
+	connection.Write(raw)
+}
@@ -0,0 +1,188 @@
+package apollon
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Number of throttled packets within the period after which the client is
+// disconnected
+const MAX_THROTTLED = 20
+const THROTTLE_PERIOD = time.Minute
+
+// Buckets that are full are removed once there are more buckets than this
+const maxBuckets = 10000
+
+// Packets per second and the number of packets that can be sent at once. The
+// same limit applies to every user and to every remote address.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	packet uint16
+	tokens float64
+	last   time.Time
+}
+
+var rateLimits = defaultRateLimits()
+var buckets = make(map[string]*tokenBucket)
+var rateLock sync.Mutex
+
+var rateMetrics = expvar.NewMap("ratelimit")
+var throttledPackets = new(expvar.Map).Init()
+var throttleDisconnects = new(expvar.Int)
+
+func init() {
+	rateMetrics.Set("limits", expvar.Func(func() any {
+		rateLock.Lock()
+		defer rateLock.Unlock()
+		limits := make(map[string]RateLimit)
+		for packet, limit := range rateLimits {
+			limits[packetName(packet)] = limit
+		}
+		return limits
+	}))
+	rateMetrics.Set("buckets", expvar.Func(func() any {
+		rateLock.Lock()
+		defer rateLock.Unlock()
+		return len(buckets)
+	}))
+	rateMetrics.Set("throttled", throttledPackets)
+	rateMetrics.Set("disconnects", throttleDisconnects)
+}
+
+func defaultRateLimits() map[uint16]RateLimit {
+	return map[uint16]RateLimit{
+		packetKey(packets.CAT_CONTACT, packets.CON_CREATE): {Rate: 0.1, Burst: 5},
+		packetKey(packets.CAT_CONTACT, packets.CON_SEARCH): {Rate: 2, Burst: 10},
+		// Every key bundle uses up a prekey of the requested user
+		packetKey(packets.CAT_CONTACT, packets.CON_KEY_BUNDLE): {Rate: 0.2, Burst: 10},
+		packetKey(packets.CAT_DATA, packets.D_TEXT):            {Rate: 10, Burst: 50},
+	}
+}
+
+func packetKey(category byte, pType byte) uint16 {
+	return uint16(category)<<8 | uint16(pType)
+}
+
+func packetName(packet uint16) string {
+	return fmt.Sprintf("%d.%d", packet>>8, packet&0xff)
+}
+
+// Sets the limit of the packet type, a rate of zero removes the limit. The
+// buckets of the packet type start full again.
+func SetRateLimit(category byte, pType byte, limit RateLimit) {
+	rateLock.Lock()
+	defer rateLock.Unlock()
+	packet := packetKey(category, pType)
+	if limit.Rate <= 0 {
+		delete(rateLimits, packet)
+	} else {
+		rateLimits[packet] = limit
+	}
+	for key, bucket := range buckets {
+		if bucket.packet == packet {
+			delete(buckets, key)
+		}
+	}
+}
+
+// Parses limits of the form "category.type=rate/burst" separated by commas
+// and sets them on top of the default limits
+func SetRateLimits(limits string) error {
+	for _, v := range strings.Split(limits, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		packet, limit, found := strings.Cut(v, "=")
+		category, pType, foundType := strings.Cut(packet, ".")
+		rate, burst, foundBurst := strings.Cut(limit, "/")
+		if !found || !foundType || !foundBurst {
+			return errors.New("invalid rate limit " + v)
+		}
+		categoryValue, errCategory := strconv.ParseUint(category, 10, 8)
+		typeValue, errType := strconv.ParseUint(pType, 10, 8)
+		rateValue, errRate := strconv.ParseFloat(rate, 64)
+		burstValue, errBurst := strconv.Atoi(burst)
+		if errCategory != nil || errType != nil || errRate != nil || errBurst != nil || burstValue < 1 {
+			return errors.New("invalid rate limit " + v)
+		}
+		SetRateLimit(byte(categoryValue), byte(typeValue), RateLimit{Rate: rateValue, Burst: burstValue})
+	}
+	return nil
+}
+
+// Takes a token from the bucket of the user and of the remote address. The
+// packet is allowed if both buckets had a token left. Before the login only
+// the bucket of the remote address is used, the user ID in the header is not
+// verified yet.
+func AllowPacket(header packets.Header, userId uint32, address string) bool {
+	rateLock.Lock()
+	defer rateLock.Unlock()
+	packet := packetKey(header.Category, header.Type)
+	limit, exists := rateLimits[packet]
+	if !exists {
+		return true
+	}
+	now := time.Now()
+	allowed := takeToken(fmt.Sprintf("ip:%s/%d", address, packet), packet, limit, now)
+	if userId != 0 {
+		allowed = takeToken(fmt.Sprintf("user:%d/%d", userId, packet), packet, limit, now) && allowed
+	}
+	if !allowed {
+		throttledPackets.Add(packetName(packet), 1)
+	}
+	if len(buckets) > maxBuckets {
+		pruneBuckets(now)
+	}
+	return allowed
+}
+
+func takeToken(key string, packet uint16, limit RateLimit, now time.Time) bool {
+	bucket, exists := buckets[key]
+	if !exists {
+		bucket = &tokenBucket{packet: packet, tokens: float64(limit.Burst), last: now}
+		buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	if bucket.tokens > float64(limit.Burst) {
+		bucket.tokens = float64(limit.Burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Removes the buckets that would be full by now, they start full again anyway
+func pruneBuckets(now time.Time) {
+	for key, bucket := range buckets {
+		limit, exists := rateLimits[bucket.packet]
+		if !exists || bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(buckets, key)
+		}
+	}
+}
+
+// Address of the client without the port, all connections from the same host
+// share the buckets and the connection limit
+func RemoteHost(connection net.Conn) string {
+	host, _, err := net.SplitHostPort(connection.RemoteAddr().String())
+	if err != nil {
+		return connection.RemoteAddr().String()
+	}
+	return host
+}
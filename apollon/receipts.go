@@ -0,0 +1,80 @@
+package apollon
+
+import (
+	"log"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Stores that the text was accepted by the server and answers the sender
+// with the server-accepted receipt carrying the sequence number of the text
+func AcceptText(header packets.Header, recipients []uint32, text packets.Text, connection net.Conn) {
+	err := database.AcceptMessage(header.UserId, header.MessageId, text.GroupId, recipients)
+	if err != nil {
+		log.Printf("Failed to store status of text %d from %d: %s", header.MessageId, header.UserId, err)
+	}
+	ackHeader, textAck := packets.CreateTextAck(header.UserId, header.MessageId, text.ContactUserId)
+	textAck.Sequence = text.Sequence
+	textAck.Timestamp = text.ServerTimestamp
+	ack, err := packets.SerializePacket(ackHeader, textAck)
+	if err != nil {
+		log.Println("Failed to create ack packet")
+		return
+	}
+	connection.Write(ack)
+	database.RememberMessage(header, ackHeader, textAck)
+}
+
+// Updates the state of the referenced text and forwards the receipt to the
+// sender of the text. Older clients acknowledge texts with D_TEXT_ACK and the
+// ID of the text, this is handled as delivered receipt.
+func HandleReceipt(header packets.Header, receipt packets.TextAck, onlineC chan OnlineMessage, fwdC chan ForwardMessage) {
+	status := byte(packets.STATUS_DELIVERED)
+	receiptType := byte(packets.D_TEXT_DELIVERED)
+	if header.Type == packets.D_TEXT_READ {
+		status = packets.STATUS_READ
+		receiptType = packets.D_TEXT_READ
+	}
+	textId := receipt.MessageId
+	if textId == 0 {
+		textId = header.MessageId
+	}
+	// Any receipt confirms that the forwarded text arrived
+	ConfirmDelivery(header.UserId, receipt.ContactUserId, textId)
+	updated, err := database.UpdateMessageStatus(receipt.ContactUserId, textId, header.UserId, status)
+	if err != nil {
+		// Duplicated or outdated receipts are dropped
+		log.Printf("Ignoring receipt of %d for text %d: %s", header.UserId, textId, err)
+		return
+	}
+	forwardHeader, forward := packets.CreateTextReceipt(header.UserId, header.MessageId, receiptType, receipt.ContactUserId, textId)
+	forward.Timestamp = updated.Timestamp()
+	ForwardOrStore(forwardHeader, forward, receipt.ContactUserId, onlineC, fwdC)
+}
+
+// Answers the sender of a text with the state of the text for all recipients
+func HandleTextStatus(header packets.Header, query packets.TextStatus, connection net.Conn) {
+	statuses, err := database.GetMessageStatus(header.UserId, query.MessageId)
+	if err != nil {
+		log.Printf("Status of text %d from %d not found", query.MessageId, header.UserId)
+		SendError(header, packets.ERR_RECEIPT, "message not found", connection)
+		return
+	}
+	receipts := make([]packets.TextReceipt, 0, len(statuses))
+	for _, v := range statuses {
+		receipts = append(receipts, packets.TextReceipt{
+			ContactUserId: v.Recipient,
+			Status:        v.Status,
+			Timestamp:     v.Timestamp(),
+		})
+	}
+	answerHeader, answer := packets.CreateTextStatus(header.UserId, header.MessageId, query.MessageId, receipts)
+	raw, err := packets.SerializePacket(answerHeader, answer)
+	if err != nil {
+		log.Printf("Failed to serialize text status")
+		return
+	}
+	connection.Write(raw)
+}
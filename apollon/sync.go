@@ -0,0 +1,79 @@
+package apollon
+
+import (
+	"log"
+	"net"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Number of messages sent for a sync request without or with a too large limit
+const SYNC_DEFAULT_LIMIT = 100
+const SYNC_MAX_LIMIT = 500
+
+// Assigns the sequence number and the server time to the text and stores it
+// in the history of the conversation
+func StampText(header packets.Header, text packets.Text) (packets.Text, error) {
+	key := database.ConversationKey(header.UserId, text.ContactUserId, text.GroupId)
+	stamped, err := database.RecordMessage(key, header, func(sequence uint64, timestamp uint64) any {
+		text.Sequence = sequence
+		text.ServerTimestamp = timestamp
+		return text
+	})
+	return stamped.(packets.Text), err
+}
+
+func StampTextEdit(header packets.Header, key string, edit packets.TextEdit) (packets.TextEdit, error) {
+	stamped, err := database.RecordMessage(key, header, func(sequence uint64, timestamp uint64) any {
+		edit.Sequence = sequence
+		edit.ServerTimestamp = timestamp
+		return edit
+	})
+	return stamped.(packets.TextEdit), err
+}
+
+// Sends the stored messages of the conversation after the requested sequence
+// number followed by the sync answer. Messages of blocked users are skipped,
+// members of a group only get the messages sent after they joined.
+func HandleSync(header packets.Header, request packets.Sync, connection net.Conn) {
+	if request.GroupId != 0 {
+		group, err := database.GetGroup(request.GroupId)
+		if err != nil || !group.IsMember(header.UserId) {
+			log.Printf("User %d cannot sync group %d", header.UserId, request.GroupId)
+			SendError(header, packets.ERR_GROUP, "not a member", connection)
+			return
+		}
+		if joined := group.JoinedAt(header.UserId); joined > request.After {
+			request.After = joined
+		}
+	}
+	limit := int(request.Limit)
+	if limit <= 0 || limit > SYNC_MAX_LIMIT {
+		limit = SYNC_DEFAULT_LIMIT
+	}
+	key := database.ConversationKey(header.UserId, request.ContactUserId, request.GroupId)
+	entries, more := database.ReadHistory(key, request.After, limit)
+	for _, v := range entries {
+		request.After = v.Sequence
+		if database.IsBlocked(header.UserId, v.Header.UserId) {
+			continue
+		}
+		raw, err := packets.SerializePacket(v.Header, v.Payload)
+		if err != nil {
+			log.Printf("Failed to serialize message %d of conversation %s", v.Sequence, key)
+			continue
+		}
+		connection.Write(raw)
+	}
+	log.Printf("Synced %d messages of conversation %s to %d", len(entries), key, header.UserId)
+
+	request.More = more
+	request.Limit = uint32(limit)
+	raw, err := packets.SerializePacket(header, request)
+	if err != nil {
+		log.Printf("Failed to serialize sync answer")
+		return
+	}
+	connection.Write(raw)
+}
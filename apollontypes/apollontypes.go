@@ -3,4 +3,14 @@ package apollontypes
 type User struct {
 	Username string
 	UserId   uint32
+	Privacy  Privacy
+}
+
+// Who is allowed to interact with the user. Empty values use the defaults of
+// the server.
+type Privacy struct {
+	Messages     string
+	Search       string
+	Presence     string
+	ProfileImage string
 }
@@ -1,5 +1,7 @@
 package configuration
 
+import "time"
+
 type Config struct {
 	Secure             bool
 	ListenAddr         string
@@ -13,4 +15,29 @@ type Config struct {
 	CertificateKeyfile string
 	DatabaseFile       string
 	DatabaseNoWrite    bool
+	FileDirectory      string
+	FileGCInterval     time.Duration
+	MaxImageDimension  int
+	UsernameMinLength  int
+	UsernameMaxLength  int
+	UsernameSymbols    string
+	UniqueUsernames    bool
+	DetectConfusables  bool
+	AdminToken         string
+	Noise              bool
+	NoiseListenPort    string
+	NoiseKeyfile       string
+	NoiseCreateKey     bool
+	DedupWindow        time.Duration
+	DedupSize          int
+	RateLimits         string
+	MaxFrameSize       int
+	FrameLimits        string
+	MaxConnections     int
+	MaxHostConnections int
+	LoginTimeout       time.Duration
+	OutboundQueueSize  int
+	WriteTimeout       time.Duration
+	DeliveryTimeout    time.Duration
+	HistoryRetention   time.Duration
 }
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// IDs of deleted accounts together with the time of the deletion. The IDs are
+// never given to new accounts, so packets for the old account cannot reach
+// somebody else.
+var deletedUsers = make(map[uint32]uint64)
+var deletedLoaded = false
+var deletedLock sync.Mutex
+
+func IsDeleted(userId uint32) bool {
+	deletedLock.Lock()
+	defer deletedLock.Unlock()
+	loadDeletedUsers()
+	_, exists := deletedUsers[userId]
+	return exists
+}
+
+// Removes the account and all data stored for it: the mailbox, the file
+// references, the profile, the keys, the conversations with other users, the
+// seen messages, the presence, the receipts, the contacts and the group
+// memberships. The ID is kept as a tombstone.
+func DeleteUser(userId uint32) error {
+	usersLock.Lock()
+	loadDatabase()
+	user, exists := database[userId]
+	if !exists {
+		usersLock.Unlock()
+		log.Printf("Cannot delete unknown user %d", userId)
+		return errors.New("user not found")
+	}
+	deletedLock.Lock()
+	loadDeletedUsers()
+	deletedUsers[userId] = uint64(time.Now().UnixMilli())
+	err := saveDeletedUsers()
+	deletedLock.Unlock()
+	if err != nil {
+		usersLock.Unlock()
+		log.Printf("Failed to store tombstone of %d", userId)
+		return err
+	}
+
+	delete(database, userId)
+	unindexUsername(userId, user.Username)
+	err = saveToFile(databaseFile)
+	usersLock.Unlock()
+	if err != nil {
+		return err
+	}
+	DeleteMailbox(userId)
+	DeleteProfile(userId)
+	DeleteKeys(userId)
+	DeleteHistoryOf(userId)
+	DeleteSeenMessages(userId)
+	ReleaseAllFileReferences(userId)
+	DeletePresence(userId)
+	RemoveReceiptsOf(userId)
+	RemoveAllContacts(userId)
+	RemoveFromAllGroups(userId)
+	log.Printf("Deleted account %d", userId)
+	return nil
+}
+
+func ClearDeletedUsers() {
+	deletedLock.Lock()
+	defer deletedLock.Unlock()
+	deletedUsers = make(map[uint32]uint64)
+	deletedLoaded = true
+	os.Remove(dataFile("deleted.json"))
+}
+
+func loadDeletedUsers() {
+	if deletedLoaded {
+		return
+	}
+	deletedLoaded = true
+	content, err := os.ReadFile(dataFile("deleted.json"))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &deletedUsers)
+	if err != nil {
+		log.Printf("Failed to convert deleted users to JSON: %s", err)
+	}
+}
+
+func saveDeletedUsers() error {
+	if noWrite.Load() {
+		return nil
+	}
+	encoded, err := json.Marshal(deletedUsers)
+	if err != nil {
+		log.Println("Failed to encode deleted users")
+		return err
+	}
+	return os.WriteFile(dataFile("deleted.json"), encoded, 0644)
+}
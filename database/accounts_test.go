@@ -0,0 +1,52 @@
+package database_test
+
+import (
+	"testing"
+
+	"anzu.cloudsheeptech.com/apollontypes"
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func TestDeleteUser(t *testing.T) {
+	database.Delete()
+	database.StoreUserInDatabase(apollontypes.User{Username: "Deleted", UserId: 1})
+	database.StoreUserInDatabase(apollontypes.User{Username: "Remaining", UserId: 2})
+	database.AddContact(1, 2)
+	database.AddContactRequest(1, 3)
+	database.BlockUser(2, 1)
+	group, _ := database.CreateGroup(1, "Group")
+	database.InviteToGroup(group.GroupId, 1, 2)
+	database.JoinGroup(group.GroupId, 2)
+	database.SaveProfile(1, packets.ContactInfo{Username: "Deleted"})
+	database.SaveToMailbox(1, packets.Header{UserId: 2}, nil)
+
+	if database.DeleteUser(1) != nil || database.DeleteUser(1) == nil {
+		t.FailNow()
+	}
+	if database.IdExists(1) || !database.IsDeleted(1) || database.IsDeleted(2) {
+		t.FailNow()
+	}
+	if len(database.GetContacts(2)) != 0 || len(database.GetContactRequests(3)) != 0 || database.IsBlocked(2, 1) {
+		t.Fatalf("Contacts of the deleted user were kept")
+	}
+	group, err := database.GetGroup(group.GroupId)
+	if err != nil || group.IsMember(1) || group.Owner != 2 {
+		t.Fatalf("Group was not handed over: %+v", group)
+	}
+	if _, err := database.GetProfile(1); err == nil {
+		t.Fatalf("Profile was kept")
+	}
+	if mailbox, _ := database.ReadMailbox(1); len(mailbox) != 0 {
+		t.Fatalf("Mailbox was kept")
+	}
+	if users, _ := database.SearchUsers("deleted", 2, 0, 0); len(users) != 0 {
+		t.Fatalf("Deleted user is still found")
+	}
+
+	// The ID is never given to another account
+	if database.StoreUserInDatabase(apollontypes.User{Username: "New", UserId: 1}) == nil {
+		t.Fatalf("ID of deleted user was reused")
+	}
+	database.Delete()
+}
@@ -0,0 +1,240 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+)
+
+// Contact relationships known to the server. A relationship is always stored
+// for both users, requests are stored for the requested user until answered.
+var contacts = make(map[uint32][]uint32)
+var contactRequests = make(map[uint32][]uint32)
+var blockedUsers = make(map[uint32][]uint32)
+var contactsLoaded = false
+var contactLock sync.Mutex
+
+func AddContact(userId uint32, contactId uint32) error {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	if !containsId(contacts[userId], contactId) {
+		contacts[userId] = append(contacts[userId], contactId)
+	}
+	if !containsId(contacts[contactId], userId) {
+		contacts[contactId] = append(contacts[contactId], userId)
+	}
+	log.Printf("Users %d and %d are now contacts", userId, contactId)
+	return saveContacts()
+}
+
+func RemoveContact(userId uint32, contactId uint32) error {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	contacts[userId] = removeId(contacts[userId], contactId)
+	contacts[contactId] = removeId(contacts[contactId], userId)
+	if len(contacts[userId]) == 0 {
+		delete(contacts, userId)
+	}
+	if len(contacts[contactId]) == 0 {
+		delete(contacts, contactId)
+	}
+	log.Printf("Users %d and %d are no longer contacts", userId, contactId)
+	return saveContacts()
+}
+
+// Stores the request of the user to add the contact. The request is kept until
+// the contact accepts or declines it.
+func AddContactRequest(userId uint32, contactId uint32) error {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	if userId == contactId {
+		return errors.New("cannot add yourself")
+	}
+	if containsId(contacts[userId], contactId) {
+		return errors.New("already a contact")
+	}
+	if !containsId(contactRequests[contactId], userId) {
+		contactRequests[contactId] = append(contactRequests[contactId], userId)
+	}
+	log.Printf("User %d requested to add %d", userId, contactId)
+	return saveContacts()
+}
+
+// Answers the pending request of the requester. Accepting the request adds
+// the relationship for both users.
+func AnswerContactRequest(requester uint32, userId uint32, accept bool) error {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	if !containsId(contactRequests[userId], requester) {
+		log.Printf("No pending request from %d to %d", requester, userId)
+		return errors.New("no pending request")
+	}
+	contactRequests[userId] = removeId(contactRequests[userId], requester)
+	if len(contactRequests[userId]) == 0 {
+		delete(contactRequests, userId)
+	}
+	if accept {
+		if !containsId(contacts[userId], requester) {
+			contacts[userId] = append(contacts[userId], requester)
+		}
+		if !containsId(contacts[requester], userId) {
+			contacts[requester] = append(contacts[requester], userId)
+		}
+	}
+	log.Printf("User %d answered request of %d, accepted: %t", userId, requester, accept)
+	return saveContacts()
+}
+
+// Users that requested to add the given user and are waiting for an answer
+func GetContactRequests(userId uint32) []uint32 {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	result := make([]uint32, len(contactRequests[userId]))
+	copy(result, contactRequests[userId])
+	return result
+}
+
+// Blocks all texts, options and profile infos of the blocked user. Pending
+// requests of the blocked user are dropped.
+func BlockUser(userId uint32, blockedId uint32) error {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	if userId == blockedId {
+		return errors.New("cannot block yourself")
+	}
+	if !containsId(blockedUsers[userId], blockedId) {
+		blockedUsers[userId] = append(blockedUsers[userId], blockedId)
+	}
+	contactRequests[userId] = removeId(contactRequests[userId], blockedId)
+	if len(contactRequests[userId]) == 0 {
+		delete(contactRequests, userId)
+	}
+	log.Printf("User %d blocked %d", userId, blockedId)
+	return saveContacts()
+}
+
+func UnblockUser(userId uint32, blockedId uint32) error {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	blockedUsers[userId] = removeId(blockedUsers[userId], blockedId)
+	if len(blockedUsers[userId]) == 0 {
+		delete(blockedUsers, userId)
+	}
+	log.Printf("User %d unblocked %d", userId, blockedId)
+	return saveContacts()
+}
+
+func IsBlocked(userId uint32, senderId uint32) bool {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	return containsId(blockedUsers[userId], senderId)
+}
+
+func GetBlockedUsers(userId uint32) []uint32 {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	result := make([]uint32, len(blockedUsers[userId]))
+	copy(result, blockedUsers[userId])
+	return result
+}
+
+func GetContacts(userId uint32) []uint32 {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	result := make([]uint32, len(contacts[userId]))
+	copy(result, contacts[userId])
+	return result
+}
+
+func IsContact(userId uint32, contactId uint32) bool {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	return containsId(contacts[userId], contactId)
+}
+
+// Removes all relationships, requests and blocks of the user in both directions
+func RemoveAllContacts(userId uint32) error {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	loadContacts()
+	for _, stored := range []map[uint32][]uint32{contacts, contactRequests, blockedUsers} {
+		delete(stored, userId)
+		for id, ids := range stored {
+			ids = removeId(ids, userId)
+			if len(ids) == 0 {
+				delete(stored, id)
+				continue
+			}
+			stored[id] = ids
+		}
+	}
+	log.Printf("Removed all contacts of %d", userId)
+	return saveContacts()
+}
+
+func ClearContacts() {
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	contacts = make(map[uint32][]uint32)
+	contactRequests = make(map[uint32][]uint32)
+	blockedUsers = make(map[uint32][]uint32)
+	contactsLoaded = true
+	os.Remove(dataFile("contacts.json"))
+}
+
+type storedContacts struct {
+	Contacts map[uint32][]uint32
+	Requests map[uint32][]uint32
+	Blocked  map[uint32][]uint32
+}
+
+func loadContacts() {
+	if contactsLoaded {
+		return
+	}
+	contactsLoaded = true
+	content, err := os.ReadFile(dataFile("contacts.json"))
+	if err != nil {
+		return
+	}
+	var stored storedContacts
+	err = json.Unmarshal(content, &stored)
+	if err != nil {
+		log.Printf("Failed to convert contacts to JSON: %s", err)
+		return
+	}
+	if stored.Contacts != nil {
+		contacts = stored.Contacts
+	}
+	if stored.Requests != nil {
+		contactRequests = stored.Requests
+	}
+	if stored.Blocked != nil {
+		blockedUsers = stored.Blocked
+	}
+}
+
+func saveContacts() error {
+	if noWrite.Load() {
+		return nil
+	}
+	encoded, err := json.Marshal(storedContacts{Contacts: contacts, Requests: contactRequests, Blocked: blockedUsers})
+	if err != nil {
+		log.Println("Failed to encode contacts")
+		return err
+	}
+	return os.WriteFile(dataFile("contacts.json"), encoded, 0644)
+}
@@ -0,0 +1,53 @@
+package database_test
+
+import (
+	"testing"
+
+	"anzu.cloudsheeptech.com/database"
+)
+
+func TestContacts(t *testing.T) {
+	database.ClearContacts()
+	database.AddContact(1, 2)
+	database.AddContact(1, 3)
+	if !database.IsContact(2, 1) || !database.IsContact(1, 3) || database.IsContact(2, 3) {
+		t.FailNow()
+	}
+	database.RemoveContact(2, 1)
+	if database.IsContact(1, 2) || len(database.GetContacts(1)) != 1 || len(database.GetContacts(2)) != 0 {
+		t.FailNow()
+	}
+}
+
+func TestContactRequests(t *testing.T) {
+	database.ClearContacts()
+	if database.AnswerContactRequest(1, 2, true) == nil {
+		t.FailNow()
+	}
+	database.AddContactRequest(1, 2)
+	database.AddContactRequest(3, 2)
+	if len(database.GetContactRequests(2)) != 2 || database.IsContact(1, 2) {
+		t.FailNow()
+	}
+	database.AnswerContactRequest(1, 2, true)
+	database.AnswerContactRequest(3, 2, false)
+	if !database.IsContact(1, 2) || !database.IsContact(2, 1) || database.IsContact(2, 3) {
+		t.FailNow()
+	}
+	if len(database.GetContactRequests(2)) != 0 || database.AddContactRequest(2, 1) == nil {
+		t.FailNow()
+	}
+}
+
+func TestBlockingUsers(t *testing.T) {
+	database.ClearContacts()
+	database.AddContactRequest(2, 1)
+	database.BlockUser(1, 2)
+	if !database.IsBlocked(1, 2) || database.IsBlocked(2, 1) || len(database.GetContactRequests(1)) != 0 {
+		t.FailNow()
+	}
+	database.UnblockUser(1, 2)
+	if database.IsBlocked(1, 2) || len(database.GetBlockedUsers(1)) != 0 {
+		t.FailNow()
+	}
+}
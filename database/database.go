@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"database/sql"
@@ -17,7 +19,17 @@ import (
 var database = make(map[uint32]apollontypes.User)
 var databaseFile = "database.json"
 var directory = "./"
-var noWrite = false
+var noWrite atomic.Bool
+
+// Guards the users in memory together with the search index and the username
+// skeletons. Handlers of all connections read and change the users at once.
+var usersLock sync.Mutex
+
+// File the users in memory were read from
+var loadedFile = ""
+
+// Index over the usernames of all users in memory
+var searchIndex = NewSearchIndex()
 
 func UseSQL() {
 	db, err := sql.Open("mysql", "anzuchat@localhost:1234@/anzuchat")
@@ -35,6 +47,8 @@ func PrintUser(user apollontypes.User) {
 }
 
 func PrintDatabase() {
+	usersLock.Lock()
+	defer usersLock.Unlock()
 	log.Println("--------------------------")
 	for _, v := range database {
 		PrintUser(v)
@@ -76,44 +90,112 @@ func StoreInDatabase(userId uint32, username string) error {
 }
 
 func StoreUserInDatabase(user apollontypes.User) error {
-	ReadFromFile(databaseFile)
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	loadDatabase()
 	// log.Println("Storing user in database")
 	err := CheckUser(user)
 	if err != nil {
 		return err
 	}
 	_, exists := database[user.UserId]
-	if exists {
+	if exists || IsDeleted(user.UserId) {
 		log.Printf("User with ID %d already exists", user.UserId)
 		return errors.New("user already exists")
 	}
+	user.Username, err = NormalizeUsername(user.Username)
+	if err != nil {
+		log.Printf("Rejected username of %d: %s", user.UserId, err)
+		return err
+	}
+	err = usernameAvailable(user.Username, user.UserId)
+	if err != nil {
+		return err
+	}
 	database[user.UserId] = user
+	indexUsername(user.UserId, user.Username)
 	log.Printf("Stored user \"%s\" with id \"%d\"", user.Username, user.UserId)
-	SaveToFile(databaseFile)
+	saveToFile(databaseFile)
 	return nil
 }
 
-func SearchUsers(search string) []packets.Contact {
-	ReadFromFile(databaseFile)
-	log.Printf("Searching for \"%s\"", search)
+// Replaces the stored record of an existing user
+func UpdateUser(user apollontypes.User) error {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	return updateUser(user)
+}
 
-	var users []packets.Contact
+func updateUser(user apollontypes.User) error {
+	loadDatabase()
+	err := CheckUser(user)
+	if err != nil {
+		return err
+	}
+	stored, exists := database[user.UserId]
+	if !exists {
+		log.Printf("User with ID %d does not exist", user.UserId)
+		return errors.New("user not found")
+	}
+	database[user.UserId] = user
+	if stored.Username != user.Username {
+		unindexUsername(stored.UserId, stored.Username)
+		indexUsername(user.UserId, user.Username)
+	}
+	return saveToFile(databaseFile)
+}
 
-	for _, v := range database {
-		if strings.Contains(v.Username, search) {
-			newUser := packets.Contact{
-				UserId:   v.UserId,
-				Username: v.Username,
+// Searches the users whose name contains the search, starting at the cursor.
+// The searcher, users blocked by or blocking the searcher and users hiding from
+// the searcher are left out. Returns the found users and the cursor of the next
+// page, which is 0 if there are no more results.
+func SearchUsers(search string, searcherId uint32, cursor uint64, limit uint32) ([]packets.Contact, uint64) {
+	log.Printf("Searching for \"%s\"", search)
+	if limit == 0 {
+		limit = SEARCH_DEFAULT_LIMIT
+	}
+	if limit > SEARCH_MAX_LIMIT {
+		limit = SEARCH_MAX_LIMIT
+	}
+
+	users := make([]packets.Contact, 0, limit)
+	usersLock.Lock()
+	loadDatabase()
+	index := searchIndex
+	usersLock.Unlock()
+	// The index has its own lock and the privacy checks read the users as
+	// well, so the lock is only held for single lookups
+	for uint32(len(users)) < limit {
+		matches, next := index.Search(search, cursor, int(limit)-len(users))
+		for _, v := range matches {
+			user, err := GetUser(v)
+			if err != nil || !visibleInSearch(user.UserId, searcherId) {
+				continue
 			}
-			users = append(users, newUser)
+			users = append(users, packets.Contact{
+				UserId:   user.UserId,
+				Username: user.Username,
+			})
+		}
+		if next == 0 {
+			return users, 0
 		}
+		cursor = next
 	}
+	return users, cursor
+}
 
-	return users
+func visibleInSearch(userId uint32, searcherId uint32) bool {
+	if userId == searcherId || IsBlocked(searcherId, userId) || IsBlocked(userId, searcherId) {
+		return false
+	}
+	return PrivacyAllows(userId, searcherId, packets.PRIVACY_SEARCH)
 }
 
 func SearchUserId(userId uint32) (packets.Contact, error) {
-	err := ReadFromFile(databaseFile)
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	err := loadDatabase()
 	if err != nil {
 		log.Printf("Failed to read database from '%s'", databaseFile)
 		return packets.Contact{}, errors.New("database not found")
@@ -131,6 +213,8 @@ func SearchUserId(userId uint32) (packets.Contact, error) {
 }
 
 func GetUser(userId uint32) (apollontypes.User, error) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
 	user, err := database[userId]
 
 	if !err {
@@ -142,7 +226,9 @@ func GetUser(userId uint32) (apollontypes.User, error) {
 }
 
 func IdExists(id uint32) bool {
-	ReadFromFile(databaseFile)
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	loadDatabase()
 	log.Printf("Checking if ID %d exists", id)
 
 	_, exists := database[id]
@@ -151,12 +237,34 @@ func IdExists(id uint32) bool {
 }
 
 func Clear() {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	clearUsers()
+}
+
+func clearUsers() {
 	database = make(map[uint32]apollontypes.User)
+	searchIndex = NewSearchIndex()
+	usernameSkeletons = make(map[string][]uint32)
+	loadedFile = ""
 }
 
 func Delete() {
-	database = make(map[uint32]apollontypes.User)
+	usersLock.Lock()
+	clearUsers()
 	os.Create(databaseFile)
+	loadedFile = databaseFile
+	usersLock.Unlock()
+	ClearFiles()
+	ClearGroups()
+	ClearReceipts()
+	ClearContacts()
+	ClearPresence()
+	ClearProfiles()
+	ClearDeletedUsers()
+	ClearKeys()
+	ClearHistory()
+	ClearSeenMessages()
 	// Maybe also delete all outstanding message files?
 	dir, err := os.Open(directory)
 	if err != nil {
@@ -179,10 +287,16 @@ func SetDatabaseLocation(location string) {
 }
 
 func SetDatabaseNoWrite(overwriteDatabase bool) {
-	noWrite = overwriteDatabase
+	noWrite.Store(overwriteDatabase)
 }
 
 func ConvertToByte() ([]byte, error) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	return convertToByte()
+}
+
+func convertToByte() ([]byte, error) {
 	var content []byte
 	var err error
 	seperator := ","
@@ -207,8 +321,14 @@ func ConvertToByte() ([]byte, error) {
 }
 
 func SaveToFile(file string) error {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	return saveToFile(file)
+}
+
+func saveToFile(file string) error {
 	log.Printf("Saving to \"%s\"", file)
-	if noWrite {
+	if noWrite.Load() {
 		return nil
 	}
 	f, err := os.Create(file)
@@ -218,7 +338,7 @@ func SaveToFile(file string) error {
 	}
 	// Don't forget to close the file
 	defer f.Close()
-	users, err := ConvertToByte()
+	users, err := convertToByte()
 	if err != nil {
 		log.Println("Failed to save users to file!")
 		return err
@@ -232,7 +352,7 @@ func SaveToFile(file string) error {
 // TODO: Find a method to store and retrieve all types of JSON from a single or multiple files!
 func SaveAnyToFile[T packets.Packet](any T, file string) error {
 	log.Printf("Saving to \"%s\"", file)
-	if noWrite {
+	if noWrite.Load() {
 		return nil
 	}
 	// Append if file exists
@@ -290,12 +410,33 @@ func SaveContactOption(option packets.ContactOption, file string) error {
 	return SaveAnyToFile(option, file)
 }
 
+// Reads the users from the file once. Every change is written from memory to
+// the file, so the users in memory stay the latest state afterwards. The lock
+// has to be held.
+func loadDatabase() error {
+	if loadedFile == databaseFile {
+		return nil
+	}
+	return readFromFile(databaseFile)
+}
+
+// Replaces the users in memory with the users stored in the file
 func ReadFromFile(file string) error {
-	Clear()
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	return readFromFile(file)
+}
+
+func readFromFile(file string) error {
+	clearUsers()
 	log.Printf("Reading from \"%s\"", file)
 	content, err := os.ReadFile(file)
 	if err != nil {
 		log.Println(err)
+		if errors.Is(err, os.ErrNotExist) {
+			// No user was stored yet, the empty database is the latest state
+			loadedFile = file
+		}
 		return err
 	}
 	var data []apollontypes.User
@@ -306,7 +447,9 @@ func ReadFromFile(file string) error {
 	}
 	for _, v := range data {
 		database[v.UserId] = v
+		indexUsername(v.UserId, v.Username)
 	}
+	loadedFile = file
 	return nil
 }
 
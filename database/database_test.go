@@ -3,13 +3,30 @@ package database_test
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"anzu.cloudsheeptech.com/apollontypes"
 	"anzu.cloudsheeptech.com/database"
-	"anzu.cloudsheeptech.com/packets"
 )
 
+// Database file of the tests, benchmarks with their own file switch back to it
+var databaseLocation string
+
+func TestMain(m *testing.M) {
+	dataDir, err := os.MkdirTemp("", "apollon-database")
+	if err != nil {
+		log.Fatalf("Failed to create database directory: %s", err)
+	}
+	databaseLocation = filepath.Join(dataDir, "database.json")
+	database.SetDatabaseLocation(databaseLocation)
+	database.SetFileDirectory(filepath.Join(dataDir, "files"))
+	result := m.Run()
+	os.RemoveAll(dataDir)
+	os.Remove("./database.json")
+	os.Exit(result)
+}
+
 func TestInsertUser(t *testing.T) {
 	log.Println("Testing inserting user")
 
@@ -59,35 +76,27 @@ func TestInsertUser(t *testing.T) {
 	}
 	database.PrintDatabase()
 	// Check for correct insertion with create function
-	client := packets.Create{
-		Username: "fritz",
-	}
-	err = database.StoreInDatabase(client, nil)
+	err = database.StoreInDatabase(9875, "fritz")
 	if err != nil {
 		log.Printf("Failed to insert user in database!")
 		t.Fail()
 	}
-	client.Username = ""
-	err = database.StoreInDatabase(client, nil)
+	err = database.StoreInDatabase(9874, "")
 	if err == nil {
 		log.Println("Inserted incorrect user!")
 		t.Fail()
 	}
-	client.Username = "fritz"
-	client.UserId = 0
-	err = database.StoreInDatabase(client, nil)
+	err = database.StoreInDatabase(0, "fritz")
 	if err == nil {
 		log.Println("Inserted incorrect user!")
 		t.Fail()
 	}
-	client.UserId = 10
-	err = database.StoreInDatabase(client, nil)
+	err = database.StoreInDatabase(10, "fritz")
 	if err == nil {
 		log.Println("Stored duplicate user")
 		t.Fail()
 	}
-	client.UserId = 9876
-	err = database.StoreInDatabase(client, nil)
+	err = database.StoreInDatabase(9876, "fritz")
 	if err != nil {
 		log.Println("Failed to store correct user!")
 		t.Fail()
@@ -98,9 +107,8 @@ func TestInsertUser(t *testing.T) {
 func TestStoringUser(t *testing.T) {
 	log.Println("Testing storing users")
 	user := apollontypes.User{
-		Username:   "test",
-		UserId:     1,
-		Connection: nil,
+		Username: "test",
+		UserId:   1,
 	}
 	err := database.StoreUserInDatabase(user)
 	if err != nil {
@@ -148,11 +156,10 @@ func TestLoadingDatabase(t *testing.T) {
 
 func TestSearchingUser(t *testing.T) {
 	log.Println("Testing search for users")
-	database.Clear()
+	database.Delete()
 	user := apollontypes.User{
-		Username:   "test",
-		UserId:     1,
-		Connection: nil,
+		Username: "test",
+		UserId:   1,
 	}
 	err := database.StoreUserInDatabase(user)
 	if err != nil {
@@ -173,7 +180,7 @@ func TestSearchingUser(t *testing.T) {
 		log.Println("Failed to store correct user in database")
 		t.Fail()
 	}
-	contacts := database.SearchUsers("num")
+	contacts, _ := database.SearchUsers("num", 0, 0, 0)
 	if len(contacts) < 2 {
 		log.Println("Got incorrect amount of results back!")
 		t.Fail()
@@ -184,7 +191,7 @@ func TestSearchingUser(t *testing.T) {
 			t.Fail()
 		}
 	}
-	contacts = database.SearchUsers("numb")
+	contacts, _ = database.SearchUsers("numb", 0, 0, 0)
 	if len(contacts) != 1 {
 		log.Println("Got incorrect amount of results back!")
 		t.Fail()
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Message of a sender that the server already accepted together with the ack
+// that was sent for it. Clients resending the message after a reconnect get
+// the same ack again instead of delivering the message twice.
+type SeenMessage struct {
+	MessageId uint32
+	Category  byte
+	Type      byte
+	Seen      uint64
+	Ack       MailboxEntry
+}
+
+// Messages are remembered for the window or until the sender sent the given
+// number of newer messages
+var dedupWindow = 24 * time.Hour
+var dedupSize = 1000
+
+// The messages of every sender are stored in a file of the sender, so that
+// accepting a message only rewrites the messages of its sender
+var seenMessages = make(map[uint32][]SeenMessage)
+var seenLock sync.Mutex
+
+func seenFile(userId uint32) string {
+	return filepath.Join(dataFile("dedup"), fmt.Sprint(userId)+".json")
+}
+
+func SetDedupWindow(window time.Duration, size int) {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	dedupWindow = window
+	dedupSize = size
+}
+
+// Returns the message of the sender with the given ID if it was seen within
+// the window
+func FindSeenMessage(sender uint32, messageId uint32) (SeenMessage, bool) {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	oldest := uint64(time.Now().Add(-dedupWindow).UnixMilli())
+	for _, v := range readSeenMessages(sender) {
+		if v.MessageId == messageId && v.Seen >= oldest {
+			return v, true
+		}
+	}
+	return SeenMessage{}, false
+}
+
+// Remembers the accepted message and the ack that was sent to the sender.
+// Messages outside of the window are dropped.
+func RememberMessage(header packets.Header, ackHeader packets.Header, ack any) error {
+	encoded, err := json.Marshal(ack)
+	if err != nil {
+		log.Printf("Failed to encode ack of %d", header.MessageId)
+		return err
+	}
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	now := time.Now()
+	oldest := uint64(now.Add(-dedupWindow).UnixMilli())
+	seen := readSeenMessages(header.UserId)
+	kept := make([]SeenMessage, 0, len(seen)+1)
+	for _, v := range seen {
+		if v.Seen >= oldest && v.MessageId != header.MessageId {
+			kept = append(kept, v)
+		}
+	}
+	kept = append(kept, SeenMessage{
+		MessageId: header.MessageId,
+		Category:  header.Category,
+		Type:      header.Type,
+		Seen:      uint64(now.UnixMilli()),
+		Ack:       MailboxEntry{Header: ackHeader, Payload: encoded},
+	})
+	if len(kept) > dedupSize {
+		kept = kept[len(kept)-dedupSize:]
+	}
+	seenMessages[header.UserId] = kept
+	return writeSeenMessages(header.UserId, kept)
+}
+
+func DeleteSeenMessages(userId uint32) error {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	delete(seenMessages, userId)
+	err := os.Remove(seenFile(userId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func ClearSeenMessages() {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	seenMessages = make(map[uint32][]SeenMessage)
+	os.RemoveAll(dataFile("dedup"))
+}
+
+func readSeenMessages(userId uint32) []SeenMessage {
+	seen, exists := seenMessages[userId]
+	if exists {
+		return seen
+	}
+	content, err := os.ReadFile(seenFile(userId))
+	if err == nil {
+		err = json.Unmarshal(content, &seen)
+		if err != nil {
+			log.Printf("Failed to convert seen messages of %d to JSON: %s", userId, err)
+		}
+	}
+	seenMessages[userId] = seen
+	return seen
+}
+
+func writeSeenMessages(userId uint32, seen []SeenMessage) error {
+	if noWrite.Load() {
+		return nil
+	}
+	err := os.MkdirAll(dataFile("dedup"), 0755)
+	if err != nil {
+		log.Println("Failed to create dedup directory")
+		return err
+	}
+	encoded, err := json.Marshal(seen)
+	if err != nil {
+		log.Println("Failed to encode seen messages")
+		return err
+	}
+	return os.WriteFile(seenFile(userId), encoded, 0644)
+}
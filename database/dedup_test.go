@@ -0,0 +1,44 @@
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func TestSeenMessages(t *testing.T) {
+	database.ClearSeenMessages()
+	defer database.SetDedupWindow(24*time.Hour, 1000)
+	database.SetDedupWindow(time.Hour, 3)
+
+	for i := uint32(1); i <= 4; i++ {
+		header, _ := packets.CreateText(1, i, 2, "Text")
+		ackHeader, ack := packets.CreateTextAck(1, i, 2)
+		ack.Sequence = uint64(i)
+		database.RememberMessage(header, ackHeader, ack)
+	}
+	seen, exists := database.FindSeenMessage(1, 4)
+	if !exists || seen.Type != packets.D_TEXT || seen.Ack.Header.Type != packets.D_TEXT_ACK {
+		t.Fatalf("Message was not remembered")
+	}
+	ack, err := packets.DeseralizePacket[packets.TextAck](seen.Ack.Payload)
+	if err != nil || ack.Sequence != 4 {
+		t.Fatalf("Incorrect stored ack %+v", ack)
+	}
+	// Only the newest messages are kept and IDs are per sender
+	if _, exists := database.FindSeenMessage(1, 1); exists {
+		t.Fatalf("Window size was exceeded")
+	}
+	if _, exists := database.FindSeenMessage(2, 4); exists {
+		t.FailNow()
+	}
+
+	database.SetDedupWindow(time.Millisecond, 3)
+	time.Sleep(5 * time.Millisecond)
+	if _, exists := database.FindSeenMessage(1, 4); exists {
+		t.Fatalf("Expired message was found")
+	}
+	database.ClearSeenMessages()
+}
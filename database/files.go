@@ -0,0 +1,385 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Files are stored content addressed by their SHA-256 hash. A file that is sent
+// to multiple contacts is therefore only kept once and every recipient holds a
+// reference onto the stored blob until the download is acknowledged. References
+// that are not released within the history retention expire.
+type StoredFile struct {
+	Hash       string
+	Length     uint64
+	References map[uint32]uint32
+	// Time of the newest reference of every recipient
+	Referenced map[uint32]uint64 `json:",omitempty"`
+}
+
+var fileDirectory = "files"
+var fileIndexFile = "index.json"
+var fileIndex = make(map[string]StoredFile)
+var fileLock sync.Mutex
+
+// Uploads of the same file from different connections append to the same
+// partial file, so the offset check and the write happen under the lock of the
+// hash
+type uploadLock struct {
+	sync.Mutex
+	users int
+}
+
+var uploadLocks = make(map[string]*uploadLock)
+var uploadLocksLock sync.Mutex
+
+func lockUpload(hash string) func() {
+	uploadLocksLock.Lock()
+	lock, exists := uploadLocks[hash]
+	if !exists {
+		lock = &uploadLock{}
+		uploadLocks[hash] = lock
+	}
+	lock.users++
+	uploadLocksLock.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		uploadLocksLock.Lock()
+		defer uploadLocksLock.Unlock()
+		lock.users--
+		if lock.users == 0 {
+			delete(uploadLocks, hash)
+		}
+	}
+}
+
+func SetFileDirectory(location string) error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	fileDirectory = location
+	err := os.MkdirAll(fileDirectory, 0755)
+	if err != nil {
+		log.Printf("Failed to create file directory \"%s\"", fileDirectory)
+		return err
+	}
+	return readFileIndex()
+}
+
+func ValidFileHash(hash string) bool {
+	raw, err := hex.DecodeString(hash)
+	return err == nil && len(raw) == sha256.Size
+}
+
+func blobPath(hash string) string {
+	return filepath.Join(fileDirectory, hash)
+}
+
+func partPath(hash string) string {
+	return filepath.Join(fileDirectory, hash+".part")
+}
+
+func FileExists(hash string) bool {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	_, exists := fileIndex[hash]
+	return exists
+}
+
+func GetStoredFile(hash string) (StoredFile, error) {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	stored, exists := fileIndex[hash]
+	if !exists {
+		return StoredFile{}, errors.New("file not found")
+	}
+	return stored, nil
+}
+
+func AddFileReference(hash string, recipient uint32) error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	stored, exists := fileIndex[hash]
+	if !exists {
+		log.Printf("Cannot reference unknown file %s", hash)
+		return errors.New("file not found")
+	}
+	addReference(stored, recipient)
+	log.Printf("Added reference for %d onto %s", recipient, hash)
+	return saveFileIndex()
+}
+
+func HasFileReference(hash string, recipient uint32) bool {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	stored, exists := fileIndex[hash]
+	if !exists {
+		return false
+	}
+	return stored.References[recipient] > 0
+}
+
+func ReleaseFileReference(hash string, recipient uint32) error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	stored, exists := fileIndex[hash]
+	if !exists {
+		return errors.New("file not found")
+	}
+	count, referenced := stored.References[recipient]
+	if !referenced {
+		log.Printf("User %d does not reference %s", recipient, hash)
+		return errors.New("no reference")
+	}
+	if count <= 1 {
+		delete(stored.References, recipient)
+		delete(stored.Referenced, recipient)
+	} else {
+		stored.References[recipient] = count - 1
+	}
+	log.Printf("Released reference of %d onto %s", recipient, hash)
+	return saveFileIndex()
+}
+
+// Releases every reference a user holds, e.g. when the account is removed
+func ReleaseAllFileReferences(recipient uint32) error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	for _, stored := range fileIndex {
+		delete(stored.References, recipient)
+		delete(stored.Referenced, recipient)
+	}
+	return saveFileIndex()
+}
+
+// Returns how many bytes of a not yet completed upload are already stored
+// so that an interrupted upload can be resumed at this offset
+func UploadedLength(hash string) uint64 {
+	info, err := os.Stat(partPath(hash))
+	if err != nil {
+		return 0
+	}
+	return uint64(info.Size())
+}
+
+func WriteFileChunk(hash string, offset uint64, data []byte) (uint64, error) {
+	if !ValidFileHash(hash) {
+		return 0, errors.New("invalid file hash")
+	}
+	unlock := lockUpload(hash)
+	defer unlock()
+	current := UploadedLength(hash)
+	if offset != current {
+		log.Printf("Chunk for %s at offset %d but expected %d", hash, offset, current)
+		return current, errors.New("incorrect offset")
+	}
+	f, err := os.OpenFile(partPath(hash), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open partial file for %s", hash)
+		return current, err
+	}
+	defer f.Close()
+	written, err := f.Write(data)
+	return current + uint64(written), err
+}
+
+func DiscardUpload(hash string) {
+	if !ValidFileHash(hash) {
+		return
+	}
+	unlock := lockUpload(hash)
+	defer unlock()
+	os.Remove(partPath(hash))
+}
+
+// Verifies that the uploaded content matches the hash and moves it into the
+// store. The recipient reference is added in the same step so that the garbage
+// collection cannot remove the file in between. A zero recipient adds no
+// reference.
+func CommitFile(hash string, length uint64, recipient uint32) error {
+	if !ValidFileHash(hash) {
+		return errors.New("invalid file hash")
+	}
+	unlock := lockUpload(hash)
+	defer unlock()
+	f, err := os.Open(partPath(hash))
+	if err != nil {
+		log.Printf("No upload for %s found", hash)
+		return err
+	}
+	hasher := sha256.New()
+	read, err := io.Copy(hasher, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if uint64(read) != length {
+		log.Printf("Upload for %s has %d bytes but expected %d", hash, read, length)
+		return errors.New("incorrect file length")
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != hash {
+		log.Printf("Upload does not match hash %s", hash)
+		os.Remove(partPath(hash))
+		return errors.New("hash mismatch")
+	}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	err = os.Rename(partPath(hash), blobPath(hash))
+	if err != nil {
+		log.Printf("Failed to move upload for %s into the store", hash)
+		return err
+	}
+	stored, exists := fileIndex[hash]
+	if !exists {
+		stored = StoredFile{
+			Hash:       hash,
+			Length:     length,
+			References: make(map[uint32]uint32),
+			Referenced: make(map[uint32]uint64),
+		}
+		fileIndex[hash] = stored
+	}
+	if recipient != 0 {
+		addReference(stored, recipient)
+	}
+	log.Printf("Stored file %s with %d bytes", hash, length)
+	return saveFileIndex()
+}
+
+func ReadFileChunk(hash string, offset uint64, size int) ([]byte, error) {
+	if !FileExists(hash) {
+		return nil, errors.New("file not found")
+	}
+	f, err := os.Open(blobPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buffer := make([]byte, size)
+	read, err := f.ReadAt(buffer, int64(offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buffer[:read], nil
+}
+
+func addReference(stored StoredFile, recipient uint32) {
+	stored.References[recipient]++
+	stored.Referenced[recipient] = uint64(time.Now().UnixMilli())
+}
+
+// Removes the references that were not released within the history retention
+// and all stored files that are no longer referenced by any user
+func CollectGarbage() int {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	oldest := oldestKept()
+	expired := 0
+	for hash, stored := range fileIndex {
+		for recipient := range stored.References {
+			if stored.Referenced[recipient] < oldest {
+				log.Printf("Reference of %d onto %s expired", recipient, hash)
+				delete(stored.References, recipient)
+				delete(stored.Referenced, recipient)
+				expired++
+			}
+		}
+	}
+	removed := 0
+	for hash, stored := range fileIndex {
+		if len(stored.References) > 0 {
+			continue
+		}
+		err := os.Remove(blobPath(hash))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove file %s: %s", hash, err)
+			continue
+		}
+		delete(fileIndex, hash)
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Garbage collection removed %d files", removed)
+	}
+	if removed > 0 || expired > 0 {
+		saveFileIndex()
+	}
+	return removed
+}
+
+func GarbageCollection(interval time.Duration) {
+	log.Println("Starting file garbage collection thread")
+	for {
+		time.Sleep(interval)
+		CollectGarbage()
+		PruneHistory()
+		PruneReceipts()
+	}
+}
+
+func ClearFiles() {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	for hash := range fileIndex {
+		os.Remove(blobPath(hash))
+	}
+	fileIndex = make(map[string]StoredFile)
+	os.Remove(filepath.Join(fileDirectory, fileIndexFile))
+}
+
+func readFileIndex() error {
+	fileIndex = make(map[string]StoredFile)
+	content, err := os.ReadFile(filepath.Join(fileDirectory, fileIndexFile))
+	if err != nil {
+		// No files stored so far
+		return nil
+	}
+	var files []StoredFile
+	err = json.Unmarshal(content, &files)
+	if err != nil {
+		log.Printf("Failed to convert file index to JSON: %s", err)
+		return err
+	}
+	now := uint64(time.Now().UnixMilli())
+	for _, v := range files {
+		if v.References == nil {
+			v.References = make(map[uint32]uint32)
+		}
+		if v.Referenced == nil {
+			v.Referenced = make(map[uint32]uint64)
+		}
+		// References of older indexes expire from now on
+		for recipient := range v.References {
+			if _, exists := v.Referenced[recipient]; !exists {
+				v.Referenced[recipient] = now
+			}
+		}
+		fileIndex[v.Hash] = v
+	}
+	return nil
+}
+
+func saveFileIndex() error {
+	if noWrite.Load() {
+		return nil
+	}
+	files := make([]StoredFile, 0, len(fileIndex))
+	for _, v := range fileIndex {
+		files = append(files, v)
+	}
+	encoded, err := json.Marshal(files)
+	if err != nil {
+		log.Println("Failed to encode file index")
+		return err
+	}
+	return os.WriteFile(filepath.Join(fileDirectory, fileIndexFile), encoded, 0644)
+}
@@ -0,0 +1,165 @@
+package database_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"anzu.cloudsheeptech.com/database"
+)
+
+func hashContent(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestStoringFile(t *testing.T) {
+	content := []byte("This is the content of a file that is sent to multiple contacts")
+	hash := hashContent(content)
+
+	if database.FileExists(hash) {
+		log.Println("File exists before upload!")
+		t.FailNow()
+	}
+	received, err := database.WriteFileChunk(hash, 0, content[:10])
+	if err != nil || received != 10 {
+		log.Printf("Failed to write first chunk: %s", err)
+		t.FailNow()
+	}
+	// Chunk at the wrong offset must be rejected
+	_, err = database.WriteFileChunk(hash, 5, content[5:])
+	if err == nil {
+		log.Println("Chunk with incorrect offset accepted!")
+		t.FailNow()
+	}
+	if database.UploadedLength(hash) != 10 {
+		log.Println("Incorrect length of partial upload!")
+		t.FailNow()
+	}
+	received, err = database.WriteFileChunk(hash, 10, content[10:])
+	if err != nil || received != uint64(len(content)) {
+		log.Printf("Failed to write second chunk: %s", err)
+		t.FailNow()
+	}
+	err = database.CommitFile(hash, uint64(len(content)), 1)
+	if err != nil {
+		log.Printf("Failed to commit file: %s", err)
+		t.FailNow()
+	}
+	if !database.FileExists(hash) || !database.HasFileReference(hash, 1) {
+		log.Println("File not stored correctly!")
+		t.FailNow()
+	}
+	stored, err := database.ReadFileChunk(hash, 0, 1024)
+	if err != nil || !bytes.Equal(stored, content) {
+		log.Println("Stored content does not match!")
+		t.FailNow()
+	}
+}
+
+func TestFileHashMismatch(t *testing.T) {
+	content := []byte("Original content")
+	hash := hashContent(content)
+	_, err := database.WriteFileChunk(hash, 0, []byte("Modified content"))
+	if err != nil {
+		t.FailNow()
+	}
+	err = database.CommitFile(hash, uint64(len(content)), 1)
+	if err == nil {
+		log.Println("File with incorrect hash accepted!")
+		t.FailNow()
+	}
+	if database.FileExists(hash) || database.UploadedLength(hash) != 0 {
+		log.Println("Incorrect upload not discarded!")
+		t.FailNow()
+	}
+}
+
+func TestFileReferences(t *testing.T) {
+	content := []byte("Forwarded picture")
+	hash := hashContent(content)
+	database.WriteFileChunk(hash, 0, content)
+	err := database.CommitFile(hash, uint64(len(content)), 1)
+	if err != nil {
+		t.FailNow()
+	}
+	// Other recipients reference the same stored file
+	database.AddFileReference(hash, 2)
+	database.AddFileReference(hash, 3)
+
+	database.ReleaseFileReference(hash, 1)
+	database.ReleaseFileReference(hash, 2)
+	if database.CollectGarbage() != 0 || !database.FileExists(hash) {
+		log.Println("Referenced file was removed!")
+		t.FailNow()
+	}
+	if database.HasFileReference(hash, 1) {
+		log.Println("Released reference still exists!")
+		t.FailNow()
+	}
+	database.ReleaseFileReference(hash, 3)
+	if database.CollectGarbage() != 1 || database.FileExists(hash) {
+		log.Println("Unreferenced file was not removed!")
+		t.FailNow()
+	}
+	if database.AddFileReference(hash, 4) == nil {
+		log.Println("Referenced removed file!")
+		t.FailNow()
+	}
+}
+
+func TestConcurrentFileChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("Chunk sent by many connections at once"), 16*1024)
+	hash := hashContent(content)
+	defer database.DiscardUpload(hash)
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	start := make(chan struct{})
+	accepted := 0
+	for i := 0; i < 16; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			<-start
+			_, err := database.WriteFileChunk(hash, 0, content)
+			if err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wait.Wait()
+	// Only one chunk for the offset is appended
+	if accepted != 1 || database.UploadedLength(hash) != uint64(len(content)) {
+		log.Printf("Accepted %d chunks, %d bytes uploaded", accepted, database.UploadedLength(hash))
+		t.FailNow()
+	}
+}
+
+func TestFileReferenceExpiry(t *testing.T) {
+	database.SetHistoryRetention(200 * time.Millisecond)
+	defer database.SetHistoryRetention(30 * 24 * time.Hour)
+	content := []byte("Picture that is never downloaded")
+	hash := hashContent(content)
+	database.WriteFileChunk(hash, 0, content)
+	err := database.CommitFile(hash, uint64(len(content)), 1)
+	if err != nil {
+		t.FailNow()
+	}
+	database.CollectGarbage()
+	if !database.FileExists(hash) {
+		log.Println("File was removed before the reference expired!")
+		t.FailNow()
+	}
+	time.Sleep(300 * time.Millisecond)
+	if database.CollectGarbage() == 0 || database.FileExists(hash) {
+		log.Println("File with expired reference was not removed!")
+		t.FailNow()
+	}
+}
@@ -1,3 +1,5 @@
 module anzu.cloudsheeptech.com/database
 
 go 1.20
+
+require golang.org/x/text v0.14.0
@@ -0,0 +1,347 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type Group struct {
+	GroupId uint32
+	Name    string
+	Owner   uint32
+	Admins  []uint32
+	Members []uint32
+	Invited []uint32
+	// Sequence number of the group conversation when the member joined, older
+	// messages are not synced to the member
+	Joined map[uint32]uint64 `json:",omitempty"`
+}
+
+var groups = make(map[uint32]Group)
+var groupsLoaded = false
+var groupLock sync.Mutex
+
+// Additional stores are kept next to the user database
+func dataFile(name string) string {
+	return filepath.Join(filepath.Dir(databaseFile), name)
+}
+
+func containsId(ids []uint32, id uint32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func removeId(ids []uint32, id uint32) []uint32 {
+	result := make([]uint32, 0, len(ids))
+	for _, v := range ids {
+		if v != id {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (group Group) IsMember(userId uint32) bool {
+	return containsId(group.Members, userId)
+}
+
+func (group Group) IsAdmin(userId uint32) bool {
+	return group.Owner == userId || containsId(group.Admins, userId)
+}
+
+func (group Group) JoinedAt(userId uint32) uint64 {
+	return group.Joined[userId]
+}
+
+// All members that receive the texts sent by the given user
+func (group Group) Recipients(sender uint32) []uint32 {
+	return removeId(group.Members, sender)
+}
+
+func CreateGroup(owner uint32, name string) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	if name == "" {
+		return Group{}, errors.New("empty group name")
+	}
+	groupId := rand.Uint32()
+	for {
+		_, exists := groups[groupId]
+		if groupId != 0 && !exists {
+			break
+		}
+		groupId = rand.Uint32()
+	}
+	group := Group{
+		GroupId: groupId,
+		Name:    name,
+		Owner:   owner,
+		Admins:  []uint32{owner},
+		Members: []uint32{owner},
+		Invited: []uint32{},
+	}
+	groups[groupId] = group
+	log.Printf("User %d created group %d \"%s\"", owner, groupId, name)
+	return group, saveGroups()
+}
+
+func GetGroup(groupId uint32) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	group, exists := groups[groupId]
+	if !exists {
+		return Group{}, errors.New("group not found")
+	}
+	return group, nil
+}
+
+func GetGroupsOfUser(userId uint32) []Group {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	var result []Group
+	for _, v := range groups {
+		if v.IsMember(userId) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Removes the user from all groups and pending invitations. Returns the
+// groups that still exist afterwards.
+func RemoveFromAllGroups(userId uint32) ([]Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	var changed []Group
+	for id, group := range groups {
+		if !group.IsMember(userId) && !containsId(group.Invited, userId) {
+			continue
+		}
+		group = removeMember(group, userId)
+		group.Invited = removeId(group.Invited, userId)
+		if len(group.Members) == 0 {
+			log.Printf("Removing empty group %d", id)
+			delete(groups, id)
+			continue
+		}
+		groups[id] = group
+		changed = append(changed, group)
+	}
+	return changed, saveGroups()
+}
+
+func InviteToGroup(groupId uint32, inviter uint32, invitee uint32) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	group, exists := groups[groupId]
+	if !exists {
+		return Group{}, errors.New("group not found")
+	}
+	if !group.IsAdmin(inviter) {
+		log.Printf("User %d is not allowed to invite into group %d", inviter, groupId)
+		return group, errors.New("not an admin")
+	}
+	if group.IsMember(invitee) {
+		return group, errors.New("already a member")
+	}
+	if !containsId(group.Invited, invitee) {
+		group.Invited = append(group.Invited, invitee)
+	}
+	groups[groupId] = group
+	return group, saveGroups()
+}
+
+func JoinGroup(groupId uint32, userId uint32) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	group, exists := groups[groupId]
+	if !exists {
+		return Group{}, errors.New("group not found")
+	}
+	if group.IsMember(userId) {
+		return group, errors.New("already a member")
+	}
+	if !containsId(group.Invited, userId) {
+		log.Printf("User %d was not invited into group %d", userId, groupId)
+		return group, errors.New("not invited")
+	}
+	group.Invited = removeId(group.Invited, userId)
+	group.Members = append(group.Members, userId)
+	group.Joined = copyJoined(group.Joined)
+	group.Joined[userId] = HistorySequence(ConversationKey(0, 0, groupId))
+	groups[groupId] = group
+	return group, saveGroups()
+}
+
+// Removes the user from the group. If the owner leaves, the ownership is passed
+// on to an admin or the longest member. Empty groups are removed.
+func LeaveGroup(groupId uint32, userId uint32) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	group, exists := groups[groupId]
+	if !exists {
+		return Group{}, errors.New("group not found")
+	}
+	if !group.IsMember(userId) {
+		return group, errors.New("not a member")
+	}
+	group = removeMember(group, userId)
+	if len(group.Members) == 0 {
+		log.Printf("Removing empty group %d", groupId)
+		delete(groups, groupId)
+		return group, saveGroups()
+	}
+	groups[groupId] = group
+	return group, saveGroups()
+}
+
+func KickFromGroup(groupId uint32, admin uint32, userId uint32) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	group, exists := groups[groupId]
+	if !exists {
+		return Group{}, errors.New("group not found")
+	}
+	if !group.IsAdmin(admin) {
+		return group, errors.New("not an admin")
+	}
+	if !group.IsMember(userId) && !containsId(group.Invited, userId) {
+		return group, errors.New("not a member")
+	}
+	// Only the owner may remove other admins and nobody can remove the owner
+	if userId == group.Owner || (group.IsAdmin(userId) && admin != group.Owner) {
+		log.Printf("User %d is not allowed to kick %d from group %d", admin, userId, groupId)
+		return group, errors.New("not allowed")
+	}
+	group = removeMember(group, userId)
+	group.Invited = removeId(group.Invited, userId)
+	groups[groupId] = group
+	return group, saveGroups()
+}
+
+func RenameGroup(groupId uint32, admin uint32, name string) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	group, exists := groups[groupId]
+	if !exists {
+		return Group{}, errors.New("group not found")
+	}
+	if !group.IsAdmin(admin) {
+		return group, errors.New("not an admin")
+	}
+	if name == "" {
+		return group, errors.New("empty group name")
+	}
+	group.Name = name
+	groups[groupId] = group
+	return group, saveGroups()
+}
+
+func SetGroupAdmin(groupId uint32, owner uint32, userId uint32) (Group, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	loadGroups()
+	group, exists := groups[groupId]
+	if !exists {
+		return Group{}, errors.New("group not found")
+	}
+	if group.Owner != owner {
+		return group, errors.New("not the owner")
+	}
+	if !group.IsMember(userId) {
+		return group, errors.New("not a member")
+	}
+	if !containsId(group.Admins, userId) {
+		group.Admins = append(group.Admins, userId)
+	}
+	groups[groupId] = group
+	return group, saveGroups()
+}
+
+func removeMember(group Group, userId uint32) Group {
+	group.Members = removeId(group.Members, userId)
+	group.Admins = removeId(group.Admins, userId)
+	group.Joined = copyJoined(group.Joined)
+	delete(group.Joined, userId)
+	if group.Owner == userId && len(group.Members) > 0 {
+		if len(group.Admins) > 0 {
+			group.Owner = group.Admins[0]
+		} else {
+			group.Owner = group.Members[0]
+			group.Admins = append(group.Admins, group.Owner)
+		}
+		log.Printf("User %d is the new owner of group %d", group.Owner, group.GroupId)
+	}
+	return group
+}
+
+// The groups handed out share the map, it is copied before every change
+func copyJoined(joined map[uint32]uint64) map[uint32]uint64 {
+	copied := make(map[uint32]uint64, len(joined)+1)
+	for k, v := range joined {
+		copied[k] = v
+	}
+	return copied
+}
+
+func ClearGroups() {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	groups = make(map[uint32]Group)
+	groupsLoaded = true
+	os.Remove(dataFile("groups.json"))
+}
+
+func loadGroups() {
+	if groupsLoaded {
+		return
+	}
+	groupsLoaded = true
+	content, err := os.ReadFile(dataFile("groups.json"))
+	if err != nil {
+		return
+	}
+	var stored []Group
+	err = json.Unmarshal(content, &stored)
+	if err != nil {
+		log.Printf("Failed to convert groups to JSON: %s", err)
+		return
+	}
+	for _, v := range stored {
+		groups[v.GroupId] = v
+	}
+}
+
+func saveGroups() error {
+	if noWrite.Load() {
+		return nil
+	}
+	stored := make([]Group, 0, len(groups))
+	for _, v := range groups {
+		stored = append(stored, v)
+	}
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		log.Println("Failed to encode groups")
+		return err
+	}
+	return os.WriteFile(dataFile("groups.json"), encoded, 0644)
+}
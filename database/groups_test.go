@@ -0,0 +1,84 @@
+package database_test
+
+import (
+	"log"
+	"testing"
+
+	"anzu.cloudsheeptech.com/database"
+)
+
+func TestGroupMembership(t *testing.T) {
+	database.ClearGroups()
+	group, err := database.CreateGroup(1, "Test group")
+	if err != nil || group.GroupId == 0 {
+		log.Printf("Failed to create group: %s", err)
+		t.FailNow()
+	}
+	if !group.IsMember(1) || !group.IsAdmin(1) || group.Owner != 1 {
+		log.Println("Creator is not owner of the group!")
+		t.FailNow()
+	}
+	_, err = database.JoinGroup(group.GroupId, 2)
+	if err == nil {
+		log.Println("Joined group without invitation!")
+		t.FailNow()
+	}
+	_, err = database.InviteToGroup(group.GroupId, 2, 3)
+	if err == nil {
+		log.Println("Non member invited other user!")
+		t.FailNow()
+	}
+	database.InviteToGroup(group.GroupId, 1, 2)
+	database.InviteToGroup(group.GroupId, 1, 3)
+	database.JoinGroup(group.GroupId, 2)
+	group, err = database.JoinGroup(group.GroupId, 3)
+	if err != nil || len(group.Members) != 3 || len(group.Invited) != 0 {
+		log.Printf("Failed to join group: %s", err)
+		t.FailNow()
+	}
+
+	// Admins can kick members but not the owner or other admins
+	database.SetGroupAdmin(group.GroupId, 1, 2)
+	_, err = database.KickFromGroup(group.GroupId, 2, 1)
+	if err == nil {
+		log.Println("Admin kicked the owner!")
+		t.FailNow()
+	}
+	_, err = database.KickFromGroup(group.GroupId, 3, 2)
+	if err == nil {
+		log.Println("Member kicked an admin!")
+		t.FailNow()
+	}
+	group, err = database.KickFromGroup(group.GroupId, 2, 3)
+	if err != nil || group.IsMember(3) {
+		log.Printf("Failed to kick member: %s", err)
+		t.FailNow()
+	}
+	_, err = database.RenameGroup(group.GroupId, 3, "Renamed")
+	if err == nil {
+		log.Println("Kicked member renamed the group!")
+		t.FailNow()
+	}
+	group, err = database.RenameGroup(group.GroupId, 2, "Renamed")
+	if err != nil || group.Name != "Renamed" {
+		t.FailNow()
+	}
+}
+
+func TestGroupOwnerLeaves(t *testing.T) {
+	database.ClearGroups()
+	group, _ := database.CreateGroup(1, "Test group")
+	database.InviteToGroup(group.GroupId, 1, 2)
+	database.JoinGroup(group.GroupId, 2)
+	group, err := database.LeaveGroup(group.GroupId, 1)
+	if err != nil || group.Owner != 2 || !group.IsAdmin(2) {
+		log.Println("Ownership was not passed on!")
+		t.FailNow()
+	}
+	database.LeaveGroup(group.GroupId, 2)
+	_, err = database.GetGroup(group.GroupId)
+	if err == nil {
+		log.Println("Empty group was not removed!")
+		t.FailNow()
+	}
+}
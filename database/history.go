@@ -0,0 +1,256 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Number of messages kept per conversation, older messages can no longer be
+// synced but keep their sequence numbers
+const MAX_HISTORY = 1000
+
+// Time messages are kept in the history. Messages are removed when the
+// conversation changes or by the garbage collection.
+var historyRetention = 30 * 24 * time.Hour
+
+// Accepted message together with the packet that was forwarded for it
+type HistoryEntry struct {
+	Sequence uint64
+	Header   packets.Header
+	Payload  json.RawMessage
+	// Time the server accepted the message
+	Stored uint64
+}
+
+// Messages of a conversation in the order the server accepted them. The
+// sequence number is increased with every accepted message.
+type Conversation struct {
+	Key      string
+	Sequence uint64
+	Entries  []HistoryEntry
+}
+
+var conversations = make(map[string]Conversation)
+var historyLock sync.Mutex
+
+// Key of the conversation between two users or of a group. Both users of a
+// conversation get the same key.
+func ConversationKey(userId uint32, contactId uint32, groupId uint32) string {
+	if groupId != 0 {
+		return fmt.Sprintf("g%d", groupId)
+	}
+	if contactId < userId {
+		userId, contactId = contactId, userId
+	}
+	return fmt.Sprintf("%d-%d", userId, contactId)
+}
+
+// Zero keeps the current retention
+func SetHistoryRetention(retention time.Duration) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	if retention > 0 {
+		historyRetention = retention
+	}
+}
+
+func historyFile(key string) string {
+	return filepath.Join(dataFile("history"), key+".json")
+}
+
+// Assigns the next sequence number of the conversation and the server time to
+// the message. The stamp function returns the packet content with both values
+// filled, which is then appended to the history.
+func RecordMessage(key string, header packets.Header, stamp func(sequence uint64, timestamp uint64) any) (any, error) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	conversation := readConversation(key)
+	conversation.Sequence++
+	now := uint64(time.Now().UnixMilli())
+	content := stamp(conversation.Sequence, now)
+	payload, err := json.Marshal(content)
+	if err != nil {
+		log.Printf("Failed to encode message of conversation %s", key)
+		return content, err
+	}
+	conversation.Entries = append(retainedEntries(conversation.Entries), HistoryEntry{Sequence: conversation.Sequence, Header: header, Payload: payload, Stored: now})
+	if len(conversation.Entries) > MAX_HISTORY {
+		conversation.Entries = append([]HistoryEntry{}, conversation.Entries[len(conversation.Entries)-MAX_HISTORY:]...)
+	}
+	conversations[key] = conversation
+	return content, writeConversation(conversation)
+}
+
+// Returns at most limit messages with a sequence number after the given one
+// and whether further messages are left
+func ReadHistory(key string, after uint64, limit int) ([]HistoryEntry, bool) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	conversation := readConversation(key)
+	oldest := oldestRetained()
+	var result []HistoryEntry
+	for _, v := range conversation.Entries {
+		if v.Sequence <= after || v.Stored < oldest {
+			continue
+		}
+		if len(result) == limit {
+			return result, true
+		}
+		result = append(result, v)
+	}
+	return result, false
+}
+
+// Current sequence number of the conversation, the next message gets the
+// following number
+func HistorySequence(key string) uint64 {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	return readConversation(key).Sequence
+}
+
+// Removes the messages older than the retention from all conversations. The
+// conversations are kept for their sequence numbers. Returns the number of
+// removed messages.
+func PruneHistory() int {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	removed := 0
+	files, _ := os.ReadDir(dataFile("history"))
+	for _, v := range files {
+		key := strings.TrimSuffix(v.Name(), ".json")
+		conversation := readConversation(key)
+		kept := retainedEntries(conversation.Entries)
+		if len(kept) == len(conversation.Entries) {
+			continue
+		}
+		removed += len(conversation.Entries) - len(kept)
+		conversation.Entries = kept
+		conversations[key] = conversation
+		writeConversation(conversation)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d messages older than %s from the history", removed, historyRetention)
+	}
+	return removed
+}
+
+// Oldest time that is still kept, for data that expires together with the
+// history
+func oldestKept() uint64 {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	return oldestRetained()
+}
+
+func oldestRetained() uint64 {
+	return uint64(time.Now().Add(-historyRetention).UnixMilli())
+}
+
+func retainedEntries(entries []HistoryEntry) []HistoryEntry {
+	oldest := oldestRetained()
+	for i, v := range entries {
+		if v.Stored >= oldest {
+			if i == 0 {
+				return entries
+			}
+			return append([]HistoryEntry{}, entries[i:]...)
+		}
+	}
+	return []HistoryEntry{}
+}
+
+// Removes a deleted text of the sender and all edits of it from the history
+func RemoveFromHistory(key string, sender uint32, messageId uint32) error {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	conversation := readConversation(key)
+	kept := make([]HistoryEntry, 0, len(conversation.Entries))
+	for _, v := range conversation.Entries {
+		if v.Header.UserId == sender && v.Header.Category == packets.CAT_DATA {
+			if v.Header.Type == packets.D_TEXT && v.Header.MessageId == messageId {
+				continue
+			}
+			if v.Header.Type == packets.D_TEXT_EDIT {
+				var edit packets.TextEdit
+				if json.Unmarshal(v.Payload, &edit) == nil && edit.MessageId == messageId {
+					continue
+				}
+			}
+		}
+		kept = append(kept, v)
+	}
+	conversation.Entries = kept
+	conversations[key] = conversation
+	return writeConversation(conversation)
+}
+
+// Removes the conversations of the user with other users
+func DeleteHistoryOf(userId uint32) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	files, _ := os.ReadDir(dataFile("history"))
+	for _, v := range files {
+		conversationKey := strings.TrimSuffix(v.Name(), ".json")
+		conversations[conversationKey] = readConversation(conversationKey)
+	}
+	for key := range conversations {
+		var first, second uint32
+		if _, err := fmt.Sscanf(key, "%d-%d", &first, &second); err != nil || (first != userId && second != userId) {
+			continue
+		}
+		delete(conversations, key)
+		os.Remove(historyFile(key))
+	}
+}
+
+func ClearHistory() {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	conversations = make(map[string]Conversation)
+	os.RemoveAll(dataFile("history"))
+}
+
+func readConversation(key string) Conversation {
+	conversation, exists := conversations[key]
+	if exists {
+		return conversation
+	}
+	conversation = Conversation{Key: key}
+	content, err := os.ReadFile(historyFile(key))
+	if err != nil {
+		return conversation
+	}
+	err = json.Unmarshal(content, &conversation)
+	if err != nil {
+		log.Printf("Failed to convert conversation %s to JSON", key)
+		return Conversation{Key: key}
+	}
+	conversations[key] = conversation
+	return conversation
+}
+
+func writeConversation(conversation Conversation) error {
+	if noWrite.Load() {
+		return nil
+	}
+	err := os.MkdirAll(dataFile("history"), 0755)
+	if err != nil {
+		log.Println("Failed to create history directory")
+		return err
+	}
+	encoded, err := json.Marshal(conversation)
+	if err != nil {
+		log.Println("Failed to encode conversation")
+		return err
+	}
+	return os.WriteFile(historyFile(conversation.Key), encoded, 0644)
+}
@@ -0,0 +1,124 @@
+package database_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func recordText(key string, sender uint32, messageId uint32) packets.Text {
+	header, text := packets.CreateText(sender, messageId, 0, "Text")
+	stamped, _ := database.RecordMessage(key, header, func(sequence uint64, timestamp uint64) any {
+		text.Sequence = sequence
+		text.ServerTimestamp = timestamp
+		return text
+	})
+	return stamped.(packets.Text)
+}
+
+func TestConversationHistory(t *testing.T) {
+	database.ClearHistory()
+	key := database.ConversationKey(2, 1, 0)
+	if key != database.ConversationKey(1, 2, 0) || key == database.ConversationKey(1, 2, 3) {
+		t.Fatalf("Conversation keys do not match")
+	}
+	for i := uint32(1); i <= 5; i++ {
+		text := recordText(key, 1+i%2, i)
+		if text.Sequence != uint64(i) || text.ServerTimestamp == 0 {
+			t.Fatalf("Incorrect sequence %d for message %d", text.Sequence, i)
+		}
+	}
+	if text := recordText(database.ConversationKey(1, 3, 0), 1, 1); text.Sequence != 1 {
+		t.Fatalf("Conversations share sequence numbers")
+	}
+
+	entries, more := database.ReadHistory(key, 2, 2)
+	if len(entries) != 2 || !more || entries[0].Sequence != 3 || entries[1].Sequence != 4 {
+		t.Fatalf("Incorrect history %+v", entries)
+	}
+	entries, more = database.ReadHistory(key, 4, 2)
+	if len(entries) != 1 || more {
+		t.FailNow()
+	}
+
+	// Deleted texts are removed while the sequence keeps growing
+	database.RemoveFromHistory(key, 2, 3)
+	entries, _ = database.ReadHistory(key, 0, 10)
+	if len(entries) != 4 || entries[2].Sequence != 4 {
+		t.Fatalf("Text was not removed %+v", entries)
+	}
+	if text := recordText(key, 1, 6); text.Sequence != 6 {
+		t.FailNow()
+	}
+
+	database.DeleteHistoryOf(2)
+	if entries, _ := database.ReadHistory(key, 0, 10); len(entries) != 0 {
+		t.Fatalf("History of deleted user was kept")
+	}
+	if entries, _ := database.ReadHistory(database.ConversationKey(1, 3, 0), 0, 10); len(entries) != 1 {
+		t.Fatalf("History of other users was removed")
+	}
+	database.ClearHistory()
+}
+
+func TestHistoryLimit(t *testing.T) {
+	database.ClearHistory()
+	key := database.ConversationKey(0, 0, 1)
+	for i := uint32(1); i <= database.MAX_HISTORY+10; i++ {
+		recordText(key, 1, i)
+	}
+	entries, _ := database.ReadHistory(key, 0, database.MAX_HISTORY+10)
+	if len(entries) != database.MAX_HISTORY || entries[0].Sequence != 11 {
+		t.Fatalf("History was not trimmed")
+	}
+	database.ClearHistory()
+}
+
+func TestHistoryRetention(t *testing.T) {
+	database.ClearHistory()
+	database.SetHistoryRetention(200 * time.Millisecond)
+	defer database.SetHistoryRetention(30 * 24 * time.Hour)
+	key := database.ConversationKey(1, 2, 0)
+	recordText(key, 1, 1)
+	recordText(key, 2, 2)
+	time.Sleep(300 * time.Millisecond)
+	recordText(key, 1, 3)
+	entries, _ := database.ReadHistory(key, 0, 10)
+	if len(entries) != 1 || entries[0].Sequence != 3 {
+		log.Printf("Expired messages were synced: %+v", entries)
+		t.FailNow()
+	}
+	time.Sleep(300 * time.Millisecond)
+	if entries, _ := database.ReadHistory(key, 0, 10); len(entries) != 0 {
+		t.Fatalf("Expired message was synced")
+	}
+	database.PruneHistory()
+	if text := recordText(key, 2, 4); text.Sequence != 4 {
+		t.Fatalf("Sequence was reset by the pruning")
+	}
+	database.ClearHistory()
+}
+
+func TestGroupJoinSequence(t *testing.T) {
+	database.ClearHistory()
+	database.ClearGroups()
+	group, _ := database.CreateGroup(1, "Test group")
+	key := database.ConversationKey(0, 0, group.GroupId)
+	recordText(key, 1, 1)
+	recordText(key, 1, 2)
+	database.InviteToGroup(group.GroupId, 1, 2)
+	group, err := database.JoinGroup(group.GroupId, 2)
+	if err != nil || group.JoinedAt(2) != 2 || group.JoinedAt(1) != 0 {
+		log.Printf("Incorrect join sequence %d", group.JoinedAt(2))
+		t.FailNow()
+	}
+	group, _ = database.LeaveGroup(group.GroupId, 2)
+	if group.JoinedAt(2) != 0 {
+		t.Fatalf("Join sequence was kept after leaving")
+	}
+	database.ClearGroups()
+	database.ClearHistory()
+}
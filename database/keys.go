@@ -0,0 +1,190 @@
+package database
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Maximal number of prekeys stored for a single user
+const MAX_PREKEYS = 100
+
+// X25519 public keys have the same length as Ed25519 public keys
+const exchangeKeySize = 32
+
+// A requester gets at most one prekey of the same user within this period
+const PREKEY_PERIOD = time.Hour
+
+// Published keys of a user. The server only stores public keys and hands out
+// every prekey exactly once.
+type KeyRecord struct {
+	IdentityKey       []byte
+	ExchangeKey       []byte
+	ExchangeSignature []byte
+	PreKeys           []packets.PreKey
+	Updated           uint64
+}
+
+var keys = make(map[uint32]KeyRecord)
+var keysLoaded = false
+
+// Time of the last prekey handed out per owner and requester
+var preKeyRequests = make(map[uint32]map[uint32]time.Time)
+var keyLock sync.Mutex
+
+func validKey(identityKey []byte, key []byte, signature []byte) bool {
+	return len(key) == exchangeKeySize && len(signature) == ed25519.SignatureSize && ed25519.Verify(identityKey, key, signature)
+}
+
+// Stores the uploaded keys after checking the signatures. A new identity key
+// replaces all stored keys. Returns whether the identity key changed and the
+// number of stored prekeys.
+func StoreKeys(userId uint32, upload packets.KeyUpload) (bool, int, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	loadKeys()
+	if len(upload.IdentityKey) != ed25519.PublicKeySize {
+		return false, 0, errors.New("invalid identity key")
+	}
+	record, exists := keys[userId]
+	changed := !exists || string(record.IdentityKey) != string(upload.IdentityKey)
+	if changed {
+		record = KeyRecord{IdentityKey: upload.IdentityKey}
+	}
+	if len(upload.ExchangeKey) > 0 {
+		if !validKey(upload.IdentityKey, upload.ExchangeKey, upload.ExchangeSignature) {
+			return false, 0, errors.New("invalid exchange key")
+		}
+		record.ExchangeKey = upload.ExchangeKey
+		record.ExchangeSignature = upload.ExchangeSignature
+	}
+	if len(record.ExchangeKey) == 0 {
+		return false, 0, errors.New("missing exchange key")
+	}
+	for _, v := range upload.PreKeys {
+		if !validKey(upload.IdentityKey, v.Key, v.Signature) {
+			log.Printf("Invalid prekey %d of %d", v.KeyId, userId)
+			return false, 0, errors.New("invalid prekey")
+		}
+		if findPreKey(record.PreKeys, v.KeyId) > -1 {
+			return false, 0, errors.New("duplicate prekey")
+		}
+		record.PreKeys = append(record.PreKeys, v)
+	}
+	if len(record.PreKeys) > MAX_PREKEYS {
+		return false, 0, errors.New("too many prekeys")
+	}
+	record.Updated = uint64(time.Now().UnixMilli())
+	keys[userId] = record
+	log.Printf("Stored keys of %d with %d prekeys, identity changed: %t", userId, len(record.PreKeys), changed)
+	return changed, len(record.PreKeys), saveKeys()
+}
+
+// Returns the keys of the user with at most one prekey. The prekey is removed,
+// so that no two key exchanges use the same prekey. A requester that got a
+// prekey of the user within the PREKEY_PERIOD gets the keys without one, so
+// that repeated requests cannot use up all prekeys.
+func TakeKeyBundle(userId uint32, requester uint32) (KeyRecord, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	loadKeys()
+	record, exists := keys[userId]
+	if !exists {
+		return KeyRecord{}, errors.New("no keys published")
+	}
+	bundle := record
+	bundle.PreKeys = nil
+	now := time.Now()
+	requests := preKeyRequests[userId]
+	for v, last := range requests {
+		if now.Sub(last) >= PREKEY_PERIOD {
+			delete(requests, v)
+		}
+	}
+	if _, recent := requests[requester]; recent {
+		log.Printf("User %d already got a prekey of %d", requester, userId)
+		return bundle, nil
+	}
+	if len(record.PreKeys) > 0 {
+		bundle.PreKeys = record.PreKeys[:1]
+		record.PreKeys = append([]packets.PreKey{}, record.PreKeys[1:]...)
+		keys[userId] = record
+		if requests == nil {
+			requests = make(map[uint32]time.Time)
+			preKeyRequests[userId] = requests
+		}
+		requests[requester] = now
+	}
+	return bundle, saveKeys()
+}
+
+func GetIdentityKey(userId uint32) ([]byte, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	loadKeys()
+	record, exists := keys[userId]
+	if !exists {
+		return nil, errors.New("no keys published")
+	}
+	return record.IdentityKey, nil
+}
+
+func DeleteKeys(userId uint32) error {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	loadKeys()
+	delete(keys, userId)
+	delete(preKeyRequests, userId)
+	return saveKeys()
+}
+
+func ClearKeys() {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	keys = make(map[uint32]KeyRecord)
+	preKeyRequests = make(map[uint32]map[uint32]time.Time)
+	keysLoaded = true
+	os.Remove(dataFile("keys.json"))
+}
+
+func findPreKey(preKeys []packets.PreKey, keyId uint32) int {
+	for i, v := range preKeys {
+		if v.KeyId == keyId {
+			return i
+		}
+	}
+	return -1
+}
+
+func loadKeys() {
+	if keysLoaded {
+		return
+	}
+	keysLoaded = true
+	content, err := os.ReadFile(dataFile("keys.json"))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &keys)
+	if err != nil {
+		log.Printf("Failed to convert keys to JSON: %s", err)
+	}
+}
+
+func saveKeys() error {
+	if noWrite.Load() {
+		return nil
+	}
+	encoded, err := json.Marshal(keys)
+	if err != nil {
+		log.Println("Failed to encode keys")
+		return err
+	}
+	return os.WriteFile(dataFile("keys.json"), encoded, 0644)
+}
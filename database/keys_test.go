@@ -0,0 +1,81 @@
+package database_test
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func signedKey(identity ed25519.PrivateKey, keyId uint32) packets.PreKey {
+	private, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	public := private.PublicKey().Bytes()
+	return packets.PreKey{KeyId: keyId, Key: public, Signature: ed25519.Sign(identity, public)}
+}
+
+func TestKeyDirectory(t *testing.T) {
+	database.ClearKeys()
+	identityPublic, identity, _ := ed25519.GenerateKey(rand.Reader)
+	exchange := signedKey(identity, 0)
+	upload := packets.KeyUpload{
+		IdentityKey:       identityPublic,
+		ExchangeKey:       exchange.Key,
+		ExchangeSignature: exchange.Signature,
+		PreKeys:           []packets.PreKey{signedKey(identity, 1), signedKey(identity, 2)},
+	}
+	changed, preKeys, err := database.StoreKeys(1, upload)
+	if err != nil || !changed || preKeys != 2 {
+		t.Fatalf("Failed to store keys: %s", err)
+	}
+
+	// Keys signed by another identity are rejected
+	_, otherIdentity, _ := ed25519.GenerateKey(rand.Reader)
+	forged := upload
+	forged.ExchangeKey = nil
+	forged.PreKeys = []packets.PreKey{signedKey(otherIdentity, 3)}
+	if _, _, err := database.StoreKeys(1, forged); err == nil {
+		t.Fatalf("Forged prekey was accepted")
+	}
+	more := packets.KeyUpload{IdentityKey: identityPublic, PreKeys: []packets.PreKey{signedKey(identity, 3)}}
+	changed, preKeys, err = database.StoreKeys(1, more)
+	if err != nil || changed || preKeys != 3 {
+		t.Fatalf("Failed to add prekeys: %s", err)
+	}
+
+	// Every prekey is handed out once
+	for i := uint32(1); i <= 2; i++ {
+		bundle, err := database.TakeKeyBundle(1, 10+i)
+		if err != nil || len(bundle.PreKeys) != 1 || bundle.PreKeys[0].KeyId != i || string(bundle.ExchangeKey) != string(exchange.Key) {
+			t.Fatalf("Incorrect bundle %+v", bundle)
+		}
+	}
+
+	// A requester gets only one prekey within the period
+	bundle, err := database.TakeKeyBundle(1, 11)
+	if err != nil || len(bundle.PreKeys) != 0 || string(bundle.ExchangeKey) != string(exchange.Key) {
+		t.Fatalf("Repeated request got a prekey %+v", bundle)
+	}
+	bundle, err = database.TakeKeyBundle(1, 13)
+	if err != nil || len(bundle.PreKeys) != 1 || bundle.PreKeys[0].KeyId != 3 {
+		t.Fatalf("Prekey was used up by the repeated request %+v", bundle)
+	}
+	bundle, err = database.TakeKeyBundle(1, 14)
+	if err != nil || len(bundle.PreKeys) != 0 {
+		t.FailNow()
+	}
+	if _, err := database.TakeKeyBundle(2, 11); err == nil {
+		t.FailNow()
+	}
+
+	// A new identity replaces all keys
+	newPublic, newIdentity, _ := ed25519.GenerateKey(rand.Reader)
+	newExchange := signedKey(newIdentity, 0)
+	changed, preKeys, err = database.StoreKeys(1, packets.KeyUpload{IdentityKey: newPublic, ExchangeKey: newExchange.Key, ExchangeSignature: newExchange.Signature})
+	if err != nil || !changed || preKeys != 0 {
+		t.Fatalf("Failed to change identity: %s", err)
+	}
+	database.ClearKeys()
+}
@@ -0,0 +1,229 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Packets for users that are currently not online are stored together with
+// their original header so that every packet type can be delivered later on
+type MailboxEntry struct {
+	Header  packets.Header
+	Payload json.RawMessage
+}
+
+var mailboxLock sync.Mutex
+
+func mailboxFile(userId uint32) string {
+	return filepath.Join(directory, fmt.Sprint(userId)+".json")
+}
+
+func SaveToMailbox(userId uint32, header packets.Header, content any) error {
+	var payload json.RawMessage
+	if content != nil {
+		encoded, err := json.Marshal(content)
+		if err != nil {
+			log.Printf("Failed to encode packet for mailbox of %d", userId)
+			return err
+		}
+		payload = encoded
+	}
+	return AppendToMailbox(userId, MailboxEntry{Header: header, Payload: payload})
+}
+
+func AppendToMailbox(userId uint32, entries ...MailboxEntry) error {
+	mailboxLock.Lock()
+	defer mailboxLock.Unlock()
+	if noWrite.Load() {
+		return nil
+	}
+	mailbox, _ := readMailbox(userId)
+	mailbox = append(mailbox, entries...)
+	log.Printf("Storing %d packets in mailbox of %d", len(entries), userId)
+	return writeMailbox(userId, mailbox)
+}
+
+// Replaces the content of a text that is still waiting in the mailbox of the
+// user, a nil text removes it together with pending edits of the text.
+// Returns whether the text was found.
+func ReviseMailboxText(userId uint32, sender uint32, messageId uint32, revised *packets.TextEdit) (bool, error) {
+	mailboxLock.Lock()
+	defer mailboxLock.Unlock()
+	mailbox, err := readMailbox(userId)
+	if err != nil {
+		return false, nil
+	}
+	found := false
+	kept := mailbox[:0]
+	for _, v := range mailbox {
+		if v.Header.UserId != sender {
+			kept = append(kept, v)
+			continue
+		}
+		if v.Header.Category == packets.CAT_DATA && v.Header.Type == packets.D_TEXT && v.Header.MessageId == messageId {
+			found = true
+			if revised == nil {
+				continue
+			}
+			var text packets.Text
+			err = json.Unmarshal(v.Payload, &text)
+			if err != nil {
+				log.Printf("Failed to decode text %d in mailbox of %d", messageId, userId)
+				return false, err
+			}
+			text.Message = revised.Message
+			text.Ciphertext = revised.Ciphertext
+			text.Edited = revised.Timestamp
+			v.Payload, err = json.Marshal(text)
+			if err != nil {
+				return false, err
+			}
+		} else if revised == nil && v.Header.Category == packets.CAT_DATA && v.Header.Type == packets.D_TEXT_EDIT {
+			var edit packets.TextEdit
+			if json.Unmarshal(v.Payload, &edit) == nil && edit.MessageId == messageId {
+				continue
+			}
+		}
+		kept = append(kept, v)
+	}
+	if !found || noWrite.Load() {
+		return found, nil
+	}
+	log.Printf("Revised text %d of %d in mailbox of %d", messageId, sender, userId)
+	return found, writeMailbox(userId, kept)
+}
+
+// Removes a text from the mailbox of the user after the user confirmed it on
+// another way. Edits of the text are kept. Returns whether the text was found.
+func RemoveMailboxText(userId uint32, sender uint32, messageId uint32) (bool, error) {
+	mailboxLock.Lock()
+	defer mailboxLock.Unlock()
+	mailbox, err := readMailbox(userId)
+	if err != nil {
+		return false, nil
+	}
+	found := false
+	kept := mailbox[:0]
+	for _, v := range mailbox {
+		if v.Header.UserId == sender && v.Header.Category == packets.CAT_DATA && v.Header.Type == packets.D_TEXT && v.Header.MessageId == messageId {
+			found = true
+			continue
+		}
+		kept = append(kept, v)
+	}
+	if !found || noWrite.Load() {
+		return found, nil
+	}
+	log.Printf("Removed confirmed text %d of %d from mailbox of %d", messageId, sender, userId)
+	return found, writeMailbox(userId, kept)
+}
+
+func ReadMailbox(userId uint32) ([]MailboxEntry, error) {
+	mailboxLock.Lock()
+	defer mailboxLock.Unlock()
+	return readMailbox(userId)
+}
+
+// Returns the packets of the mailbox and removes them in one step, so that
+// packets stored in the meantime are not lost. The file is moved to the backup
+// of the last taken packets, which is replaced on the next take. Texts the
+// client does not confirm are stored in the mailbox again by the delivery
+// tracking.
+func TakeMailbox(userId uint32) ([]MailboxEntry, error) {
+	mailboxLock.Lock()
+	defer mailboxLock.Unlock()
+	mailbox, err := readMailbox(userId)
+	if err != nil {
+		return nil, err
+	}
+	os.Rename(mailboxFile(userId), filepath.Join(directory, "_"+fmt.Sprint(userId)+".json"))
+	return mailbox, nil
+}
+
+// Removes all packets from the mailbox. The delivered packets are kept in a
+// backup file until the delivery is confirmed.
+func ClearMailbox(userId uint32) {
+	mailboxLock.Lock()
+	defer mailboxLock.Unlock()
+	os.Rename(mailboxFile(userId), filepath.Join(directory, "_"+fmt.Sprint(userId)+".json"))
+}
+
+// Removes the mailbox together with the backup of the delivered packets
+func DeleteMailbox(userId uint32) {
+	mailboxLock.Lock()
+	defer mailboxLock.Unlock()
+	os.Remove(mailboxFile(userId))
+	os.Remove(filepath.Join(directory, "_"+fmt.Sprint(userId)+".json"))
+}
+
+func readMailbox(userId uint32) ([]MailboxEntry, error) {
+	content, err := os.ReadFile(mailboxFile(userId))
+	if err != nil {
+		return nil, err
+	}
+	var stored []struct {
+		Header  *packets.Header
+		Payload json.RawMessage
+	}
+	err = json.Unmarshal(content, &stored)
+	if err != nil {
+		log.Printf("Failed to convert mailbox of %d to JSON", userId)
+		return nil, err
+	}
+	mailbox := make([]MailboxEntry, 0, len(stored))
+	for _, v := range stored {
+		if v.Header != nil {
+			mailbox = append(mailbox, MailboxEntry{Header: *v.Header, Payload: v.Payload})
+		}
+	}
+	if len(mailbox) == len(stored) {
+		return mailbox, nil
+	}
+	// Mailboxes of older versions only hold texts, with the sender stored in
+	// place of the contact. They get the header they are sent with.
+	var legacy []packets.Text
+	err = json.Unmarshal(content, &legacy)
+	if err != nil || len(mailbox) != 0 {
+		log.Printf("Failed to convert old mailbox of %d", userId)
+		return nil, errors.New("invalid mailbox")
+	}
+	messageId := rand.Uint32()
+	for _, v := range legacy {
+		header := packets.Header{
+			Category:  packets.CAT_DATA,
+			Type:      packets.D_TEXT,
+			UserId:    v.ContactUserId,
+			MessageId: messageId,
+		}
+		messageId++
+		v.ContactUserId = userId
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		mailbox = append(mailbox, MailboxEntry{Header: header, Payload: payload})
+	}
+	log.Printf("Converted %d texts of the old mailbox of %d", len(mailbox), userId)
+	return mailbox, nil
+}
+
+func writeMailbox(userId uint32, mailbox []MailboxEntry) error {
+	if len(mailbox) == 0 {
+		os.Remove(mailboxFile(userId))
+		return nil
+	}
+	encoded, err := json.Marshal(mailbox)
+	if err != nil {
+		log.Println("Failed to encode mailbox")
+		return err
+	}
+	return os.WriteFile(mailboxFile(userId), encoded, 0644)
+}
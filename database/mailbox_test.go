@@ -0,0 +1,80 @@
+package database_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func TestReviseMailboxText(t *testing.T) {
+	database.DeleteMailbox(5)
+	textHeader, text := packets.CreateText(6, 100, 5, "Original")
+	otherHeader, other := packets.CreateText(7, 100, 5, "Other sender")
+	editHeader, edit := packets.CreateTextEdit(6, 101, 5, 100, "Edited")
+	database.SaveToMailbox(5, textHeader, text)
+	database.SaveToMailbox(5, otherHeader, other)
+
+	found, err := database.ReviseMailboxText(5, 6, 100, &edit)
+	if err != nil || !found {
+		t.Fatalf("Text was not found: %s", err)
+	}
+	mailbox, _ := database.ReadMailbox(5)
+	var stored packets.Text
+	json.Unmarshal(mailbox[0].Payload, &stored)
+	if len(mailbox) != 2 || stored.Message != "Edited" || stored.Edited != edit.Timestamp || stored.Timestamp != text.Timestamp {
+		t.Fatalf("Text was not rewritten: %+v", stored)
+	}
+	json.Unmarshal(mailbox[1].Payload, &stored)
+	if stored.Message != "Other sender" {
+		t.Fatalf("Text of other sender was changed")
+	}
+
+	// Deleting removes the text and edits of it that are still pending
+	database.SaveToMailbox(5, editHeader, edit)
+	found, err = database.ReviseMailboxText(5, 6, 100, nil)
+	if err != nil || !found {
+		t.FailNow()
+	}
+	mailbox, _ = database.ReadMailbox(5)
+	if len(mailbox) != 1 || mailbox[0].Header.UserId != 7 {
+		t.Fatalf("Text was not removed: %+v", mailbox)
+	}
+	if found, _ := database.ReviseMailboxText(5, 6, 100, nil); found {
+		t.FailNow()
+	}
+	database.DeleteMailbox(5)
+}
+
+func TestOldMailbox(t *testing.T) {
+	database.DeleteMailbox(5)
+	defer database.DeleteMailbox(5)
+	// Older versions stored the texts with the sender as contact
+	_, first := packets.CreateText(6, 100, 5, "First")
+	_, second := packets.CreateText(7, 101, 5, "Second")
+	database.SaveMessagesToFile(first, 6, "5.json")
+	database.SaveMessagesToFile(second, 7, "5.json")
+
+	mailbox, err := database.ReadMailbox(5)
+	if err != nil || len(mailbox) != 2 {
+		t.Fatalf("Old mailbox was not read: %s", err)
+	}
+	var stored packets.Text
+	json.Unmarshal(mailbox[1].Payload, &stored)
+	header := mailbox[1].Header
+	if header.Category != packets.CAT_DATA || header.Type != packets.D_TEXT || header.UserId != 7 || stored.ContactUserId != 5 || stored.Message != "Second" {
+		t.Fatalf("Incorrect converted text %+v %+v", header, stored)
+	}
+	if mailbox[0].Header.UserId != 6 || mailbox[0].Header.MessageId == header.MessageId {
+		t.Fatalf("Incorrect converted text %+v", mailbox[0].Header)
+	}
+
+	// New packets are stored next to the converted texts
+	editHeader, edit := packets.CreateTextEdit(6, 102, 5, 100, "Edited")
+	database.SaveToMailbox(5, editHeader, edit)
+	mailbox, err = database.TakeMailbox(5)
+	if err != nil || len(mailbox) != 3 || mailbox[0].Header.UserId != 6 || mailbox[2].Header.Type != packets.D_TEXT_EDIT {
+		t.Fatalf("Mailbox was not converted: %+v", mailbox)
+	}
+}
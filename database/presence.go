@@ -0,0 +1,78 @@
+package database
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// Last time a user went offline. Who is allowed to see the presence is part
+// of the privacy settings.
+type PresenceInfo struct {
+	LastSeen uint64
+}
+
+var presence = make(map[uint32]PresenceInfo)
+var presenceLoaded = false
+var presenceLock sync.Mutex
+
+func SetLastSeen(userId uint32, lastSeen uint64) error {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+	loadPresence()
+	info := presence[userId]
+	info.LastSeen = lastSeen
+	presence[userId] = info
+	return savePresence()
+}
+
+func GetPresence(userId uint32) PresenceInfo {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+	loadPresence()
+	return presence[userId]
+}
+
+func DeletePresence(userId uint32) error {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+	loadPresence()
+	delete(presence, userId)
+	return savePresence()
+}
+
+func ClearPresence() {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+	presence = make(map[uint32]PresenceInfo)
+	presenceLoaded = true
+	os.Remove(dataFile("presence.json"))
+}
+
+func loadPresence() {
+	if presenceLoaded {
+		return
+	}
+	presenceLoaded = true
+	content, err := os.ReadFile(dataFile("presence.json"))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &presence)
+	if err != nil {
+		log.Printf("Failed to convert presence to JSON: %s", err)
+	}
+}
+
+func savePresence() error {
+	if noWrite.Load() {
+		return nil
+	}
+	encoded, err := json.Marshal(presence)
+	if err != nil {
+		log.Println("Failed to encode presence")
+		return err
+	}
+	return os.WriteFile(dataFile("presence.json"), encoded, 0644)
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"errors"
+	"log"
+
+	"anzu.cloudsheeptech.com/apollontypes"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Values allowed for each setting, the first value is the default
+var privacyValues = map[string][]string{
+	packets.PRIVACY_MESSAGES: {packets.PRIVACY_EVERYONE, packets.PRIVACY_CONTACTS},
+	packets.PRIVACY_SEARCH:   {packets.PRIVACY_EVERYONE, packets.PRIVACY_CONTACTS, packets.PRIVACY_NOBODY},
+	packets.PRIVACY_PRESENCE: {packets.PRIVACY_CONTACTS, packets.PRIVACY_EVERYONE, packets.PRIVACY_NOBODY},
+	packets.PRIVACY_IMAGE:    {packets.PRIVACY_EVERYONE, packets.PRIVACY_CONTACTS, packets.PRIVACY_NOBODY},
+}
+
+func privacyField(privacy *apollontypes.Privacy, setting string) *string {
+	switch setting {
+	case packets.PRIVACY_MESSAGES:
+		return &privacy.Messages
+	case packets.PRIVACY_SEARCH:
+		return &privacy.Search
+	case packets.PRIVACY_PRESENCE:
+		return &privacy.Presence
+	case packets.PRIVACY_IMAGE:
+		return &privacy.ProfileImage
+	}
+	return nil
+}
+
+func validPrivacyValue(setting string, value string) bool {
+	for _, v := range privacyValues[setting] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value of the setting, the default if the user never changed it
+func GetPrivacySetting(userId uint32, setting string) string {
+	values, exists := privacyValues[setting]
+	if !exists {
+		return packets.PRIVACY_NOBODY
+	}
+	user, err := GetUser(userId)
+	if err != nil {
+		return values[0]
+	}
+	value := *privacyField(&user.Privacy, setting)
+	if value == "" {
+		return values[0]
+	}
+	return value
+}
+
+// All settings of the user in the format of the privacy packet
+func GetPrivacySettings(userId uint32) []packets.Option {
+	settings := make([]packets.Option, 0, len(privacyValues))
+	for _, setting := range []string{packets.PRIVACY_MESSAGES, packets.PRIVACY_SEARCH, packets.PRIVACY_PRESENCE, packets.PRIVACY_IMAGE} {
+		settings = append(settings, packets.Option{
+			Type:  setting,
+			Value: GetPrivacySetting(userId, setting),
+		})
+	}
+	return settings
+}
+
+// Changes the given settings on the user record. Either all settings are
+// valid and stored or none is changed.
+func SetPrivacySettings(userId uint32, settings []packets.Option) error {
+	user, err := GetUser(userId)
+	if err != nil {
+		return err
+	}
+	for _, v := range settings {
+		if !validPrivacyValue(v.Type, v.Value) {
+			log.Printf("Invalid privacy setting {%s, %s} of %d", v.Type, v.Value, userId)
+			return errors.New("invalid privacy setting")
+		}
+		*privacyField(&user.Privacy, v.Type) = v.Value
+	}
+	return UpdateUser(user)
+}
+
+// Checks if the viewer is allowed to do what the setting of the owner covers
+func PrivacyAllows(ownerId uint32, viewerId uint32, setting string) bool {
+	if ownerId == viewerId {
+		return true
+	}
+	switch GetPrivacySetting(ownerId, setting) {
+	case packets.PRIVACY_EVERYONE:
+		return true
+	case packets.PRIVACY_CONTACTS:
+		return IsContact(ownerId, viewerId)
+	default:
+		return false
+	}
+}
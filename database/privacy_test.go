@@ -0,0 +1,32 @@
+package database_test
+
+import (
+	"testing"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func TestPrivacySettings(t *testing.T) {
+	database.ClearContacts()
+	owner := uint32(424242)
+	database.StoreInDatabase(owner, "Private")
+	if database.GetPrivacySetting(owner, packets.PRIVACY_MESSAGES) != packets.PRIVACY_EVERYONE || !database.PrivacyAllows(owner, 1, packets.PRIVACY_MESSAGES) {
+		t.FailNow()
+	}
+	err := database.SetPrivacySettings(owner, []packets.Option{{Type: packets.PRIVACY_MESSAGES, Value: packets.PRIVACY_CONTACTS}, {Type: "Unknown", Value: packets.PRIVACY_NOBODY}})
+	if err == nil || database.GetPrivacySetting(owner, packets.PRIVACY_MESSAGES) != packets.PRIVACY_EVERYONE {
+		t.FailNow()
+	}
+	err = database.SetPrivacySettings(owner, []packets.Option{{Type: packets.PRIVACY_MESSAGES, Value: packets.PRIVACY_CONTACTS}, {Type: packets.PRIVACY_IMAGE, Value: packets.PRIVACY_NOBODY}})
+	if err != nil {
+		t.FailNow()
+	}
+	database.AddContact(owner, 1)
+	if !database.PrivacyAllows(owner, 1, packets.PRIVACY_MESSAGES) || database.PrivacyAllows(owner, 2, packets.PRIVACY_MESSAGES) {
+		t.FailNow()
+	}
+	if database.PrivacyAllows(owner, 1, packets.PRIVACY_IMAGE) || !database.PrivacyAllows(owner, owner, packets.PRIVACY_IMAGE) {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Latest profile a user pushed with a contact info. The version is increased
+// with every change so that clients only fetch profiles that changed. The
+// username is not taken from the client, it is filled from the database.
+type Profile struct {
+	UserId      uint32
+	Version     uint64
+	Updated     uint64
+	Username    string `json:"-"`
+	ImageFormat string
+	Image       []byte
+}
+
+var profiles = make(map[uint32]Profile)
+var profileLock sync.Mutex
+
+func profileFile(userId uint32) string {
+	return filepath.Join(dataFile("profiles"), fmt.Sprint(userId)+".json")
+}
+
+func SaveProfile(userId uint32, info packets.ContactInfo) (Profile, error) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	profile, _ := readProfile(userId)
+	profile.UserId = userId
+	profile.Version++
+	profile.Updated = uint64(time.Now().UnixMilli())
+	profile.ImageFormat = info.ImageFormat
+	profile.Image = info.Image
+	profiles[userId] = profile
+	log.Printf("Stored profile version %d of %d", profile.Version, userId)
+	return withUsername(profile), writeProfile(profile)
+}
+
+func GetProfile(userId uint32) (Profile, error) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	profile, err := readProfile(userId)
+	if err != nil {
+		return profile, err
+	}
+	return withUsername(profile), nil
+}
+
+func withUsername(profile Profile) Profile {
+	user, err := GetUser(profile.UserId)
+	if err == nil {
+		profile.Username = user.Username
+	}
+	return profile
+}
+
+func DeleteProfile(userId uint32) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	delete(profiles, userId)
+	os.Remove(profileFile(userId))
+}
+
+func ClearProfiles() {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	profiles = make(map[uint32]Profile)
+	os.RemoveAll(dataFile("profiles"))
+}
+
+func readProfile(userId uint32) (Profile, error) {
+	profile, exists := profiles[userId]
+	if exists {
+		return profile, nil
+	}
+	content, err := os.ReadFile(profileFile(userId))
+	if err != nil {
+		return Profile{}, errors.New("profile not found")
+	}
+	err = json.Unmarshal(content, &profile)
+	if err != nil {
+		log.Printf("Failed to convert profile of %d to JSON", userId)
+		return Profile{}, err
+	}
+	profiles[userId] = profile
+	return profile, nil
+}
+
+func writeProfile(profile Profile) error {
+	if noWrite.Load() {
+		return nil
+	}
+	err := os.MkdirAll(dataFile("profiles"), 0755)
+	if err != nil {
+		log.Println("Failed to create profile directory")
+		return err
+	}
+	encoded, err := json.Marshal(profile)
+	if err != nil {
+		log.Println("Failed to encode profile")
+		return err
+	}
+	return os.WriteFile(profileFile(profile.UserId), encoded, 0644)
+}
@@ -0,0 +1,30 @@
+package database_test
+
+import (
+	"bytes"
+	"testing"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func TestProfileVersions(t *testing.T) {
+	database.ClearProfiles()
+	database.StoreInDatabase(77, "Stored")
+	_, err := database.GetProfile(77)
+	if err == nil {
+		t.FailNow()
+	}
+	_, info := packets.CreateContactInfo(77, 1, "Profile", []byte{0x01, 0x02}, nil)
+	first, err := database.SaveProfile(77, info)
+	if err != nil || first.Version != 1 {
+		t.FailNow()
+	}
+	// The username of the client is ignored
+	info.Username = "Renamed"
+	database.SaveProfile(77, info)
+	profile, err := database.GetProfile(77)
+	if err != nil || profile.Version != 2 || profile.Username != "Stored" || !bytes.Equal(profile.Image, info.Image) {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,281 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Delivery state of a text for a single recipient. Timestamps are given in
+// milliseconds since epoch and are zero until the state was reached.
+type MessageStatus struct {
+	Sender    uint32
+	MessageId uint32
+	Recipient uint32
+	// Group the text was sent to, zero for texts to a single user
+	GroupId   uint32 `json:",omitempty"`
+	Status    byte
+	Accepted  uint64
+	Delivered uint64
+	Read      uint64
+}
+
+// The texts are identified by the sender and the message ID of the sender.
+// The states of the texts of a sender are stored in a file of the sender, so
+// that a receipt only rewrites the states of a single sender. States expire
+// together with the history, edits need the recipients of the texts until then.
+var receipts = make(map[uint32]map[uint32][]MessageStatus)
+var receiptLock sync.Mutex
+
+func receiptFile(sender uint32) string {
+	return filepath.Join(dataFile("receipts"), fmt.Sprint(sender)+".json")
+}
+
+// Stores that the server accepted the text of the sender for the given recipients
+func AcceptMessage(sender uint32, messageId uint32, groupId uint32, recipients []uint32) error {
+	receiptLock.Lock()
+	defer receiptLock.Unlock()
+	texts := senderReceipts(sender)
+	now := uint64(time.Now().UnixMilli())
+	statuses := texts[messageId]
+	for _, recipient := range recipients {
+		if findRecipient(statuses, recipient) > -1 {
+			continue
+		}
+		statuses = append(statuses, MessageStatus{
+			Sender:    sender,
+			MessageId: messageId,
+			Recipient: recipient,
+			GroupId:   groupId,
+			Status:    packets.STATUS_ACCEPTED,
+			Accepted:  now,
+		})
+	}
+	texts[messageId] = statuses
+	return saveReceipts(sender)
+}
+
+// Moves the state of the text forward. Only the recipient of the text can
+// update the state and the state can never go back. Reading a text implies
+// that it was delivered.
+func UpdateMessageStatus(sender uint32, messageId uint32, recipient uint32, status byte) (MessageStatus, error) {
+	receiptLock.Lock()
+	defer receiptLock.Unlock()
+	statuses := senderReceipts(sender)[messageId]
+	index := findRecipient(statuses, recipient)
+	if index < 0 {
+		log.Printf("No text %d from %d to %d known", messageId, sender, recipient)
+		return MessageStatus{}, errors.New("message not found")
+	}
+	current := statuses[index]
+	if status <= current.Status {
+		return current, errors.New("status already reached")
+	}
+	now := uint64(time.Now().UnixMilli())
+	switch status {
+	case packets.STATUS_DELIVERED:
+		current.Delivered = now
+	case packets.STATUS_READ:
+		if current.Delivered == 0 {
+			current.Delivered = now
+		}
+		current.Read = now
+	default:
+		return current, errors.New("invalid status")
+	}
+	current.Status = status
+	statuses[index] = current
+	return current, saveReceipts(sender)
+}
+
+func GetMessageStatus(sender uint32, messageId uint32) ([]MessageStatus, error) {
+	receiptLock.Lock()
+	defer receiptLock.Unlock()
+	statuses, exists := senderReceipts(sender)[messageId]
+	if !exists {
+		return nil, errors.New("message not found")
+	}
+	result := make([]MessageStatus, len(statuses))
+	copy(result, statuses)
+	return result, nil
+}
+
+// Forgets the state of a deleted text, later receipts for it are dropped
+func RemoveMessage(sender uint32, messageId uint32) error {
+	receiptLock.Lock()
+	defer receiptLock.Unlock()
+	delete(senderReceipts(sender), messageId)
+	return saveReceipts(sender)
+}
+
+// Timestamp at which the current state was reached
+func (status MessageStatus) Timestamp() uint64 {
+	switch status.Status {
+	case packets.STATUS_READ:
+		return status.Read
+	case packets.STATUS_DELIVERED:
+		return status.Delivered
+	default:
+		return status.Accepted
+	}
+}
+
+// Removes the states of all texts the user sent or received
+func RemoveReceiptsOf(userId uint32) error {
+	receiptLock.Lock()
+	defer receiptLock.Unlock()
+	delete(receipts, userId)
+	os.Remove(receiptFile(userId))
+	var err error
+	for _, sender := range storedSenders() {
+		changed := false
+		texts := senderReceipts(sender)
+		for messageId, statuses := range texts {
+			if index := findRecipient(statuses, userId); index > -1 {
+				changed = true
+				statuses = append(statuses[:index], statuses[index+1:]...)
+				if len(statuses) == 0 {
+					delete(texts, messageId)
+					continue
+				}
+				texts[messageId] = statuses
+			}
+		}
+		if changed {
+			if saveErr := saveReceipts(sender); saveErr != nil {
+				err = saveErr
+			}
+		}
+	}
+	return err
+}
+
+// Removes the states of texts that are no longer kept in the history. Returns
+// the number of removed states.
+func PruneReceipts() int {
+	receiptLock.Lock()
+	defer receiptLock.Unlock()
+	oldest := oldestKept()
+	removed := 0
+	for _, sender := range storedSenders() {
+		texts := senderReceipts(sender)
+		pruned := pruneExpired(texts, oldest)
+		if pruned == 0 {
+			continue
+		}
+		removed += pruned
+		saveReceipts(sender)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d expired receipts", removed)
+	}
+	return removed
+}
+
+func ClearReceipts() {
+	receiptLock.Lock()
+	defer receiptLock.Unlock()
+	receipts = make(map[uint32]map[uint32][]MessageStatus)
+	os.RemoveAll(dataFile("receipts"))
+}
+
+func findRecipient(statuses []MessageStatus, recipient uint32) int {
+	for i, v := range statuses {
+		if v.Recipient == recipient {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the states of the texts of the sender, the file of the sender is
+// read once
+func senderReceipts(sender uint32) map[uint32][]MessageStatus {
+	texts, exists := receipts[sender]
+	if exists {
+		return texts
+	}
+	texts = make(map[uint32][]MessageStatus)
+	receipts[sender] = texts
+	content, err := os.ReadFile(receiptFile(sender))
+	if err != nil {
+		return texts
+	}
+	var stored []MessageStatus
+	err = json.Unmarshal(content, &stored)
+	if err != nil {
+		log.Printf("Failed to convert receipts of %d to JSON: %s", sender, err)
+		return texts
+	}
+	for _, v := range stored {
+		texts[v.MessageId] = append(texts[v.MessageId], v)
+	}
+	pruneExpired(texts, oldestKept())
+	return texts
+}
+
+// Senders with states in memory or in a file
+func storedSenders() []uint32 {
+	senders := make([]uint32, 0, len(receipts))
+	for sender := range receipts {
+		senders = append(senders, sender)
+	}
+	files, _ := os.ReadDir(dataFile("receipts"))
+	for _, v := range files {
+		sender, err := strconv.ParseUint(strings.TrimSuffix(v.Name(), ".json"), 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, exists := receipts[uint32(sender)]; !exists {
+			senders = append(senders, uint32(sender))
+		}
+	}
+	return senders
+}
+
+func pruneExpired(texts map[uint32][]MessageStatus, oldest uint64) int {
+	removed := 0
+	for messageId, statuses := range texts {
+		// All recipients of a text were accepted at the same time
+		if len(statuses) > 0 && statuses[0].Accepted < oldest {
+			removed += len(statuses)
+			delete(texts, messageId)
+		}
+	}
+	return removed
+}
+
+func saveReceipts(sender uint32) error {
+	if noWrite.Load() {
+		return nil
+	}
+	texts := receipts[sender]
+	if len(texts) == 0 {
+		os.Remove(receiptFile(sender))
+		return nil
+	}
+	err := os.MkdirAll(dataFile("receipts"), 0755)
+	if err != nil {
+		log.Println("Failed to create receipt directory")
+		return err
+	}
+	stored := make([]MessageStatus, 0, len(texts))
+	for _, v := range texts {
+		stored = append(stored, v...)
+	}
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		log.Println("Failed to encode receipts")
+		return err
+	}
+	return os.WriteFile(receiptFile(sender), encoded, 0644)
+}
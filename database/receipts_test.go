@@ -0,0 +1,89 @@
+package database_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"anzu.cloudsheeptech.com/database"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func TestMessageStatus(t *testing.T) {
+	database.ClearReceipts()
+	sender := uint32(1)
+	messageId := uint32(42)
+	err := database.AcceptMessage(sender, messageId, 0, []uint32{2, 3})
+	if err != nil {
+		t.FailNow()
+	}
+	_, err = database.UpdateMessageStatus(sender, messageId, 4, packets.STATUS_DELIVERED)
+	if err == nil {
+		log.Println("Receipt from a user that did not receive the text was accepted!")
+		t.FailNow()
+	}
+	status, err := database.UpdateMessageStatus(sender, messageId, 2, packets.STATUS_DELIVERED)
+	if err != nil || status.Status != packets.STATUS_DELIVERED || status.Delivered == 0 {
+		log.Printf("Failed to update status: %s", err)
+		t.FailNow()
+	}
+	// Read implies delivered and the state cannot go back
+	status, err = database.UpdateMessageStatus(sender, messageId, 3, packets.STATUS_READ)
+	if err != nil || status.Delivered == 0 || status.Read == 0 {
+		t.FailNow()
+	}
+	_, err = database.UpdateMessageStatus(sender, messageId, 3, packets.STATUS_DELIVERED)
+	if err == nil {
+		log.Println("Status went back from read to delivered!")
+		t.FailNow()
+	}
+
+	statuses, err := database.GetMessageStatus(sender, messageId)
+	if err != nil || len(statuses) != 2 {
+		t.FailNow()
+	}
+	for _, v := range statuses {
+		if v.Recipient == 2 && v.Status != packets.STATUS_DELIVERED {
+			t.Fail()
+		}
+		if v.Recipient == 3 && (v.Status != packets.STATUS_READ || v.Timestamp() != v.Read) {
+			t.Fail()
+		}
+	}
+}
+
+func TestReceiptExpiry(t *testing.T) {
+	database.ClearReceipts()
+	database.SetHistoryRetention(200 * time.Millisecond)
+	defer database.SetHistoryRetention(30 * 24 * time.Hour)
+	database.AcceptMessage(1, 1, 0, []uint32{2, 3})
+	time.Sleep(300 * time.Millisecond)
+	database.AcceptMessage(1, 2, 0, []uint32{2})
+	database.AcceptMessage(4, 1, 0, []uint32{2})
+	database.UpdateMessageStatus(1, 2, 2, packets.STATUS_READ)
+
+	// Only the states of texts that left the history are removed
+	if removed := database.PruneReceipts(); removed != 2 {
+		log.Printf("Removed %d receipts instead of 2", removed)
+		t.FailNow()
+	}
+	if _, err := database.GetMessageStatus(1, 1); err == nil {
+		t.FailNow()
+	}
+	if statuses, err := database.GetMessageStatus(1, 2); err != nil || statuses[0].Status != packets.STATUS_READ {
+		t.FailNow()
+	}
+	if _, err := database.GetMessageStatus(4, 1); err != nil {
+		t.FailNow()
+	}
+
+	// Removing a recipient leaves the other states of the sender
+	database.AcceptMessage(1, 3, 0, []uint32{3})
+	database.RemoveReceiptsOf(2)
+	if _, err := database.GetMessageStatus(1, 2); err == nil {
+		t.FailNow()
+	}
+	if _, err := database.GetMessageStatus(1, 3); err != nil {
+		t.FailNow()
+	}
+}
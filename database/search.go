@@ -0,0 +1,256 @@
+package database
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Number of users returned if the search does not specify a limit
+const SEARCH_DEFAULT_LIMIT = 20
+
+// Maximal number of users returned for a single search
+const SEARCH_MAX_LIMIT = 100
+
+// Grams up to this length are indexed. Searches with at least that many
+// characters only look at the users containing the rarest gram of the search.
+const searchGramLength = 3
+
+// Ranks of the matches, lower ranks are returned first. Matches of the same
+// rank are ordered by the user ID.
+const (
+	rankExact = iota
+	rankPrefix
+	rankSubstring
+)
+
+// Characters that are replaced by their base letters, so that "Zoë" is found
+// when searching for "zoe". Combining marks are removed separately.
+var foldedCharacters = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th", 'ð': "d", 'ø': "o", 'ł': "l", 'đ': "d", 'ħ': "h", 'ı': "i", 'ŧ': "t",
+}
+
+var accentedLetters = map[string]string{
+	"a": "àáâãäåāăą",
+	"c": "çćĉċč",
+	"d": "ď",
+	"e": "èéêëēĕėęě",
+	"g": "ĝğġģ",
+	"h": "ĥ",
+	"i": "ìíîïĩīĭį",
+	"j": "ĵ",
+	"k": "ķ",
+	"l": "ĺļľŀ",
+	"n": "ñńņňŉ",
+	"o": "òóôõöōŏő",
+	"r": "ŕŗř",
+	"s": "śŝşšș",
+	"t": "ţťț",
+	"u": "ùúûüũūŭůűų",
+	"w": "ŵ",
+	"y": "ýÿŷ",
+	"z": "źżž",
+}
+
+func init() {
+	for base, letters := range accentedLetters {
+		for _, letter := range letters {
+			foldedCharacters[letter] = base
+		}
+	}
+}
+
+// Converts the name into the form used for comparisons. Compatibility forms
+// such as fullwidth letters are replaced by the usual letters, then the name
+// is lower cased and accents are removed.
+func FoldName(name string) string {
+	var folded strings.Builder
+	for _, char := range strings.ToLower(norm.NFKC.String(name)) {
+		if unicode.Is(unicode.Mn, char) {
+			continue
+		}
+		if replacement, exists := foldedCharacters[char]; exists {
+			folded.WriteString(replacement)
+			continue
+		}
+		folded.WriteRune(char)
+	}
+	return folded.String()
+}
+
+// All distinct grams of the name with up to the given length
+func nameGrams(name string, length int) []string {
+	runes := []rune(name)
+	seen := make(map[string]bool)
+	var grams []string
+	for n := 1; n <= length && n <= len(runes); n++ {
+		for i := 0; i+n <= len(runes); i++ {
+			gram := string(runes[i : i+n])
+			if !seen[gram] {
+				seen[gram] = true
+				grams = append(grams, gram)
+			}
+		}
+	}
+	return grams
+}
+
+// Index of the usernames. Every user is listed under all grams of the folded
+// username, so only users sharing the grams of the search have to be compared.
+type SearchIndex struct {
+	lock  sync.RWMutex
+	names map[uint32]string
+	grams map[string][]uint32
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		names: make(map[uint32]string),
+		grams: make(map[string][]uint32),
+	}
+}
+
+// Adds the user to the index. An already indexed user is replaced.
+func (index *SearchIndex) Add(userId uint32, username string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	index.remove(userId)
+	folded := FoldName(username)
+	index.names[userId] = folded
+	for _, gram := range nameGrams(folded, searchGramLength) {
+		index.grams[gram] = append(index.grams[gram], userId)
+	}
+}
+
+func (index *SearchIndex) Remove(userId uint32) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	index.remove(userId)
+}
+
+func (index *SearchIndex) remove(userId uint32) {
+	folded, exists := index.names[userId]
+	if !exists {
+		return
+	}
+	delete(index.names, userId)
+	for _, gram := range nameGrams(folded, searchGramLength) {
+		users := index.grams[gram]
+		for i, v := range users {
+			if v == userId {
+				// The order of the users does not matter
+				users[i] = users[len(users)-1]
+				users = users[:len(users)-1]
+				break
+			}
+		}
+		if len(users) == 0 {
+			delete(index.grams, gram)
+			continue
+		}
+		index.grams[gram] = users
+	}
+}
+
+func (index *SearchIndex) Len() int {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	return len(index.names)
+}
+
+// Position of a match in the results. The cursor of a search is the position
+// of the last returned match, so that pages stay consistent while users are
+// added or removed.
+func matchPosition(rank int, userId uint32) uint64 {
+	return uint64(rank)<<32 | uint64(userId)
+}
+
+// Positions with the last position on top
+type positionHeap []uint64
+
+func (positions positionHeap) Len() int           { return len(positions) }
+func (positions positionHeap) Less(i, j int) bool { return positions[i] > positions[j] }
+func (positions positionHeap) Swap(i, j int)      { positions[i], positions[j] = positions[j], positions[i] }
+
+func (positions *positionHeap) Push(position any) {
+	*positions = append(*positions, position.(uint64))
+}
+
+func (positions *positionHeap) Pop() any {
+	last := (*positions)[len(*positions)-1]
+	*positions = (*positions)[:len(*positions)-1]
+	return last
+}
+
+// Returns the IDs of at most limit users whose name contains the search and
+// which come after the cursor. Exact matches come first, then names starting
+// with the search and then all other matches. The returned cursor points to
+// the last returned user and is 0 if there are no more matches. Only the best
+// matches are kept while the candidates are compared, the others are never
+// sorted.
+func (index *SearchIndex) Search(search string, cursor uint64, limit int) ([]uint32, uint64) {
+	folded := FoldName(search)
+	if folded == "" || limit <= 0 {
+		return nil, 0
+	}
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	// Only the users containing the rarest gram of the search can match
+	runes := []rune(folded)
+	length := len(runes)
+	if length > searchGramLength {
+		length = searchGramLength
+	}
+	var candidates []uint32
+	for i := 0; i+length <= len(runes); i++ {
+		users, exists := index.grams[string(runes[i:i+length])]
+		if !exists {
+			return nil, 0
+		}
+		if candidates == nil || len(users) < len(candidates) {
+			candidates = users
+		}
+	}
+
+	// One match more than the limit tells whether there is a next page
+	best := make(positionHeap, 0, limit+1)
+	for _, v := range candidates {
+		name := index.names[v]
+		rank := rankSubstring
+		if name == folded {
+			rank = rankExact
+		} else if strings.HasPrefix(name, folded) {
+			rank = rankPrefix
+		} else if !strings.Contains(name, folded) {
+			continue
+		}
+		position := matchPosition(rank, v)
+		if position <= cursor {
+			continue
+		}
+		if len(best) <= limit {
+			heap.Push(&best, position)
+		} else if position < best[0] {
+			best[0] = position
+			heap.Fix(&best, 0)
+		}
+	}
+	sort.Slice(best, func(i, j int) bool {
+		return best[i] < best[j]
+	})
+	next := uint64(0)
+	if len(best) > limit {
+		best = best[:limit]
+		next = best[limit-1]
+	}
+	result := make([]uint32, len(best))
+	for i, v := range best {
+		result[i] = uint32(v)
+	}
+	return result, next
+}
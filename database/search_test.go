@@ -0,0 +1,193 @@
+package database_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"anzu.cloudsheeptech.com/apollontypes"
+	"anzu.cloudsheeptech.com/database"
+)
+
+func TestSearchRanking(t *testing.T) {
+	index := database.NewSearchIndex()
+	index.Add(1, "Annabelle")
+	index.Add(2, "Joanna")
+	index.Add(3, "Anna")
+	index.Add(4, "Bob")
+	index.Add(5, "ÄNNA")
+	result, next := index.Search("anna", 0, 10)
+	expected := []uint32{3, 5, 1, 2}
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, result)
+	}
+	for i := range expected {
+		if result[i] != expected[i] || next != 0 {
+			t.Fatalf("Expected %v but got %v", expected, result)
+		}
+	}
+
+	// The next page starts behind the cursor even if users were added before
+	result, next = index.Search("anna", 0, 2)
+	if len(result) != 2 || result[1] != 5 || next == 0 {
+		t.Fatalf("Incorrect first page %v", result)
+	}
+	index.Add(6, "Hannah Anna")
+	index.Add(0, "Anna")
+	result, next = index.Search("anna", next, 2)
+	if len(result) != 2 || result[0] != 1 || result[1] != 2 || next == 0 {
+		t.Fatalf("Incorrect second page %v", result)
+	}
+	result, next = index.Search("anna", next, 2)
+	if len(result) != 1 || result[0] != 6 || next != 0 {
+		t.Fatalf("Incorrect last page %v", result)
+	}
+	index.Remove(0)
+	index.Remove(6)
+
+	// Renamed users are only found under their new name
+	index.Add(4, "Zoë")
+	index.Remove(1)
+	count := func(search string) int {
+		result, _ := index.Search(search, 0, database.SEARCH_MAX_LIMIT)
+		return len(result)
+	}
+	if count("bob") != 0 || count("ZOE") != 1 || count("belle") != 0 {
+		t.FailNow()
+	}
+	if count("") != 0 || count("x") != 0 || index.Len() != 4 {
+		t.FailNow()
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	database.Delete()
+	database.ClearContacts()
+	for i := uint32(1); i <= 25; i++ {
+		database.StoreUserInDatabase(apollontypes.User{Username: fmt.Sprintf("Page%02d", i), UserId: i})
+	}
+	database.BlockUser(1, 7)
+
+	var found []uint32
+	cursor := uint64(0)
+	for {
+		users, next := database.SearchUsers("page", 1, cursor, 10)
+		if len(users) > 10 {
+			t.FailNow()
+		}
+		for _, v := range users {
+			found = append(found, v.UserId)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	// Neither the searcher nor the blocked user are returned
+	if len(found) != 23 {
+		t.Fatalf("Found %d users instead of 23", len(found))
+	}
+	for i, v := range found {
+		if v == 1 || v == 7 || (i > 0 && v < found[i-1]) {
+			t.Fatalf("Incorrect search results %v", found)
+		}
+	}
+	database.ClearContacts()
+}
+
+var benchmarkIndex *database.SearchIndex
+
+var syllables = []string{"an", "ber", "chi", "do", "el", "fa", "gu", "ho", "is", "ja", "ko", "li", "ma", "no", "or", "pe", "qui", "ra", "su", "ta", "ul", "ve", "wo", "xa", "yu", "ze"}
+
+// Calls the function with the generated names of one million users
+func millionUsernames(add func(userId uint32, username string)) {
+	random := rand.New(rand.NewSource(1))
+	for i := uint32(1); i <= 1000000; i++ {
+		name := ""
+		for j := 0; j < 2+random.Intn(3); j++ {
+			name += syllables[random.Intn(len(syllables))]
+		}
+		add(i, name+fmt.Sprint(random.Intn(1000)))
+	}
+	add(1000001, "Mabergu7")
+}
+
+// Builds the index of one million users once for all benchmarks
+func millionUserIndex() *database.SearchIndex {
+	if benchmarkIndex != nil {
+		return benchmarkIndex
+	}
+	benchmarkIndex = database.NewSearchIndex()
+	millionUsernames(benchmarkIndex.Add)
+	return benchmarkIndex
+}
+
+func benchmarkSearch(b *testing.B, search string) {
+	index := millionUserIndex()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Search(search, 0, database.SEARCH_DEFAULT_LIMIT)
+	}
+}
+
+func BenchmarkSearchExact(b *testing.B) {
+	benchmarkSearch(b, "mabergu7")
+}
+
+func BenchmarkSearchPrefix(b *testing.B) {
+	benchmarkSearch(b, "maber")
+}
+
+func BenchmarkSearchSubstring(b *testing.B) {
+	benchmarkSearch(b, "elfa")
+}
+
+func BenchmarkSearchShort(b *testing.B) {
+	benchmarkSearch(b, "ze")
+}
+
+func BenchmarkSearchAdd(b *testing.B) {
+	index := millionUserIndex()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Add(2000000, fmt.Sprintf("benchmark%d", i))
+	}
+	b.StopTimer()
+	index.Remove(2000000)
+}
+
+// Searches through the database of one million users the way a search packet
+// does, including the visibility checks of every result
+func BenchmarkSearchUsers(b *testing.B) {
+	users := make([]apollontypes.User, 0, 1000001)
+	millionUsernames(func(userId uint32, username string) {
+		users = append(users, apollontypes.User{UserId: userId, Username: username})
+	})
+	content, err := json.Marshal(users)
+	if err != nil {
+		b.FailNow()
+	}
+	file := filepath.Join(b.TempDir(), "database.json")
+	err = os.WriteFile(file, content, 0644)
+	if err != nil {
+		b.FailNow()
+	}
+	database.SetDatabaseLocation(file)
+	defer func() {
+		database.SetDatabaseLocation(databaseLocation)
+		database.Clear()
+	}()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	// The users are read once by the first search
+	database.SearchUsers("maber", 1, 0, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		database.SearchUsers("maber", 1, 0, 0)
+	}
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Rules new usernames and renames have to follow. Letters and digits are
+// always allowed, other characters only if they are listed as symbols.
+type UsernameRules struct {
+	MinLength         int
+	MaxLength         int
+	AllowedSymbols    string
+	DetectConfusables bool
+	Unique            bool
+}
+
+var usernameRules = UsernameRules{
+	MinLength:         3,
+	MaxLength:         32,
+	AllowedSymbols:    " _-.",
+	DetectConfusables: true,
+	Unique:            false,
+}
+
+// Users by the skeleton of their username, used to find names that only
+// differ in characters that look alike
+var usernameSkeletons = make(map[string][]uint32)
+
+// Characters that are rendered like latin characters. As upper case I and
+// lower case l look the same in most fonts, all of them are mapped to l.
+var confusableCharacters = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x',
+	'ѕ': 's', 'і': 'l', 'ј': 'j', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	'0': 'o', '1': 'l', '|': 'l', '5': 's', 'i': 'l',
+}
+
+func SetUsernameRules(rules UsernameRules) {
+	usernameRules = rules
+}
+
+// Composes accents with their letters, trims the username, collapses repeated
+// spaces and checks it against the username rules. Returns the username that
+// should be stored.
+func NormalizeUsername(username string) (string, error) {
+	if !utf8.ValidString(username) {
+		return "", errors.New("invalid encoding")
+	}
+	username = norm.NFC.String(username)
+	username = strings.Join(strings.FieldsFunc(username, unicode.IsSpace), " ")
+	err := checkCombiningMarks(username)
+	if err != nil {
+		return "", err
+	}
+
+	length := 0
+	visible := 0
+	scripts := make(map[string]bool)
+	for _, char := range username {
+		switch {
+		case unicode.Is(unicode.Mn, char):
+			// Accents belong to the letter before them
+			continue
+		case unicode.IsLetter(char):
+			visible++
+			scripts[letterScript(char)] = true
+		case unicode.IsDigit(char):
+			visible++
+		case char == ' ':
+		case strings.ContainsRune(usernameRules.AllowedSymbols, char):
+			if !unicode.IsGraphic(char) {
+				return "", errors.New("invisible character")
+			}
+		default:
+			return "", errors.New("character not allowed")
+		}
+		length++
+	}
+	if visible == 0 {
+		return "", errors.New("empty username")
+	}
+	if length < usernameRules.MinLength {
+		return "", errors.New("username too short")
+	}
+	if usernameRules.MaxLength > 0 && length > usernameRules.MaxLength {
+		return "", errors.New("username too long")
+	}
+	if usernameRules.DetectConfusables && len(scripts) > 1 {
+		return "", errors.New("username mixes scripts")
+	}
+	return username, nil
+}
+
+// Accents following a letter, too many of them hide the letter. The accents of
+// composed letters count as well.
+func checkCombiningMarks(username string) error {
+	marks := 0
+	first := true
+	for _, char := range norm.NFD.String(username) {
+		if !unicode.Is(unicode.Mn, char) {
+			first = false
+			marks = 0
+			continue
+		}
+		marks++
+		if marks > 2 || first {
+			return errors.New("too many combining characters")
+		}
+	}
+	return nil
+}
+
+func letterScript(char rune) string {
+	for _, script := range []string{"Latin", "Cyrillic", "Greek"} {
+		if unicode.Is(unicode.Scripts[script], char) {
+			return script
+		}
+	}
+	return "Other"
+}
+
+// Reduces the username to the characters it looks like. Names with the same
+// skeleton are hard to tell apart.
+func UsernameSkeleton(username string) string {
+	return strings.Map(func(char rune) rune {
+		if replacement, exists := confusableCharacters[char]; exists {
+			return replacement
+		}
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) {
+			return -1
+		}
+		return char
+	}, FoldName(username))
+}
+
+// Checks that no other user has a username that looks like the given one.
+// Only enforced if usernames have to be unique.
+func UsernameAvailable(username string, userId uint32) error {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	loadDatabase()
+	return usernameAvailable(username, userId)
+}
+
+func usernameAvailable(username string, userId uint32) error {
+	if !usernameRules.Unique {
+		return nil
+	}
+	for _, v := range usernameSkeletons[UsernameSkeleton(username)] {
+		if v != userId {
+			log.Printf("Username \"%s\" is already taken by %d", username, v)
+			return errors.New("username already taken")
+		}
+	}
+	return nil
+}
+
+// Changes the username of the user. Returns the normalized username.
+func RenameUser(userId uint32, username string) (string, error) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	loadDatabase()
+	user, exists := database[userId]
+	if !exists {
+		return "", errors.New("user not found")
+	}
+	username, err := NormalizeUsername(username)
+	if err != nil {
+		return "", err
+	}
+	err = usernameAvailable(username, userId)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Renaming %d from \"%s\" to \"%s\"", userId, user.Username, username)
+	user.Username = username
+	return username, updateUser(user)
+}
+
+// Adds the username to the search index and the skeletons. The lock of the
+// users has to be held.
+func indexUsername(userId uint32, username string) {
+	searchIndex.Add(userId, username)
+	skeleton := UsernameSkeleton(username)
+	if !containsId(usernameSkeletons[skeleton], userId) {
+		usernameSkeletons[skeleton] = append(usernameSkeletons[skeleton], userId)
+	}
+}
+
+func unindexUsername(userId uint32, username string) {
+	searchIndex.Remove(userId)
+	skeleton := UsernameSkeleton(username)
+	usernameSkeletons[skeleton] = removeId(usernameSkeletons[skeleton], userId)
+	if len(usernameSkeletons[skeleton]) == 0 {
+		delete(usernameSkeletons, skeleton)
+	}
+}
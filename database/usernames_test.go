@@ -0,0 +1,91 @@
+package database_test
+
+import (
+	"testing"
+
+	"anzu.cloudsheeptech.com/apollontypes"
+	"anzu.cloudsheeptech.com/database"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	username, err := database.NormalizeUsername("  Zoë   Example ")
+	if err != nil || username != "Zoë Example" {
+		t.Fatalf("Incorrect normalized username \"%s\": %s", username, err)
+	}
+	// Decomposed accents are stored like the composed ones
+	username, err = database.NormalizeUsername("Zoe\u0308 Example")
+	if err != nil || username != "Zoë Example" {
+		t.Fatalf("Decomposed username was not composed \"%s\": %s", username, err)
+	}
+	rejected := []string{
+		"",
+		"\u200b\u200b\u200b",
+		"   ",
+		"ab",
+		"name\x00",
+		"na*me",
+		"p\u0430ypal",
+		"a\u0301\u0301\u0301bc",
+		"averyveryveryveryverylongusername",
+	}
+	for _, v := range rejected {
+		_, err := database.NormalizeUsername(v)
+		if err == nil {
+			t.Fatalf("Username %q was accepted", v)
+		}
+	}
+	if database.UsernameSkeleton("AIice") != database.UsernameSkeleton("alice") || database.UsernameSkeleton("Bob_1") != database.UsernameSkeleton("bobl") {
+		t.FailNow()
+	}
+	if database.UsernameSkeleton("ａｌｉｃｅ") != database.UsernameSkeleton("alice") {
+		t.Fatalf("Fullwidth username has its own skeleton")
+	}
+}
+
+func TestUniqueUsernames(t *testing.T) {
+	database.Delete()
+	rules := database.UsernameRules{MinLength: 3, MaxLength: 32, AllowedSymbols: " _-.", DetectConfusables: true, Unique: true}
+	database.SetUsernameRules(rules)
+	defer func() {
+		rules.Unique = false
+		database.SetUsernameRules(rules)
+	}()
+
+	if database.StoreUserInDatabase(apollontypes.User{Username: "Alice", UserId: 1}) != nil {
+		t.FailNow()
+	}
+	if database.StoreUserInDatabase(apollontypes.User{Username: "AIICE", UserId: 2}) == nil {
+		t.Fatalf("Confusable username was accepted")
+	}
+	if database.StoreUserInDatabase(apollontypes.User{Username: "Ａｌｉｃｅ", UserId: 2}) == nil {
+		t.Fatalf("Fullwidth username was accepted")
+	}
+	if database.StoreUserInDatabase(apollontypes.User{Username: "Zoe\u0308", UserId: 4}) != nil {
+		t.FailNow()
+	}
+	if database.StoreUserInDatabase(apollontypes.User{Username: "Zoë", UserId: 5}) == nil {
+		t.Fatalf("Decomposed username was not recognized")
+	}
+	if database.StoreUserInDatabase(apollontypes.User{Username: "Bob", UserId: 2}) != nil {
+		t.FailNow()
+	}
+	if _, err := database.RenameUser(2, "alice"); err == nil {
+		t.Fatalf("Rename to taken username was accepted")
+	}
+
+	// The old name is free again after the rename
+	username, err := database.RenameUser(1, "  Alicia ")
+	if err != nil || username != "Alicia" {
+		t.Fatalf("Failed to rename: %s", err)
+	}
+	if _, err := database.RenameUser(2, "Alice"); err != nil {
+		t.Fatalf("Failed to rename to free username: %s", err)
+	}
+	users, _ := database.SearchUsers("alic", 3, 0, 0)
+	if len(users) != 2 || users[0].Username != "Alicia" || users[1].Username != "Alice" {
+		t.Fatalf("Search did not find renamed users: %+v", users)
+	}
+	if users, _ := database.SearchUsers("bob", 3, 0, 0); len(users) != 0 {
+		t.Fatalf("Search found old username")
+	}
+}
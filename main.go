@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"anzu.cloudsheeptech.com/configuration"
 	"anzu.cloudsheeptech.com/server"
@@ -24,6 +25,31 @@ func main() {
 	tlsKeyfile := flag.String("k", "resources/apollon.key", "The location of the TLS key")
 	databaseFile := flag.String("d", "database.json", "The location of the database JSON file")
 	databaseNoWrite := flag.Bool("n", false, "If set, changes will not be written to database file")
+	fileDirectory := flag.String("f", "files", "The directory in which uploaded files are stored")
+	fileGCInterval := flag.Duration("g", time.Hour, "Interval in which unreferenced files and expired messages are removed")
+	maxImageDimension := flag.Int("m", 512, "Maximal width and height of profile images")
+	usernameMinLength := flag.Int("un", 3, "Minimal length of usernames")
+	usernameMaxLength := flag.Int("ux", 32, "Maximal length of usernames")
+	usernameSymbols := flag.String("us", " _-.", "Characters allowed in usernames besides letters and digits")
+	uniqueUsernames := flag.Bool("uu", false, "Reject usernames that look like existing usernames")
+	detectConfusables := flag.Bool("uc", true, "Reject usernames mixing scripts")
+	adminToken := flag.String("at", "", "Token for the admin endpoints of the Rest API, disabled if empty")
+	noise := flag.Bool("x", false, "Enable the Noise listener")
+	noisePort := flag.String("np", "50003", "Noise listen port")
+	noiseKeyfile := flag.String("nk", "resources/apollon.noise", "The location of the static Noise key")
+	noiseCreateKey := flag.Bool("nc", false, "Create a new static Noise key if the key file is missing")
+	dedupWindow := flag.Duration("dw", 24*time.Hour, "Time in which resent messages are recognized as duplicates")
+	dedupSize := flag.Int("ds", 1000, "Number of messages per user remembered to recognize duplicates")
+	rateLimits := flag.String("rl", "", "Rate limits per packet as category.type=rate/burst separated by commas, a rate of 0 removes the limit")
+	maxFrameSize := flag.Int("fm", 64*1024, "Maximal size of packets in bytes without an own limit")
+	frameLimits := flag.String("fl", "", "Maximal packet sizes as category.type=bytes separated by commas")
+	maxConnections := flag.Int("mc", 10000, "Maximal number of open connections, 0 for no limit")
+	maxHostConnections := flag.Int("mh", 100, "Maximal number of open connections per remote host, 0 for no limit")
+	loginTimeout := flag.Duration("lt", 30*time.Second, "Time in which new connections have to log in")
+	outboundQueueSize := flag.Int("oq", 256, "Number of packets waiting for a client before it is disconnected")
+	writeTimeout := flag.Duration("wt", 10*time.Second, "Time a client has to take a packet before it is disconnected")
+	deliveryTimeout := flag.Duration("dt", 30*time.Second, "Time a client has to confirm a text before it is moved to the mailbox")
+	historyRetention := flag.Duration("hr", 30*24*time.Hour, "Time messages, their receipts and files that were not downloaded are kept")
 	flag.Parse()
 
 	configuration := configuration.Config{
@@ -39,6 +65,31 @@ func main() {
 		CertificateKeyfile: *tlsKeyfile,
 		DatabaseFile:       *databaseFile,
 		DatabaseNoWrite:    *databaseNoWrite,
+		FileDirectory:      *fileDirectory,
+		FileGCInterval:     *fileGCInterval,
+		MaxImageDimension:  *maxImageDimension,
+		UsernameMinLength:  *usernameMinLength,
+		UsernameMaxLength:  *usernameMaxLength,
+		UsernameSymbols:    *usernameSymbols,
+		UniqueUsernames:    *uniqueUsernames,
+		DetectConfusables:  *detectConfusables,
+		AdminToken:         *adminToken,
+		Noise:              *noise,
+		NoiseListenPort:    *noisePort,
+		NoiseKeyfile:       *noiseKeyfile,
+		NoiseCreateKey:     *noiseCreateKey,
+		DedupWindow:        *dedupWindow,
+		DedupSize:          *dedupSize,
+		RateLimits:         *rateLimits,
+		MaxFrameSize:       *maxFrameSize,
+		FrameLimits:        *frameLimits,
+		MaxConnections:     *maxConnections,
+		MaxHostConnections: *maxHostConnections,
+		LoginTimeout:       *loginTimeout,
+		OutboundQueueSize:  *outboundQueueSize,
+		WriteTimeout:       *writeTimeout,
+		DeliveryTimeout:    *deliveryTimeout,
+		HistoryRetention:   *historyRetention,
 	}
 
 	setupLogger(*logfile)
@@ -0,0 +1,184 @@
+package packets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+)
+
+// Compression algorithms that can be negotiated for a connection
+const (
+	COMPRESSION_NONE = "None"
+	COMPRESSION_GZIP = "gzip"
+)
+
+// Decompressed payloads larger than this are rejected, so that small
+// compressed packets cannot exhaust the memory of the server
+var MAX_DECOMPRESSED_SIZE int = 16 * 1024 * 1024
+
+type Compressor struct {
+	Compress   func([]byte) ([]byte, error)
+	Decompress func([]byte) ([]byte, error)
+}
+
+var compressors = map[string]Compressor{
+	COMPRESSION_GZIP: {
+		Compress:   gzipCompress,
+		Decompress: gzipDecompress,
+	},
+}
+
+// Algorithms in the order the server prefers them
+var compressionPreference = []string{COMPRESSION_GZIP}
+
+// Allows to add further algorithms (like zstd) in builds that ship an
+// implementation. Registered algorithms are preferred over gzip.
+func RegisterCompression(name string, compressor Compressor) {
+	if _, exists := compressors[name]; !exists {
+		compressionPreference = append([]string{name}, compressionPreference...)
+	}
+	compressors[name] = compressor
+}
+
+func CompressionSupported(compression string) bool {
+	if compression == "" || compression == COMPRESSION_NONE {
+		return true
+	}
+	_, exists := compressors[compression]
+	return exists
+}
+
+func SupportedCompressions() []string {
+	supported := make([]string, 0, len(compressors))
+	for _, v := range compressionPreference {
+		if _, exists := compressors[v]; exists {
+			supported = append(supported, v)
+		}
+	}
+	return supported
+}
+
+// Picks the preferred algorithm out of the ones offered by the client
+func NegotiateCompression(offered []string) string {
+	for _, preferred := range SupportedCompressions() {
+		for _, v := range offered {
+			if v == preferred {
+				return preferred
+			}
+		}
+	}
+	return COMPRESSION_NONE
+}
+
+// Compresses the payload of an already serialized packet. Because packets are
+// separated by a newline the compressed payload is base64 encoded.
+func CompressPacket(packet []byte, compression string) ([]byte, error) {
+	if compression == "" || compression == COMPRESSION_NONE {
+		return packet, nil
+	}
+	if len(packet) < 11 {
+		return nil, errors.New("packet too short")
+	}
+	payload := packet[10 : len(packet)-1]
+	if len(payload) == 0 {
+		return packet, nil
+	}
+	compressed, err := CompressPayload(payload, compression)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 0, 10+len(compressed)+1)
+	result = append(result, packet[:10]...)
+	result = append(result, compressed...)
+	result = append(result, []byte("\n")...)
+	return result, nil
+}
+
+func CompressPayload(payload []byte, compression string) ([]byte, error) {
+	compressor, exists := compressors[compression]
+	if !exists {
+		log.Printf("Compression \"%s\" not supported", compression)
+		return nil, errors.New("unsupported compression")
+	}
+	compressed, err := compressor.Compress(payload)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(compressed)))
+	base64.StdEncoding.Encode(encoded, compressed)
+	return encoded, nil
+}
+
+func DecompressPayload(payload []byte, compression string) ([]byte, error) {
+	if compression == "" || compression == COMPRESSION_NONE {
+		return payload, nil
+	}
+	payload = bytes.TrimSuffix(payload, []byte("\n"))
+	if len(payload) == 0 {
+		return payload, nil
+	}
+	compressor, exists := compressors[compression]
+	if !exists {
+		log.Printf("Compression \"%s\" not supported", compression)
+		return nil, errors.New("unsupported compression")
+	}
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+	read, err := base64.StdEncoding.Decode(decoded, payload)
+	if err != nil {
+		log.Printf("Failed to decode compressed payload")
+		return nil, err
+	}
+	return compressor.Decompress(decoded[:read])
+}
+
+// Checks that the compression of a file transfer is one the server knows and
+// that the announced lengths fit the compression
+func CheckFileCompression(fileInfo FileInfo) error {
+	if !CompressionSupported(fileInfo.Compression) {
+		log.Printf("File compression \"%s\" not supported", fileInfo.Compression)
+		return errors.New("unsupported compression")
+	}
+	if fileInfo.Compression == "" || fileInfo.Compression == COMPRESSION_NONE {
+		if fileInfo.CompressedLength != 0 && fileInfo.CompressedLength != fileInfo.FileLength {
+			return errors.New("compressed length without compression")
+		}
+		return nil
+	}
+	if fileInfo.CompressedLength == 0 {
+		return errors.New("missing compressed length")
+	}
+	return nil
+}
+
+func gzipCompress(payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(payload)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func gzipDecompress(payload []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(reader, int64(MAX_DECOMPRESSED_SIZE)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > MAX_DECOMPRESSED_SIZE {
+		return nil, errors.New("decompressed payload too large")
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,143 @@
+package packets_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"anzu.cloudsheeptech.com/packets"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	chosen := packets.NegotiateCompression([]string{"brotli", packets.COMPRESSION_GZIP})
+	if chosen != packets.COMPRESSION_GZIP {
+		fmt.Printf("Expected gzip, got %s\n", chosen)
+		t.Fail()
+	}
+	chosen = packets.NegotiateCompression([]string{"brotli"})
+	if chosen != packets.COMPRESSION_NONE {
+		fmt.Printf("Expected no compression, got %s\n", chosen)
+		t.Fail()
+	}
+	chosen = packets.NegotiateCompression(nil)
+	if chosen != packets.COMPRESSION_NONE {
+		t.Fail()
+	}
+	// Only algorithms with an implementation are negotiated
+	chosen = packets.NegotiateCompression([]string{"zstd", packets.COMPRESSION_GZIP})
+	if chosen != packets.COMPRESSION_GZIP || !reflect.DeepEqual(packets.SupportedCompressions(), []string{packets.COMPRESSION_GZIP}) {
+		fmt.Printf("Expected gzip, got %s out of %v\n", chosen, packets.SupportedCompressions())
+		t.Fail()
+	}
+}
+
+func TestRegisterCompression(t *testing.T) {
+	identity := func(payload []byte) ([]byte, error) {
+		return payload, nil
+	}
+	packets.RegisterCompression("identity", packets.Compressor{Compress: identity, Decompress: identity})
+	chosen := packets.NegotiateCompression([]string{packets.COMPRESSION_GZIP, "identity"})
+	if chosen != "identity" || !packets.CompressionSupported("identity") {
+		fmt.Printf("Expected the registered compression, got %s\n", chosen)
+		t.Fail()
+	}
+}
+
+func TestCompressPacket(t *testing.T) {
+	header, info := packets.CreateContactInfo(1234, 4321, "Cloudsheep", bytes.Repeat([]byte{0x01, 0x02}, 4096), nil)
+	raw, err := packets.SerializePacket(header, info)
+	if err != nil {
+		t.FailNow()
+	}
+	compressed, err := packets.CompressPacket(raw, packets.COMPRESSION_GZIP)
+	if err != nil {
+		fmt.Printf("Failed to compress packet: %s\n", err)
+		t.FailNow()
+	}
+	if len(compressed) >= len(raw) {
+		fmt.Printf("Compressed packet not smaller: %d >= %d\n", len(compressed), len(raw))
+		t.Fail()
+	}
+	if !reflect.DeepEqual(compressed[:10], raw[:10]) {
+		fmt.Printf("Header must not be compressed!\n")
+		t.Fail()
+	}
+	// The packet separator must not be part of the compressed payload
+	if bytes.IndexByte(compressed[10:], '\n') != len(compressed)-11 {
+		fmt.Printf("Compressed payload contains a newline!\n")
+		t.Fail()
+	}
+	payload, err := packets.DecompressPayload(compressed[10:], packets.COMPRESSION_GZIP)
+	if err != nil {
+		fmt.Printf("Failed to decompress payload: %s\n", err)
+		t.FailNow()
+	}
+	decoded, err := packets.DeseralizePacket[packets.ContactInfo](payload)
+	if err != nil || !reflect.DeepEqual(decoded, info) {
+		fmt.Printf("Decompressed packet does not match!\n")
+		t.Fail()
+	}
+
+	// Header only packets stay the same
+	ack := packets.CreateContactInfoAck(1234, 4321)
+	raw, _ = packets.SerializePacket(ack, nil)
+	compressed, err = packets.CompressPacket(raw, packets.COMPRESSION_GZIP)
+	if err != nil || !reflect.DeepEqual(raw, compressed) {
+		fmt.Printf("Header only packet was modified!\n")
+		t.Fail()
+	}
+
+	header, text := packets.CreateText(1234, 4321, 9988, "Testing unknown compression")
+	raw, _ = packets.SerializePacket(header, text)
+	_, err = packets.CompressPacket(raw, "brotli")
+	if err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fail()
+	}
+}
+
+func TestCheckFileCompression(t *testing.T) {
+	_, info := packets.CreateFileInfo(1234, 4321, "video.mp4", 2048, 0, packets.COMPRESSION_GZIP, 1024)
+	if packets.CheckFileCompression(info) != nil {
+		t.Fail()
+	}
+	info.CompressedLength = 0
+	if packets.CheckFileCompression(info) == nil {
+		fmt.Printf("Missing compressed length accepted!\n")
+		t.Fail()
+	}
+	info.Compression = "rar"
+	info.CompressedLength = 1024
+	if packets.CheckFileCompression(info) == nil {
+		fmt.Printf("Unknown compression accepted!\n")
+		t.Fail()
+	}
+	info.Compression = packets.COMPRESSION_NONE
+	if packets.CheckFileCompression(info) == nil {
+		fmt.Printf("Compressed length without compression accepted!\n")
+		t.Fail()
+	}
+	info.CompressedLength = 0
+	if packets.CheckFileCompression(info) != nil {
+		t.Fail()
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	defer func(size int) { packets.MAX_DECOMPRESSED_SIZE = size }(packets.MAX_DECOMPRESSED_SIZE)
+	packets.MAX_DECOMPRESSED_SIZE = 1024
+	compressed, err := packets.CompressPayload(bytes.Repeat([]byte("a"), 1024), packets.COMPRESSION_GZIP)
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err := packets.DecompressPayload(compressed, packets.COMPRESSION_GZIP); err != nil {
+		fmt.Printf("Payload within the limit was rejected: %s\n", err)
+		t.FailNow()
+	}
+	compressed, _ = packets.CompressPayload(bytes.Repeat([]byte("a"), 1025), packets.COMPRESSION_GZIP)
+	if _, err := packets.DecompressPayload(compressed, packets.COMPRESSION_GZIP); err == nil {
+		fmt.Println("Oversized payload was decompressed")
+		t.FailNow()
+	}
+}
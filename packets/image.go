@@ -0,0 +1,29 @@
+package packets
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Image formats that are accepted for profile images
+const (
+	IMAGE_JPEG = "jpeg"
+	IMAGE_PNG  = "png"
+	IMAGE_GIF  = "gif"
+)
+
+// Detects the format from the image data instead of trusting the name given
+// by the client. Unknown formats result in an empty string.
+func DetectImageFormat(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	return format
+}
@@ -28,6 +28,27 @@ const (
 	CON_LOGIN        = 5
 	CON_CONTACT_INFO = 6
 	CON_CONTACT_ACK  = 7
+	CON_NEGOTIATE    = 8
+	CON_ERROR        = 9
+	// 10 is skipped, the newline would split the header of the packet
+	CON_GROUP_CREATE = 11
+	CON_GROUP_INVITE = 12
+	CON_GROUP_JOIN   = 13
+	CON_GROUP_LEAVE  = 14
+	CON_GROUP_KICK   = 15
+	CON_GROUP_RENAME = 16
+	CON_GROUP_ADMIN  = 17
+	CON_GROUP_INFO   = 18
+	CON_PRESENCE     = 19
+	CON_PRESENCE_REQ = 20
+	CON_CONTACT_UPD  = 21
+	CON_PRIVACY      = 22
+	CON_PROFILE      = 23
+	CON_RENAME       = 24
+	CON_DELETE       = 25
+	CON_KEYS         = 26
+	CON_KEY_BUNDLE   = 27
+	CON_KEY_CHANGE   = 28
 )
 
 // Data types
@@ -38,10 +59,65 @@ const (
 	D_FILE_HAVE = 4
 	D_FILE      = 5
 	D_FILE_ACK  = 6
+	D_FILE_REQ  = 7
+	// Receipts sent by the recipient of a text
+	D_TEXT_DELIVERED = 8
+	D_TEXT_READ      = 9
+	// 10 is skipped, the newline would split the header of the packet
+	D_TEXT_STATUS = 11
+	// Changes or removes a text sent before
+	D_TEXT_EDIT   = 12
+	D_TEXT_DELETE = 13
+	// Fetches the messages of a conversation after a sequence number
+	D_SYNC = 14
+)
+
+// Delivery state of a text for one recipient. The state only moves forward.
+const (
+	STATUS_UNKNOWN   = 0
+	STATUS_ACCEPTED  = 1
+	STATUS_DELIVERED = 2
+	STATUS_READ      = 3
+)
+
+// Changes of the contact list pushed by the server
+const (
+	CONTACT_ADDED   = "Added"
+	CONTACT_REMOVED = "Removed"
+	CONTACT_RENAMED = "Renamed"
+	CONTACT_DELETED = "Deleted"
+)
+
+// Privacy settings and the values they can be set to
+const (
+	PRIVACY_MESSAGES = "Messages"
+	PRIVACY_SEARCH   = "Search"
+	PRIVACY_PRESENCE = "Presence"
+	PRIVACY_IMAGE    = "ProfileImage"
+	PRIVACY_EVERYONE = "Everyone"
+	PRIVACY_CONTACTS = "Contacts"
+	PRIVACY_NOBODY   = "Nobody"
+)
+
+// Error codes
+const (
+	ERR_UNKNOWN     = 0
+	ERR_COMPRESSION = 1
+	ERR_GROUP       = 2
+	ERR_RECEIPT     = 3
+	ERR_CONTACT     = 4
+	ERR_PRIVACY     = 5
+	ERR_IMAGE       = 6
+	ERR_USERNAME    = 7
+	ERR_KEYS        = 8
+	ERR_MESSAGE     = 9
+	ERR_THROTTLED   = 10
+	ERR_FRAME_SIZE  = 11
+	ERR_ADMISSION   = 12
 )
 
 type Packet interface {
-	Create | Search | Contact | ContactList | ContactOption | Text | TextAck | Header | ContactInfo | FileInfo | FileHave
+	Create | Search | Contact | ContactList | ContactOption | Text | TextAck | TextStatus | TextEdit | Sync | Header | ContactInfo | FileInfo | FileHave | File | FileRequest | Negotiate | Error | GroupAction | GroupInfo | Presence | PresenceList | ContactUpdate | PrivacySettings | ProfileRequest | Profile | KeyUpload | KeyStatus | KeyBundle
 }
 
 type Header struct {
@@ -51,12 +127,26 @@ type Header struct {
 	MessageId uint32
 }
 
+type Negotiate struct {
+	Compression []string
+}
+
+type Error struct {
+	Code    uint32
+	Message string
+}
+
 type Create struct {
 	Username string
 }
 
+// Searches users by their name. The answer contains at most limit users, a
+// limit of 0 uses the default of the server. To fetch the next page the cursor
+// of the previous answer is sent.
 type Search struct {
 	UserIdentifier string
+	Limit          uint32
+	Cursor         uint64
 }
 
 type Contact struct {
@@ -64,8 +154,77 @@ type Contact struct {
 	Username string
 }
 
+// The presence is only filled if the list contains the contacts of the user
+// and holds the presence of the contact at the same index. The cursor is only
+// set if the list answers a search with more results.
 type ContactList struct {
-	Contacts []Contact
+	Contacts   []Contact
+	Presence   []Presence
+	NextCursor uint64
+}
+
+// Changes the given privacy settings of the user. The server answers with all
+// settings, therefore an empty list only queries the current settings.
+type PrivacySettings struct {
+	Settings []Option
+}
+
+// Requests the profile stored on the server. The profile is only sent if it
+// changed since the given version, zero always returns the profile.
+type ProfileRequest struct {
+	ContactUserId uint32
+	Version       uint64
+}
+
+// X25519 public key for a single key exchange, signed by the identity key
+type PreKey struct {
+	KeyId     uint32
+	Key       []byte
+	Signature []byte
+}
+
+// Publishes the keys of the user. The identity key is an Ed25519 key that
+// signs the X25519 exchange key and the prekeys. Uploading the same identity
+// key again adds the prekeys, an empty exchange key keeps the stored one.
+type KeyUpload struct {
+	IdentityKey       []byte
+	ExchangeKey       []byte
+	ExchangeSignature []byte
+	PreKeys           []PreKey
+}
+
+// Answer to an upload with the number of prekeys the server still holds
+type KeyStatus struct {
+	PreKeys uint32
+}
+
+// Keys needed to start an encrypted conversation with the contact. Requests
+// only fill the contact ID. Every bundle carries another prekey as long as
+// there are prekeys left. Key change notifications only carry the identity key.
+type KeyBundle struct {
+	ContactUserId     uint32
+	IdentityKey       []byte
+	ExchangeKey       []byte
+	ExchangeSignature []byte
+	PreKey            PreKey
+}
+
+// Answer to a profile request. If the profile did not change since the
+// requested version only the current version is filled.
+type Profile struct {
+	ContactUserId uint32
+	Version       uint64
+	Changed       bool
+	Username      string
+	ImageFormat   string
+	Image         []byte
+}
+
+// A single change of the contact list of the user
+type ContactUpdate struct {
+	Change   string
+	Contact  Contact
+	Presence Presence
 }
 
 type Option struct {
@@ -86,15 +245,98 @@ type ContactInfo struct {
 	Image       []byte
 }
 
+type GroupAction struct {
+	GroupId uint32
+	UserId  uint32
+	Name    string
+}
+
+type GroupInfo struct {
+	GroupId uint32
+	Name    string
+	Owner   uint32
+	Admins  []uint32
+	Members []uint32
+}
+
+// Presence of a contact. LastSeen is the time the contact went offline in
+// milliseconds since epoch and zero if unknown or hidden.
+type Presence struct {
+	ContactUserId uint32
+	Online        bool
+	LastSeen      uint64
+}
+
+// Requests the presence of the given contacts, the answer contains the
+// presence of every contact that is allowed to be seen
+type PresenceList struct {
+	ContactIds []uint32
+	Presence   []Presence
+}
+
+// Texts of clients using end-to-end encryption leave the message empty and
+// carry the encrypted message in the ciphertext. The server relays the
+// ciphertext without looking at it.
 type Text struct {
 	ContactUserId uint32
+	GroupId       uint32
 	Timestamp     uint64
 	Message       string
+	Ciphertext    []byte
+	// Time of the last edit, zero if the text was never edited
+	Edited uint64
+	// Position in the conversation and time in milliseconds at which the
+	// server accepted the text. Both are assigned by the server.
+	Sequence        uint64
+	ServerTimestamp uint64
 }
 
+// Changes or deletes a text. MessageId references the text of the sender, the
+// new content is left empty for deletes.
+type TextEdit struct {
+	ContactUserId   uint32
+	GroupId         uint32
+	MessageId       uint32
+	Timestamp       uint64
+	Message         string
+	Ciphertext      []byte
+	Sequence        uint64
+	ServerTimestamp uint64
+}
+
+// Receipt for a text. MessageId references the text the receipt belongs to and
+// the timestamp is given in milliseconds since epoch. The server-accepted
+// receipt carries the sequence number assigned to the text.
 type TextAck struct {
 	ContactUserId uint32
-	Timestamp     string
+	MessageId     uint32
+	Timestamp     uint64
+	Sequence      uint64
+}
+
+// Requests the messages of the conversation with the contact or the group that
+// have a sequence number after the given one. The server sends the stored
+// packets and answers with the sequence number of the last sent message. More
+// is set if further messages are left.
+type Sync struct {
+	ContactUserId uint32
+	GroupId       uint32
+	After         uint64
+	Limit         uint32
+	More          bool
+}
+
+type TextReceipt struct {
+	ContactUserId uint32
+	Status        byte
+	Timestamp     uint64
+}
+
+// Query for the delivery state of a text. The answer contains the state for
+// every recipient of the text.
+type TextStatus struct {
+	MessageId uint32
+	Receipts  []TextReceipt
 }
 
 type FileInfo struct {
@@ -106,12 +348,23 @@ type FileInfo struct {
 	Compression      string
 	CompressedLength uint32
 	FileHash         int64
+	ContentHash      string
 }
 
 type FileHave struct {
 	FileOffset uint64
 }
 
+type File struct {
+	FileOffset uint64
+	Data       []byte
+}
+
+type FileRequest struct {
+	ContentHash string
+	FileOffset  uint64
+}
+
 func PacketType(packet []byte) (int, int, error) {
 	valid := json.Valid(packet)
 	if !valid {
@@ -156,6 +409,45 @@ func PacketType(packet []byte) (int, int, error) {
 		case CON_CONTACT_ACK:
 			log.Print("Info")
 			return CAT_CONTACT, CON_CONTACT_ACK, nil
+		case CON_NEGOTIATE:
+			log.Print("Negotiate")
+			return CAT_CONTACT, CON_NEGOTIATE, nil
+		case CON_ERROR:
+			log.Print("Error")
+			return CAT_CONTACT, CON_ERROR, nil
+		case CON_GROUP_CREATE, CON_GROUP_INVITE, CON_GROUP_JOIN, CON_GROUP_LEAVE, CON_GROUP_KICK, CON_GROUP_RENAME, CON_GROUP_ADMIN, CON_GROUP_INFO:
+			log.Print("Group")
+			return CAT_CONTACT, typ, nil
+		case CON_PRESENCE:
+			log.Print("Presence")
+			return CAT_CONTACT, CON_PRESENCE, nil
+		case CON_PRESENCE_REQ:
+			log.Print("Presence Request")
+			return CAT_CONTACT, CON_PRESENCE_REQ, nil
+		case CON_CONTACT_UPD:
+			log.Print("Contact Update")
+			return CAT_CONTACT, CON_CONTACT_UPD, nil
+		case CON_PRIVACY:
+			log.Print("Privacy")
+			return CAT_CONTACT, CON_PRIVACY, nil
+		case CON_PROFILE:
+			log.Print("Profile")
+			return CAT_CONTACT, CON_PROFILE, nil
+		case CON_RENAME:
+			log.Print("Rename")
+			return CAT_CONTACT, CON_RENAME, nil
+		case CON_DELETE:
+			log.Print("Delete")
+			return CAT_CONTACT, CON_DELETE, nil
+		case CON_KEYS:
+			log.Print("Keys")
+			return CAT_CONTACT, CON_KEYS, nil
+		case CON_KEY_BUNDLE:
+			log.Print("Key Bundle")
+			return CAT_CONTACT, CON_KEY_BUNDLE, nil
+		case CON_KEY_CHANGE:
+			log.Print("Key Change")
+			return CAT_CONTACT, CON_KEY_CHANGE, nil
 		default:
 			log.Printf("Unknown type %d", typ)
 			return NONE, NONE, errors.New("unknown type")
@@ -181,6 +473,27 @@ func PacketType(packet []byte) (int, int, error) {
 		case D_FILE_ACK:
 			log.Print("File Ack")
 			return CAT_DATA, D_FILE_ACK, nil
+		case D_FILE_REQ:
+			log.Print("File Request")
+			return CAT_DATA, D_FILE_REQ, nil
+		case D_TEXT_DELIVERED:
+			log.Print("Text Delivered")
+			return CAT_DATA, D_TEXT_DELIVERED, nil
+		case D_TEXT_READ:
+			log.Print("Text Read")
+			return CAT_DATA, D_TEXT_READ, nil
+		case D_TEXT_STATUS:
+			log.Print("Text Status")
+			return CAT_DATA, D_TEXT_STATUS, nil
+		case D_TEXT_EDIT:
+			log.Print("Text Edit")
+			return CAT_DATA, D_TEXT_EDIT, nil
+		case D_TEXT_DELETE:
+			log.Print("Text Delete")
+			return CAT_DATA, D_TEXT_DELETE, nil
+		case D_SYNC:
+			log.Print("Sync")
+			return CAT_DATA, D_SYNC, nil
 		default:
 			log.Printf("Unknown type %d", typ)
 			return NONE, NONE, errors.New("unknown type")
@@ -253,6 +566,33 @@ func CreateLogin(userId uint32, messageId uint32) Header {
 	return header
 }
 
+func CreateNegotiate(userId uint32, messageId uint32, compression []string) (Header, Negotiate) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_NEGOTIATE,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	negotiate := Negotiate{
+		Compression: compression,
+	}
+	return header, negotiate
+}
+
+func CreateError(userId uint32, messageId uint32, code uint32, message string) (Header, Error) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_ERROR,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	errorPacket := Error{
+		Code:    code,
+		Message: message,
+	}
+	return header, errorPacket
+}
+
 func CreateAccount(messageId uint32, username string) (Header, Create) {
 	header := Header{
 		Category:  CAT_CONTACT,
@@ -266,6 +606,61 @@ func CreateAccount(messageId uint32, username string) (Header, Create) {
 	return header, create
 }
 
+// Changes the username of the user. The server answers with the username as
+// it was stored.
+func CreateRename(userId uint32, messageId uint32, username string) (Header, Create) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_RENAME,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	rename := Create{
+		Username: username,
+	}
+	return header, rename
+}
+
+// Deletes the account of the user together with all data stored for it. The
+// server answers with the same header before closing the connection.
+func CreateDeleteAccount(userId uint32, messageId uint32) Header {
+	return Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_DELETE,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+}
+
+func CreateKeyUpload(userId uint32, messageId uint32, identityKey []byte, exchangeKey []byte, exchangeSignature []byte, preKeys []PreKey) (Header, KeyUpload) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_KEYS,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	upload := KeyUpload{
+		IdentityKey:       identityKey,
+		ExchangeKey:       exchangeKey,
+		ExchangeSignature: exchangeSignature,
+		PreKeys:           preKeys,
+	}
+	return header, upload
+}
+
+func CreateKeyBundleRequest(userId uint32, messageId uint32, contactId uint32) (Header, KeyBundle) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_KEY_BUNDLE,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	request := KeyBundle{
+		ContactUserId: contactId,
+	}
+	return header, request
+}
+
 func CreateContactInfo(userId uint32, messageId uint32, username string, image []byte, contactList []uint32) (Header, ContactInfo) {
 	// Divisor should be sized so that the MTU is kept
 	// divisor := 1000.
@@ -283,7 +678,7 @@ func CreateContactInfo(userId uint32, messageId uint32, username string, image [
 		Username:    username,
 		ContactIds:  contactList,
 		ImageBytes:  uint32(len(image)),
-		ImageFormat: "jpeg",
+		ImageFormat: DetectImageFormat(image),
 		Image:       image,
 	}
 	// contactInfoPackets[i] = contactInfoStruct
@@ -292,6 +687,72 @@ func CreateContactInfo(userId uint32, messageId uint32, username string, image [
 	return header, contactInfoStruct
 }
 
+func CreateGroupAction(userId uint32, messageId uint32, action byte, groupId uint32, memberId uint32, name string) (Header, GroupAction) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      action,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	groupAction := GroupAction{
+		GroupId: groupId,
+		UserId:  memberId,
+		Name:    name,
+	}
+	return header, groupAction
+}
+
+func CreateGroupInfo(userId uint32, messageId uint32, groupId uint32, name string, owner uint32, admins []uint32, members []uint32) (Header, GroupInfo) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_GROUP_INFO,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	info := GroupInfo{
+		GroupId: groupId,
+		Name:    name,
+		Owner:   owner,
+		Admins:  admins,
+		Members: members,
+	}
+	return header, info
+}
+
+func CreatePresence(userId uint32, messageId uint32, contactId uint32, online bool, lastSeen uint64) (Header, Presence) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_PRESENCE,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	presence := Presence{
+		ContactUserId: contactId,
+		Online:        online,
+		LastSeen:      lastSeen,
+	}
+	return header, presence
+}
+
+func CreatePresenceRequest(userId uint32, messageId uint32, contactIds []uint32) (Header, PresenceList) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_PRESENCE_REQ,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	request := PresenceList{
+		ContactIds: contactIds,
+	}
+	return header, request
+}
+
+func CreateGroupText(userId uint32, messageId uint32, groupId uint32, text string) (Header, Text) {
+	header, textStruct := CreateText(userId, messageId, 0, text)
+	textStruct.GroupId = groupId
+	return header, textStruct
+}
+
 func CreateText(userId uint32, messageId uint32, contactId uint32, text string) (Header, Text) {
 	header := Header{
 		Category:  CAT_DATA,
@@ -317,11 +778,84 @@ func CreateTextAck(userId uint32, messageId uint32, contactId uint32) (Header, T
 	}
 	ack := TextAck{
 		ContactUserId: contactId,
-		Timestamp:     time.Now().Format("mm:yyyy"),
+		MessageId:     messageId,
+		Timestamp:     uint64(time.Now().UnixMilli()),
 	}
 	return header, ack
 }
 
+// Creates a delivered or read receipt for the text with the given ID, the
+// receipt type is either D_TEXT_DELIVERED or D_TEXT_READ
+func CreateTextReceipt(userId uint32, messageId uint32, receipt byte, contactId uint32, textId uint32) (Header, TextAck) {
+	header := Header{
+		Category:  CAT_DATA,
+		Type:      receipt,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	ack := TextAck{
+		ContactUserId: contactId,
+		MessageId:     textId,
+		Timestamp:     uint64(time.Now().UnixMilli()),
+	}
+	return header, ack
+}
+
+func CreateTextStatus(userId uint32, messageId uint32, textId uint32, receipts []TextReceipt) (Header, TextStatus) {
+	header := Header{
+		Category:  CAT_DATA,
+		Type:      D_TEXT_STATUS,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	status := TextStatus{
+		MessageId: textId,
+		Receipts:  receipts,
+	}
+	return header, status
+}
+
+// Replaces the content of the text with the given ID
+func CreateTextEdit(userId uint32, messageId uint32, contactId uint32, textId uint32, text string) (Header, TextEdit) {
+	header := Header{
+		Category:  CAT_DATA,
+		Type:      D_TEXT_EDIT,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	edit := TextEdit{
+		ContactUserId: contactId,
+		MessageId:     textId,
+		Timestamp:     uint64(time.Now().UnixMilli()),
+		Message:       text,
+	}
+	return header, edit
+}
+
+// Removes the text with the given ID for all recipients
+func CreateTextDelete(userId uint32, messageId uint32, contactId uint32, textId uint32) (Header, TextEdit) {
+	header, edit := CreateTextEdit(userId, messageId, contactId, textId, "")
+	header.Type = D_TEXT_DELETE
+	return header, edit
+}
+
+// Requests the messages of the conversation with the contact, or of the group
+// if the group ID is set, after the given sequence number
+func CreateSync(userId uint32, messageId uint32, contactId uint32, groupId uint32, after uint64) (Header, Sync) {
+	header := Header{
+		Category:  CAT_DATA,
+		Type:      D_SYNC,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	sync := Sync{
+		ContactUserId: contactId,
+		GroupId:       groupId,
+		After:         after,
+	}
+	return header, sync
+}
+
 func CreateContactOption(userId uint32, messageId uint32, contactId uint32, options []Option) (Header, ContactOption) {
 	header := Header{
 		Category:  CAT_CONTACT,
@@ -346,6 +880,21 @@ func CreateContactInfoAck(userId uint32, messageId uint32) Header {
 	return header
 }
 
+func CreateSearch(userId uint32, messageId uint32, identifier string, limit uint32, cursor uint64) (Header, Search) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_SEARCH,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	search := Search{
+		UserIdentifier: identifier,
+		Limit:          limit,
+		Cursor:         cursor,
+	}
+	return header, search
+}
+
 func CreateContactList(userId uint32, messageId uint32, contacts []Contact) (Header, ContactList) {
 	log.Println("Creating contact list packet")
 	header := Header{
@@ -360,6 +909,48 @@ func CreateContactList(userId uint32, messageId uint32, contacts []Contact) (Hea
 	return header, contactList
 }
 
+func CreateContactUpdate(userId uint32, messageId uint32, change string, contact Contact, presence Presence) (Header, ContactUpdate) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_CONTACT_UPD,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	update := ContactUpdate{
+		Change:   change,
+		Contact:  contact,
+		Presence: presence,
+	}
+	return header, update
+}
+
+func CreatePrivacySettings(userId uint32, messageId uint32, settings []Option) (Header, PrivacySettings) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_PRIVACY,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	privacy := PrivacySettings{
+		Settings: settings,
+	}
+	return header, privacy
+}
+
+func CreateProfileRequest(userId uint32, messageId uint32, contactId uint32, version uint64) (Header, ProfileRequest) {
+	header := Header{
+		Category:  CAT_CONTACT,
+		Type:      CON_PROFILE,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	request := ProfileRequest{
+		ContactUserId: contactId,
+		Version:       version,
+	}
+	return header, request
+}
+
 func ConvertContactInfoToClientContactInfo(contactInfo ContactInfo) (ContactInfo, error) {
 	log.Print("Converting the contact information from client to server format, removing all contact IDs")
 	// TODO: Maybe leave the client ID inside (no benefit for now)
@@ -416,6 +1007,29 @@ func CreateFile(userId uint32, messageId uint32) Header {
 	return header
 }
 
+func CreateFileChunk(userId uint32, messageId uint32, offset uint64, data []byte) (Header, File) {
+	header := CreateFile(userId, messageId)
+	file := File{
+		FileOffset: offset,
+		Data:       data,
+	}
+	return header, file
+}
+
+func CreateFileRequest(userId uint32, messageId uint32, contentHash string, offset uint64) (Header, FileRequest) {
+	header := Header{
+		Category:  CAT_DATA,
+		Type:      D_FILE_REQ,
+		UserId:    userId,
+		MessageId: messageId,
+	}
+	request := FileRequest{
+		ContentHash: contentHash,
+		FileOffset:  offset,
+	}
+	return header, request
+}
+
 func CreateFileAck(userId uint32, messageId uint32) Header {
 	header := Header{
 		Category:  CAT_DATA,
@@ -1,9 +1,12 @@
 package packets_test
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
 	"reflect"
 	"testing"
 
@@ -32,7 +35,7 @@ func TestCreationPacket(t *testing.T) {
 	}
 
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x01, 0x05, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x01, 0x05, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
@@ -63,7 +66,7 @@ func TestAccountPacket(t *testing.T) {
 	}
 
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
@@ -110,7 +113,7 @@ func TestContactInfoPacket(t *testing.T) {
 	}
 
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x01, 0x06, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x01, 0x06, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
@@ -137,7 +140,7 @@ func TestText(t *testing.T) {
 		t.Fail()
 	}
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x02, 0x01, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x02, 0x01, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
@@ -149,7 +152,7 @@ func TestText(t *testing.T) {
 	if text.ContactUserId != contactID {
 		t.Fail()
 	}
-	if text.Timestamp == "" {
+	if text.Timestamp == 0 {
 		t.Fail()
 	}
 }
@@ -172,7 +175,7 @@ func TestTextAckPacket(t *testing.T) {
 		t.Fail()
 	}
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x02, 0x02, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x02, 0x02, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
@@ -180,7 +183,29 @@ func TestTextAckPacket(t *testing.T) {
 	if ack.ContactUserId != contactID {
 		t.Fail()
 	}
-	if ack.Timestamp == "" {
+	if ack.Timestamp == 0 {
+		t.Fail()
+	}
+	if ack.MessageId != messageID {
+		t.Fail()
+	}
+}
+
+func TestTextReceiptPacket(t *testing.T) {
+	id := uint32(1234)
+	messageID := uint32(4321)
+	contactID := uint32(9988)
+	textID := uint32(5555)
+	header, receipt := packets.CreateTextReceipt(id, messageID, packets.D_TEXT_READ, contactID, textID)
+	if header.Category != packets.CAT_DATA || header.Type != packets.D_TEXT_READ {
+		t.Fail()
+	}
+	if receipt.ContactUserId != contactID || receipt.MessageId != textID || receipt.Timestamp == 0 {
+		t.Fail()
+	}
+	packet, _ := packets.SerializePacket(header, receipt)
+	decoded, err := packets.DeseralizePacket[packets.TextAck](packet[10:])
+	if err != nil || decoded != receipt {
 		t.Fail()
 	}
 }
@@ -203,7 +228,7 @@ func TestContactListPacket(t *testing.T) {
 		t.Fail()
 	}
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x01, 0x03, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x01, 0x03, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
@@ -242,14 +267,14 @@ func TestFileInfoPacket(t *testing.T) {
 		t.FailNow()
 	}
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x02, 0x03, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x02, 0x03, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
 	}
 	serializedRaw, _ := json.Marshal(info)
 	serialized := string(serializedRaw)
-	compareJson := fmt.Sprintf("{\"FileType\":\"IMAGE\",\"FileName\":\"%s\",\"FileLength\":%d,\"Compression\":\"%s\",\"CompressedLength\":%d,\"FileHash\":%d}", fileName, fileLength, compression, compressionLength, fileHash)
+	compareJson := fmt.Sprintf("{\"ContactUserId\":0,\"Timestamp\":0,\"FileType\":\"IMAGE\",\"FileName\":\"%s\",\"FileLength\":%d,\"Compression\":\"%s\",\"CompressedLength\":%d,\"FileHash\":%d,\"ContentHash\":\"\"}", fileName, fileLength, compression, compressionLength, fileHash)
 	if serialized != compareJson {
 		fmt.Printf("Serialized and expected do not match!\n%s\n%s\n", serialized, compareJson)
 		t.FailNow()
@@ -278,7 +303,7 @@ func TestFileHavePacket(t *testing.T) {
 		t.FailNow()
 	}
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x02, 0x04, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x02, 0x04, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
@@ -310,7 +335,7 @@ func TestFilePacket(t *testing.T) {
 		t.FailNow()
 	}
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x02, 0x05, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x02, 0x05, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
@@ -335,9 +360,22 @@ func TestFileAck(t *testing.T) {
 		t.FailNow()
 	}
 	headerRaw, _ := packets.SerializePacket(header, nil)
-	raw := []byte{0x02, 0x06, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1}
+	raw := []byte{0x02, 0x06, 0x00, 0x00, 0x04, 0xD2, 0x00, 0x00, 0x10, 0xE1, 0x0A}
 	if !reflect.DeepEqual(headerRaw, raw) {
 		fmt.Printf("Headers not equal:\nExpected: %s\nGot: %s\n", hex.Dump(raw), hex.Dump(headerRaw))
 		t.Fail()
 	}
 }
+
+func TestDetectImageFormat(t *testing.T) {
+	var buffer bytes.Buffer
+	png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	_, contact := packets.CreateContactInfo(1234, 4321, "Cloudsheep", buffer.Bytes(), nil)
+	if contact.ImageFormat != packets.IMAGE_PNG {
+		fmt.Printf("Expected png, got %s\n", contact.ImageFormat)
+		t.Fail()
+	}
+	if packets.DetectImageFormat([]byte{1, 2, 3, 4}) != "" {
+		t.Fail()
+	}
+}
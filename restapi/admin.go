@@ -0,0 +1,52 @@
+package restapi
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Token that has to be sent as bearer token to use the admin endpoints. The
+// endpoints are disabled while no token is set.
+var adminToken = ""
+
+// Deletes the account with the given ID, set by the server
+var deleteAccount func(uint32) error
+
+func SetAdminToken(token string) {
+	adminToken = token
+}
+
+func SetAccountDeletion(deletion func(uint32) error) {
+	deleteAccount = deletion
+}
+
+func requireAdmin(c *gin.Context) {
+	expected := "Bearer " + adminToken
+	given := c.GetHeader("Authorization")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "not authorized"})
+		return
+	}
+	c.Next()
+}
+
+func deleteUser(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid user id"})
+		return
+	}
+	if deleteAccount == nil {
+		c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"message": "deletion not available"})
+		return
+	}
+	err = deleteAccount(uint32(userId))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
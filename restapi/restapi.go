@@ -1,6 +1,7 @@
 package restapi
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -52,5 +53,9 @@ func RunRestApi() {
 	router.POST("/albums", postData)
 	router.GET("/albums/:id", getSpecificItem)
 
+	admin := router.Group("/admin", requireAdmin)
+	admin.DELETE("/users/:id", deleteUser)
+	admin.GET("/metrics", gin.WrapH(expvar.Handler()))
+
 	router.Run("localhost:50002")
 }
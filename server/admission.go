@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"anzu.cloudsheeptech.com/apollon"
+	"anzu.cloudsheeptech.com/packets"
+)
+
+// Maximal number of open connections in total and per remote host, zero
+// disables the limit
+var maxConnections = 0
+var maxHostConnections = 0
+
+var openConnections = 0
+var hostConnections = make(map[string]int)
+var admissionLock sync.Mutex
+
+var connectionMetrics = expvar.NewMap("connections")
+var rejectedConnections = new(expvar.Int)
+
+func init() {
+	connectionMetrics.Set("open", expvar.Func(func() any {
+		return OpenConnections()
+	}))
+	connectionMetrics.Set("rejected", rejectedConnections)
+}
+
+func SetAdmissionLimits(total int, perHost int) {
+	admissionLock.Lock()
+	defer admissionLock.Unlock()
+	maxConnections = total
+	maxHostConnections = perHost
+}
+
+func OpenConnections() int {
+	admissionLock.Lock()
+	defer admissionLock.Unlock()
+	return openConnections
+}
+
+// Counts the connection of the host if no limit is reached
+func admit(host string) error {
+	admissionLock.Lock()
+	defer admissionLock.Unlock()
+	if maxConnections > 0 && openConnections >= maxConnections {
+		return errors.New("too many connections")
+	}
+	if maxHostConnections > 0 && hostConnections[host] >= maxHostConnections {
+		return errors.New("too many connections from host")
+	}
+	openConnections++
+	hostConnections[host]++
+	return nil
+}
+
+func release(host string) {
+	admissionLock.Lock()
+	defer admissionLock.Unlock()
+	openConnections--
+	hostConnections[host]--
+	if hostConnections[host] <= 0 {
+		delete(hostConnections, host)
+	}
+}
+
+// Tells the client why the connection is not accepted. The client gets a
+// second to take the error packet.
+func rejectConnection(conn net.Conn, reason error) {
+	log.Printf("Rejecting connection from %s: %s", conn.RemoteAddr(), reason)
+	rejectedConnections.Add(1)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	apollon.SendError(packets.Header{}, packets.ERR_ADMISSION, reason.Error(), conn)
+	conn.Close()
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// Connections run a Noise XX handshake before any Apollon packets are sent.
+// The client learns the static key of the server during the handshake and
+// compares it with the pinned key. Every Noise message is prefixed with its
+// length as two bytes in big endian.
+const NOISE_PROTOCOL = "Noise_XX_25519_AESGCM_SHA256"
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+
+// Noise messages are limited to 65535 bytes including the authentication tag
+const noiseMaxMessage = 65535
+const noiseTagSize = 16
+
+// Time a client has to complete the handshake
+var NoiseHandshakeTimeout = 10 * time.Second
+
+func writeNoiseMessage(conn net.Conn, message []byte) error {
+	if len(message) > noiseMaxMessage {
+		return errors.New("noise message too large")
+	}
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(message)))
+	_, err := conn.Write(append(frame, message...))
+	return err
+}
+
+func readNoiseMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	_, err := io.ReadFull(conn, length[:])
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, message)
+	return message, err
+}
+
+func newHandshakeState(static *ecdh.PrivateKey, initiator bool) (*noise.HandshakeState, error) {
+	return noise.NewHandshakeState(noise.Config{
+		CipherSuite: noiseCipherSuite,
+		Random:      rand.Reader,
+		Pattern:     noise.HandshakeXX,
+		Initiator:   initiator,
+		StaticKeypair: noise.DHKey{
+			Private: static.Bytes(),
+			Public:  static.PublicKey().Bytes(),
+		},
+	})
+}
+
+// Connection that encrypts all data with the keys of the Noise handshake. The
+// handshake is run on the first read or write, like tls.Conn does.
+type NoiseConn struct {
+	net.Conn
+	initiator    bool
+	static       *ecdh.PrivateKey
+	pinned       []byte
+	remoteStatic []byte
+
+	handshakeLock sync.Mutex
+	handshakeErr  error
+	handshakeDone bool
+
+	readLock  sync.Mutex
+	readBuf   []byte
+	receiving *noise.CipherState
+	writeLock sync.Mutex
+	sending   *noise.CipherState
+}
+
+// Wraps a connection accepted by the server
+func NoiseServer(conn net.Conn, static *ecdh.PrivateKey) *NoiseConn {
+	return &NoiseConn{Conn: conn, static: static}
+}
+
+// Wraps a client connection. The handshake fails if the server does not
+// present the pinned public key.
+func NoiseClient(conn net.Conn, static *ecdh.PrivateKey, serverKey []byte) *NoiseConn {
+	return &NoiseConn{Conn: conn, initiator: true, static: static, pinned: serverKey}
+}
+
+// Connects to the Noise listener of the server and runs the handshake. A
+// static key is generated if none is given.
+func DialNoise(address string, serverKey []byte, static *ecdh.PrivateKey) (*NoiseConn, error) {
+	if static == nil {
+		var err error
+		static, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	noiseConn := NoiseClient(conn, static, serverKey)
+	err = noiseConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return noiseConn, nil
+}
+
+// Static public key of the other side, only known after the handshake
+func (c *NoiseConn) RemoteStatic() []byte {
+	return c.remoteStatic
+}
+
+func (c *NoiseConn) Handshake() error {
+	c.handshakeLock.Lock()
+	defer c.handshakeLock.Unlock()
+	if c.handshakeDone {
+		return c.handshakeErr
+	}
+	c.handshakeDone = true
+	c.Conn.SetDeadline(time.Now().Add(NoiseHandshakeTimeout))
+	if c.initiator {
+		c.handshakeErr = c.initiatorHandshake()
+	} else {
+		c.handshakeErr = c.responderHandshake()
+	}
+	c.Conn.SetDeadline(time.Time{})
+	if c.handshakeErr != nil {
+		log.Printf("Noise handshake with %s failed: %s", c.RemoteAddr(), c.handshakeErr)
+	}
+	return c.handshakeErr
+}
+
+func (c *NoiseConn) initiatorHandshake() error {
+	state, err := newHandshakeState(c.static, true)
+	if err != nil {
+		return err
+	}
+
+	// -> e
+	message, _, _, err := state.WriteMessage(nil, nil)
+	if err != nil {
+		return err
+	}
+	err = writeNoiseMessage(c.Conn, message)
+	if err != nil {
+		return err
+	}
+
+	// <- e, ee, s, es
+	message, err = readNoiseMessage(c.Conn)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = state.ReadMessage(nil, message)
+	if err != nil {
+		return err
+	}
+	remoteStatic := state.PeerStatic()
+	if c.pinned != nil && subtle.ConstantTimeCompare(remoteStatic, c.pinned) != 1 {
+		return errors.New("server key does not match the pinned key")
+	}
+
+	// -> s, se
+	message, sending, receiving, err := state.WriteMessage(nil, nil)
+	if err != nil {
+		return err
+	}
+	err = writeNoiseMessage(c.Conn, message)
+	if err != nil {
+		return err
+	}
+	c.remoteStatic = remoteStatic
+	c.sending, c.receiving = sending, receiving
+	return nil
+}
+
+func (c *NoiseConn) responderHandshake() error {
+	state, err := newHandshakeState(c.static, false)
+	if err != nil {
+		return err
+	}
+
+	// -> e
+	message, err := readNoiseMessage(c.Conn)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = state.ReadMessage(nil, message)
+	if err != nil {
+		return err
+	}
+
+	// <- e, ee, s, es
+	message, _, _, err = state.WriteMessage(nil, nil)
+	if err != nil {
+		return err
+	}
+	err = writeNoiseMessage(c.Conn, message)
+	if err != nil {
+		return err
+	}
+
+	// -> s, se
+	message, err = readNoiseMessage(c.Conn)
+	if err != nil {
+		return err
+	}
+	_, receiving, sending, err := state.ReadMessage(nil, message)
+	if err != nil {
+		return err
+	}
+	c.remoteStatic = state.PeerStatic()
+	c.receiving, c.sending = receiving, sending
+	return nil
+}
+
+func (c *NoiseConn) Read(b []byte) (int, error) {
+	err := c.Handshake()
+	if err != nil {
+		return 0, err
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for len(c.readBuf) == 0 {
+		message, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf, err = c.receiving.Decrypt(nil, nil, message)
+		if err != nil {
+			return 0, err
+		}
+	}
+	read := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[read:]
+	return read, nil
+}
+
+func (c *NoiseConn) Write(b []byte) (int, error) {
+	err := c.Handshake()
+	if err != nil {
+		return 0, err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	written := 0
+	for written < len(b) {
+		size := len(b) - written
+		if size > noiseMaxMessage-noiseTagSize {
+			size = noiseMaxMessage - noiseTagSize
+		}
+		message, err := c.sending.Encrypt(nil, nil, b[written:written+size])
+		if err != nil {
+			return written, err
+		}
+		err = writeNoiseMessage(c.Conn, message)
+		if err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// Wraps every accepted connection into a Noise connection
+type noiseListener struct {
+	net.Listener
+	static *ecdh.PrivateKey
+}
+
+func (l noiseListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NoiseServer(conn, l.static), nil
+}
+
+func NoiseListen(address string, static *ecdh.PrivateKey) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return noiseListener{Listener: listener, static: static}, nil
+}
+
+// Reads the hex encoded static private key of the server. The error wraps
+// os.ErrNotExist if the file does not exist.
+func LoadNoiseKey(file string) (*ecdh.PrivateKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.New("invalid noise key file")
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// Creates a new static private key and writes it hex encoded to the file. An
+// existing file is never overwritten.
+func CreateNoiseKey(file string) (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer keyFile.Close()
+	_, err = keyFile.WriteString(hex.EncodeToString(key.Bytes()) + "\n")
+	if err != nil {
+		return nil, err
+	}
+	return key, keyFile.Close()
+}
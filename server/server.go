@@ -2,6 +2,8 @@ package server
 
 import (
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"log"
 	"net"
 	"os"
@@ -13,6 +15,7 @@ import (
 )
 
 var listen net.Listener
+var noiseListen net.Listener
 var running bool
 var db map[uint32]net.Conn = make(map[uint32]net.Conn)
 
@@ -21,6 +24,24 @@ func Start(config configuration.Config) {
 
 	database.SetDatabaseLocation(config.DatabaseFile)
 	database.SetDatabaseNoWrite(config.DatabaseNoWrite)
+	if config.FileDirectory != "" {
+		err := database.SetFileDirectory(config.FileDirectory)
+		if err != nil {
+			log.Fatalf("Failed to open file directory: %s", err.Error())
+		}
+	}
+	if config.UsernameMaxLength > 0 {
+		database.SetUsernameRules(database.UsernameRules{
+			MinLength:         config.UsernameMinLength,
+			MaxLength:         config.UsernameMaxLength,
+			AllowedSymbols:    config.UsernameSymbols,
+			DetectConfusables: config.DetectConfusables,
+			Unique:            config.UniqueUsernames,
+		})
+	}
+	if config.DedupSize > 0 {
+		database.SetDedupWindow(config.DedupWindow, config.DedupSize)
+	}
 	if config.ClearDatabase {
 		database.Delete()
 		log.Print("Cleared the database")
@@ -61,8 +82,31 @@ func Start(config configuration.Config) {
 	// dbWriteChannel := make(chan apollontypes.User)
 	// go database.UpdateDatabase(dbWriteChannel)
 
-	if config.RestApi {
-		go restapi.RunRestApi()
+	if config.FileGCInterval > 0 {
+		go database.GarbageCollection(config.FileGCInterval)
+	}
+
+	err = apollon.SetRateLimits(config.RateLimits)
+	if err != nil {
+		log.Fatalf("Failed to set rate limits: %s", err.Error())
+	}
+
+	if config.MaxFrameSize > 0 {
+		apollon.SetDefaultFrameLimit(config.MaxFrameSize)
+	}
+	err = apollon.SetFrameLimits(config.FrameLimits)
+	if err != nil {
+		log.Fatalf("Failed to set frame limits: %s", err.Error())
+	}
+
+	SetAdmissionLimits(config.MaxConnections, config.MaxHostConnections)
+	apollon.SetLoginTimeout(config.LoginTimeout)
+	apollon.SetOutboundLimits(config.OutboundQueueSize, config.WriteTimeout)
+	apollon.SetDeliveryTimeout(config.DeliveryTimeout)
+	database.SetHistoryRetention(config.HistoryRetention)
+
+	if config.MaxImageDimension > 0 {
+		apollon.SetMaxImageDimension(config.MaxImageDimension)
 	}
 
 	forwardC := make(chan apollon.ForwardMessage, 20)
@@ -72,15 +116,47 @@ func Start(config configuration.Config) {
 	go apollon.ForwardingPackets(forwardC, db)
 	go apollon.CheckUserOnline(onlineC, db)
 
+	if config.RestApi {
+		restapi.SetAdminToken(config.AdminToken)
+		restapi.SetAccountDeletion(func(userId uint32) error {
+			return apollon.DeleteAccount(userId, onlineC, forwardC, newConnC)
+		})
+		go restapi.RunRestApi()
+	}
+
 	// var db database.Database
 	// if err != nil {
 	// 	log.Printf("%s", err)
 	// 	return
 	// }
 
+	if config.Noise {
+		noiseAddr := config.ListenAddr + ":" + config.NoiseListenPort
+		key, err := LoadNoiseKey(config.NoiseKeyfile)
+		if errors.Is(err, os.ErrNotExist) && config.NoiseCreateKey {
+			log.Printf("WARNING: Noise key '%s' does not exist, creating a new one. Clients pinning the old key can no longer connect!", config.NoiseKeyfile)
+			key, err = CreateNoiseKey(config.NoiseKeyfile)
+		}
+		if err != nil {
+			log.Fatalf("Failed to load Noise key: %s", err.Error())
+		}
+		log.Printf("Noise public key: %s", hex.EncodeToString(key.PublicKey().Bytes()))
+		noiseListen, err = NoiseListen(noiseAddr, key)
+		if err != nil {
+			log.Fatalf("Failed to listen on '%s': %s", noiseAddr, err.Error())
+		}
+		log.Printf("Listing on '%s'", noiseAddr)
+		defer noiseListen.Close()
+		go acceptClients(noiseListen, forwardC, newConnC, onlineC)
+	}
+
+	acceptClients(listen, forwardC, newConnC, onlineC)
+}
+
+func acceptClients(listener net.Listener, forwardC chan apollon.ForwardMessage, newConnC chan apollon.ConnMessage, onlineC chan apollon.OnlineMessage) {
 	for {
 		log.Println("Waiting for connecting client...")
-		conn, err := listen.Accept()
+		conn, err := listener.Accept()
 
 		if err != nil {
 			log.Printf("Failed to accept client: %s", err.Error())
@@ -92,9 +168,19 @@ func Start(config configuration.Config) {
 			continue
 		}
 
+		host := apollon.RemoteHost(conn)
+		err = admit(host)
+		if err != nil {
+			go rejectConnection(conn, err)
+			continue
+		}
+
 		log.Printf("Client from %s accepted", conn.RemoteAddr().String())
 		// This method is generic enough (only one param, the net.Conn) so that many different functionalites can be used and implemented with this simple code snippet
-		go apollon.HandleClient(conn, forwardC, newConnC, onlineC)
+		go func() {
+			defer release(host)
+			apollon.HandleClient(conn, forwardC, newConnC, onlineC)
+		}()
 
 		if !running {
 			break
@@ -106,6 +192,9 @@ func Stop() {
 	// Stop listening
 	running = false
 	listen.Close()
+	if noiseListen != nil {
+		noiseListen.Close()
+	}
 	// Closing all running clients the hard way (TODO: fix this)
 	os.Exit(0)
 }